@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"net"
 	"os"
@@ -12,8 +13,16 @@ import (
 	"github.com/negasus/tlog"
 
 	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/auth"
 	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/encryption"
+	"github.com/ssqueue/ssqueue/internal/front/beanstalk"
 	"github.com/ssqueue/ssqueue/internal/front/http"
+	"github.com/ssqueue/ssqueue/internal/front/mqtt"
+	"github.com/ssqueue/ssqueue/internal/front/sqs"
+	"github.com/ssqueue/ssqueue/internal/front/stomp"
+	"github.com/ssqueue/ssqueue/internal/ratelimit"
 	"github.com/ssqueue/ssqueue/internal/service"
 )
 
@@ -52,19 +61,93 @@ func run(ctx context.Context, cfg *config.Config, h *tlog.Handler) error {
 
 	slog.Info("starting application", "version", version)
 
-	app := application.New()
+	keys, errKeys := encryption.Load(cfg.Encryption.KeyFile, cfg.Encryption.Keys)
+	if errKeys != nil {
+		return errKeys
+	}
+	if cfg.Encryption.MigratePlaintext && keys != nil {
+		keys.AllowPlaintext()
+		slog.Warn("unencrypted files are accepted, disable the plaintext migration after this start")
+	}
+
+	var auditLog *audit.Log
+	if cfg.AuditFile != "" {
+		var errAudit error
+		auditLog, errAudit = audit.Open(cfg.AuditFile, keys)
+		if errAudit != nil {
+			return errAudit
+		}
+		defer func() {
+			_ = auditLog.Close()
+		}()
+	}
 
+	limiter := ratelimit.New()
+	app := application.New(cfg, auditLog, limiter)
+
+	tokens := auth.NewTokens()
+	serviceTokens := auth.NewTokens()
+	acl := auth.NewACL(auditLog)
+
+	// topics are declared and tokens are set before listeners open, so the first requests already get them.
+	// An invalid file stops the start before the snapshot is touched.
+	r := &reloader{file: cfg.File, app: app, tokens: tokens, serviceTokens: serviceTokens, acl: acl, limiter: limiter, audit: auditLog}
+	if cfg.File != "" {
+		errReload := r.reload()
+		if errReload != nil {
+			return errReload
+		}
+	}
+
+	// the restored snapshot is removed only when the next one is saved, so messages survive a failed start
+	var restored string
 	if !cfg.Snapshot.Disable {
-		errSnapshot := fromSnapshot(cfg.Snapshot.Path, app)
+		var errSnapshot error
+		restored, errSnapshot = fromSnapshot(cfg.Snapshot.Path, app, keys, auditLog)
 		if errSnapshot != nil {
 			slog.Error("error restore from snapshot", "err", errSnapshot)
 		}
 	}
 
+	wg.Add(1)
+	go r.run(ctx, &wg)
+
 	wg.Add(1)
 	go app.Run(ctx, &wg)
 
-	lnMain, errLnMain := net.Listen("tcp", cfg.Address)
+	wg.Add(1)
+	go limiter.Run(ctx, &wg)
+
+	wg.Add(1)
+	go acl.Run(ctx, &wg)
+
+	listen := func(address string) (net.Listener, error) {
+		return net.Listen("tcp", address)
+	}
+	listenService := listen
+	if cfg.TLS.CertFile != "" {
+		certs, errCerts := auth.NewCertificates(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if errCerts != nil {
+			return errCerts
+		}
+
+		wg.Add(1)
+		go certs.Run(ctx, &wg)
+
+		tlsConfig := certs.Config()
+		listen = func(address string) (net.Listener, error) {
+			return tls.Listen("tcp", address, tlsConfig)
+		}
+
+		// the service server is authenticated by service tokens only, client certificates of the API grant nothing there
+		// and the liveness probe is reachable without one
+		serviceTLSConfig := certs.ServerConfig()
+		listenService = func(address string) (net.Listener, error) {
+			return tls.Listen("tcp", address, serviceTLSConfig)
+		}
+	}
+
+	lnMain, errLnMain := listen(cfg.Address)
 	if errLnMain != nil {
 		return errLnMain
 	}
@@ -72,12 +155,68 @@ func run(ctx context.Context, cfg *config.Config, h *tlog.Handler) error {
 		_ = lnMain.Close()
 	}()
 
-	srvMain := http.New(app)
+	srvMain := http.New(app, tokens, acl)
 	wg.Add(1)
 	go srvMain.Run(ctx, &wg, lnMain)
 
+	if cfg.SQSAddress != "" {
+		lnSQS, errLnSQS := listen(cfg.SQSAddress)
+		if errLnSQS != nil {
+			return errLnSQS
+		}
+		defer func() {
+			_ = lnSQS.Close()
+		}()
+
+		srvSQS := sqs.New(app, tokens, acl)
+		wg.Add(1)
+		go srvSQS.Run(ctx, &wg, lnSQS)
+	}
+
+	if cfg.STOMPAddress != "" {
+		lnSTOMP, errLnSTOMP := listen(cfg.STOMPAddress)
+		if errLnSTOMP != nil {
+			return errLnSTOMP
+		}
+		defer func() {
+			_ = lnSTOMP.Close()
+		}()
+
+		srvSTOMP := stomp.New(app, tokens, acl)
+		wg.Add(1)
+		go srvSTOMP.Run(ctx, &wg, lnSTOMP)
+	}
+
+	if cfg.MQTTAddress != "" {
+		lnMQTT, errLnMQTT := listen(cfg.MQTTAddress)
+		if errLnMQTT != nil {
+			return errLnMQTT
+		}
+		defer func() {
+			_ = lnMQTT.Close()
+		}()
+
+		srvMQTT := mqtt.New(app, tokens, acl)
+		wg.Add(1)
+		go srvMQTT.Run(ctx, &wg, lnMQTT)
+	}
+
+	if cfg.BeanstalkAddress != "" {
+		lnBeanstalk, errLnBeanstalk := listen(cfg.BeanstalkAddress)
+		if errLnBeanstalk != nil {
+			return errLnBeanstalk
+		}
+		defer func() {
+			_ = lnBeanstalk.Close()
+		}()
+
+		srvBeanstalk := beanstalk.New(app, tokens, acl)
+		wg.Add(1)
+		go srvBeanstalk.Run(ctx, &wg, lnBeanstalk)
+	}
+
 	if cfg.ServiceAddress != "" {
-		lnService, errLnService := net.Listen("tcp", cfg.ServiceAddress)
+		lnService, errLnService := listenService(cfg.ServiceAddress)
 		if errLnService != nil {
 			return errLnService
 		}
@@ -85,7 +224,7 @@ func run(ctx context.Context, cfg *config.Config, h *tlog.Handler) error {
 			_ = lnService.Close()
 		}()
 
-		srv := service.New(h)
+		srv := service.New(h, app, serviceTokens, auditLog)
 
 		wg.Add(1)
 		go srv.Run(ctx, &wg, lnService)
@@ -96,7 +235,7 @@ func run(ctx context.Context, cfg *config.Config, h *tlog.Handler) error {
 	wg.Wait()
 
 	if !cfg.Snapshot.Disable {
-		errToSnapshot := toSnapshot(cfg.Snapshot.Path, app)
+		errToSnapshot := toSnapshot(cfg.Snapshot.Path, app, keys, auditLog, restored)
 		if errToSnapshot != nil {
 			slog.Error("error save to snapshot", "err", errToSnapshot)
 		}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/ratelimit"
+)
+
+// reloader applies the configuration file at start and again on SIGHUP
+type reloader struct {
+	file          string
+	app           *application.Application
+	tokens        *auth.Tokens
+	serviceTokens *auth.Tokens
+	acl           *auth.ACL
+	limiter       *ratelimit.Limiter
+	audit         *audit.Log
+}
+
+func (r *reloader) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+
+		if r.file == "" {
+			slog.Warn("no config file to reload")
+			continue
+		}
+
+		errReload := r.reload()
+		if errReload != nil {
+			slog.Error("error reload config file, nothing is changed", "err", errReload)
+			r.audit.Record(audit.ActionConfigReload, "", "", "failed: "+errReload.Error())
+		}
+	}
+}
+
+// reload reads and validates the whole file before any of its settings are applied
+func (r *reloader) reload() error {
+	f, errLoad := config.LoadFile(r.file)
+	if errLoad != nil {
+		return errLoad
+	}
+
+	changes := r.app.ApplyTopics(f.Topics)
+	changes = append(changes, r.app.ApplyTenants(f.Tenants)...)
+	changes = append(changes, tokenChanges("token", r.tokens, f.Tokens)...)
+	changes = append(changes, tokenChanges("service token", r.serviceTokens, f.ServiceTokens)...)
+	if r.acl.Set(f.ACL) {
+		changes = append(changes, "acl rules replaced, "+strconv.Itoa(len(f.ACL))+" rules")
+	}
+	if r.limiter.Set(f.RateLimits) {
+		changes = append(changes, "rate limits replaced, "+strconv.Itoa(len(f.RateLimits))+" limits")
+	}
+
+	for _, change := range changes {
+		slog.Info("config changed", "file", r.file, "change", change)
+	}
+	if len(changes) == 0 {
+		slog.Info("config not changed", "file", r.file)
+	}
+	r.audit.Record(audit.ActionConfigReload, "", "", strings.Join(changes, "; "))
+
+	return nil
+}
+
+// tokenChanges sets the tokens and describes the change by token names, tokens themselves are never logged
+func tokenChanges(kind string, tokens *auth.Tokens, set []config.Token) []string {
+	added, removed := tokens.Set(set)
+
+	var changes []string
+	if len(added) > 0 {
+		changes = append(changes, kind+"s added: "+strings.Join(added, ", "))
+	}
+	if len(removed) > 0 {
+		changes = append(changes, kind+"s removed: "+strings.Join(removed, ", "))
+	}
+
+	return changes
+}
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/encryption"
 )
 
 const (
@@ -26,7 +28,7 @@ func loadLastSnapshot(snapshotPath string) (filename string, data []byte, err er
 	}
 	// Find the latest snapshot by name (assuming lexicographical order corresponds to creation time)
 	var latest os.DirEntry
-	for _, entry := range entries[1:] {
+	for _, entry := range entries {
 		if !strings.HasPrefix(entry.Name(), snapshotFilePrefix) || !strings.HasSuffix(entry.Name(), snapshotFileExt) {
 			continue
 		}
@@ -62,7 +64,8 @@ func saveSnapshot(snapshotPath string, data []byte) (filename string, err error)
 	return filename, nil
 }
 
-func toSnapshot(snapshotPath string, app *application.Application) error {
+// toSnapshot saves the snapshot and then removes the restored one, which is not needed anymore
+func toSnapshot(snapshotPath string, app *application.Application, keys *encryption.Keys, auditLog *audit.Log, restored string) error {
 	if !strings.HasPrefix(snapshotPath, "/") {
 		wd, errWd := os.Getwd()
 		if errWd == nil {
@@ -77,19 +80,41 @@ func toSnapshot(snapshotPath string, app *application.Application) error {
 
 	if len(data) == 0 {
 		slog.Info("no data to snapshot")
+		removeSnapshot(snapshotPath, restored)
 		return nil
 	}
 
+	data, errSnapshot = keys.Encrypt(data)
+	if errSnapshot != nil {
+		return fmt.Errorf("encrypting snapshot failed: %s", errSnapshot.Error())
+	}
+
 	filename, errSave := saveSnapshot(snapshotPath, data)
 	if errSave != nil {
+		auditLog.Record(audit.ActionSnapshotSave, "", "", "failed: "+errSave.Error())
 		return fmt.Errorf("saving snapshot failed: %s", errSave.Error())
 	}
+	auditLog.Record(audit.ActionSnapshotSave, "", "", filename)
+	removeSnapshot(snapshotPath, restored)
 
-	slog.Info("saved snapshot", slog.String("snapshot", filename))
+	slog.Info("saved snapshot", slog.String("snapshot", filename), slog.String("key", keys.Current()))
 	return nil
 }
 
-func fromSnapshot(snapshotPath string, app *application.Application) error {
+// removeSnapshot removes the snapshot file, an empty name is ignored
+func removeSnapshot(snapshotPath string, filename string) {
+	if filename == "" {
+		return
+	}
+
+	errRemove := os.Remove(path.Join(snapshotPath, filename))
+	if errRemove != nil {
+		slog.Warn("removing snapshot file failed", slog.String("snapshot", filename), slog.String("error", errRemove.Error()))
+	}
+}
+
+// fromSnapshot restores the last snapshot and returns its file name, the file is kept until the next snapshot is saved
+func fromSnapshot(snapshotPath string, app *application.Application, keys *encryption.Keys, auditLog *audit.Log) (string, error) {
 	if !strings.HasPrefix(snapshotPath, "/") {
 		wd, errWd := os.Getwd()
 		if errWd == nil {
@@ -99,24 +124,27 @@ func fromSnapshot(snapshotPath string, app *application.Application) error {
 
 	snapshotFilename, snapshotData, errLoadSnapshot := loadLastSnapshot(snapshotPath)
 	if errLoadSnapshot != nil {
-		return fmt.Errorf("loading last snapshot failed: %s", errLoadSnapshot.Error())
+		return "", fmt.Errorf("loading last snapshot failed: %s", errLoadSnapshot.Error())
 	}
 
 	if snapshotFilename == "" {
 		slog.Info("no snapshots found", "path", snapshotPath)
-		return nil
+		return "", nil
 	}
 
-	errSnapshot := app.FromSnapshot(snapshotData)
-	if errSnapshot != nil {
-		return fmt.Errorf("restoring from snapshot %q failed: %s", snapshotFilename, errSnapshot.Error())
+	snapshotData, errDecrypt := keys.Decrypt(snapshotData)
+	if errDecrypt != nil {
+		auditLog.Record(audit.ActionSnapshotRestore, "", "", snapshotFilename+" failed: "+errDecrypt.Error())
+		return "", fmt.Errorf("decrypting snapshot %q failed: %s", snapshotFilename, errDecrypt.Error())
 	}
 
-	errRemove := os.Remove(path.Join(snapshotPath, snapshotFilename))
-	if errRemove != nil {
-		slog.Warn("removing snapshot file failed", slog.String("snapshot", snapshotFilename), slog.String("error", errRemove.Error()))
+	errSnapshot := app.FromSnapshot(snapshotData)
+	if errSnapshot != nil {
+		auditLog.Record(audit.ActionSnapshotRestore, "", "", snapshotFilename+" failed: "+errSnapshot.Error())
+		return "", fmt.Errorf("restoring from snapshot %q failed: %s", snapshotFilename, errSnapshot.Error())
 	}
 
+	auditLog.Record(audit.ActionSnapshotRestore, "", "", snapshotFilename)
 	slog.Info("restored from snapshot", slog.String("snapshot", snapshotFilename))
-	return nil
+	return snapshotFilename, nil
 }
@@ -3,21 +3,71 @@ package application
 import (
 	"context"
 	"encoding/json"
+	"log/slog"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/config"
 	"github.com/ssqueue/ssqueue/internal/queue"
+	"github.com/ssqueue/ssqueue/internal/ratelimit"
+)
+
+const (
+	maintenanceInterval = time.Second
+
+	// replyTopicPrefix marks temporary reply topics, they are removed when idle
+	replyTopicPrefix = "reply."
 )
 
 type Application struct {
 	ready int64
 	qMu   sync.RWMutex
 	q     map[string]*queue.Queue
+	// declared topics are created explicitly, they are not removed when idle
+	declared map[string]struct{}
+	// topics are settings from the configuration file
+	topics        map[string]config.Topic
+	tenants       []config.Tenant
+	dedupWindow   time.Duration
+	replyTopicTTL time.Duration
+	topicIdleTTL  time.Duration
+	strictTopics  bool
+	// defaultMaxMessageSize applies to topics without their own max message size, zero is unlimited
+	defaultMaxMessageSize int
+	audit                 *audit.Log
+	// accounts of tenants by name, they count usage of the tenant topics
+	accounts map[string]*queue.Account
+	// largestTopicMessageSize is the largest max message size of declared topics, it is kept for request size limits
+	largestTopicMessageSize int
+	// groupHold is how long the group of a message taken by get stays busy
+	groupHold time.Duration
+	// topicMetrics are sets of per-topic metrics, a set is unregistered together with its topic
+	topicMetrics map[string]*metrics.Set
+	// limiter throttles sends and gets of all fronts
+	limiter *ratelimit.Limiter
 }
 
-func New() *Application {
+func New(cfg *config.Config, auditLog *audit.Log, limiter *ratelimit.Limiter) *Application {
 	app := &Application{
-		q: make(map[string]*queue.Queue),
+		q:                     make(map[string]*queue.Queue),
+		declared:              make(map[string]struct{}),
+		topics:                make(map[string]config.Topic),
+		accounts:              make(map[string]*queue.Account),
+		topicMetrics:          make(map[string]*metrics.Set),
+		dedupWindow:           cfg.DedupWindow,
+		replyTopicTTL:         cfg.ReplyTopicTTL,
+		topicIdleTTL:          cfg.TopicIdleTTL,
+		strictTopics:          cfg.StrictTopics,
+		defaultMaxMessageSize: cfg.MaxMessageSize,
+		audit:                 auditLog,
+		groupHold:             cfg.GroupHold,
+		limiter:               limiter,
 	}
 
 	return app
@@ -28,9 +78,116 @@ func (app *Application) Run(ctx context.Context, wg *sync.WaitGroup) {
 
 	atomic.StoreInt64(&app.ready, 1)
 
-	<-ctx.Done()
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			atomic.StoreInt64(&app.ready, 0)
+			return
+		case now := <-ticker.C:
+			app.maintenance(now)
+		}
+	}
+}
+
+// maintenance returns items with expired leases back to their queues, drops expired idempotency keys and messages,
+// moves dead messages to dead letter topics and removes idle topics
+func (app *Application) maintenance(now time.Time) {
+	app.qMu.RLock()
+	var idle []string
+	dead := make(map[string][]*queue.Item)
+	for topic, q := range app.q {
+		q.Requeue(now)
+		q.ForgetExpired(now)
+		if items := app.expire(now, topic, q); len(items) > 0 {
+			dead[topic] = items
+		}
+		if ttl := app.idleTTL(topic); ttl > 0 && now.Sub(q.UsedAt()) > ttl {
+			idle = append(idle, topic)
+		}
+	}
+	app.qMu.RUnlock()
+
+	for topic, items := range dead {
+		app.deadLetter(topic, items)
+	}
+
+	for _, topic := range idle {
+		app.removeIdle(topic, now)
+	}
+}
+
+// idleTTL returns how long the topic is kept unused, zero for topics which are never removed, qMu must be locked.
+// Created and configured topics are kept even with the reply prefix.
+// With strict topics no topic but reply ones is removed, as it could not be created again.
+func (app *Application) idleTTL(topic string) time.Duration {
+	if _, ok := app.declared[topic]; ok {
+		return 0
+	}
+	if _, ok := app.topics[topic]; ok {
+		return 0
+	}
+	if strings.HasPrefix(topic, replyTopicPrefix) {
+		return app.replyTopicTTL
+	}
+	if app.strictTopics {
+		return 0
+	}
+
+	return app.topicIdleTTL
+}
+
+// removeIdle removes the topic if it is still idle, empty and has no consumers.
+// Everything is checked again under the write lock, as the topic may have been used since maintenance found it idle.
+func (app *Application) removeIdle(topic string, now time.Time) {
+	app.qMu.Lock()
+	defer app.qMu.Unlock()
+
+	q, ok := app.q[topic]
+	if !ok {
+		return
+	}
+	ttl := app.idleTTL(topic)
+	if ttl == 0 || now.Sub(q.UsedAt()) <= ttl || q.ConsumersCount() > 0 || !q.IsEmpty() {
+		return
+	}
+	app.removeLocked(topic, q)
+
+	slog.Debug("idle topic removed", slog.String("topic", topic))
+}
+
+// removeLocked removes the topic with its metrics and wakes up its consumers, qMu must be locked
+func (app *Application) removeLocked(topic string, q *queue.Queue) {
+	delete(app.q, topic)
+	delete(app.declared, topic)
+	q.Close()
+	q.SetAccount(nil)
+
+	if set, ok := app.topicMetrics[topic]; ok {
+		delete(app.topicMetrics, topic)
+		metrics.UnregisterSet(set, true)
+	}
+}
+
+// counter returns the counter of the topic from its metric set.
+// Counters of removed topics are not exported, so late updates do not bring their series back.
+func (app *Application) counter(topic string, name string) *metrics.Counter {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	return app.counterLocked(topic, name)
+}
+
+// counterLocked is counter with qMu locked
+func (app *Application) counterLocked(topic string, name string) *metrics.Counter {
+	set, ok := app.topicMetrics[topic]
+	if !ok {
+		return &metrics.Counter{}
+	}
 
-	atomic.StoreInt64(&app.ready, 0)
+	return set.GetOrCreateCounter(name + "{topic=\"" + topic + "\"}")
 }
 
 func (app *Application) FromSnapshot(src []byte) error {
@@ -41,7 +198,7 @@ func (app *Application) FromSnapshot(src []byte) error {
 	}
 
 	for topic, data := range snapshots {
-		q := app.getQueue(topic)
+		q := app.createQueue(topic)
 		app.qMu.Lock()
 		err := q.FromSnapshot([]byte(data))
 		app.qMu.Unlock()
@@ -60,6 +217,9 @@ func (app *Application) ToSnapshot() ([]byte, error) {
 	snapshots := make(map[string]string)
 
 	for topic, q := range app.q {
+		if t, ok := app.topics[topic]; ok && !t.IsDurable() {
+			continue
+		}
 		data, err := q.ToSnapshot()
 		if err != nil {
 			return nil, err
@@ -77,7 +237,44 @@ func (app *Application) ToSnapshot() ([]byte, error) {
 	return json.Marshal(snapshots)
 }
 
-func (app *Application) getQueue(topic string) *queue.Queue {
+// getQueue creates unknown topics unless topics are strict, temporary reply topics are created in any case
+func (app *Application) getQueue(topic string) (*queue.Queue, error) {
+	if !ValidTopic(topic) {
+		return nil, ErrInvalidTopic
+	}
+
+	// the queue is marked as used under the lock, so it is not removed as idle before the caller uses it
+	app.qMu.RLock()
+	q := app.q[topic]
+	if q != nil {
+		q.Use()
+	}
+	app.qMu.RUnlock()
+	if q != nil {
+		return q, nil
+	}
+	if app.strictTopics && !strings.HasPrefix(topic, replyTopicPrefix) {
+		return nil, ErrTopicNotFound
+	}
+
+	app.qMu.Lock()
+	defer app.qMu.Unlock()
+
+	q, ok := app.q[topic]
+	if ok {
+		q.Use()
+		return q, nil
+	}
+	// quotas are checked for topics created by clients only, restored and dead letter topics are created anyway
+	errQuota := app.checkTopicsLocked(topic)
+	if errQuota != nil {
+		return nil, errQuota
+	}
+
+	return app.newQueueLocked(topic), nil
+}
+
+func (app *Application) createQueue(topic string) *queue.Queue {
 	app.qMu.RLock()
 	q, ok := app.q[topic]
 	app.qMu.RUnlock()
@@ -93,8 +290,26 @@ func (app *Application) getQueue(topic string) *queue.Queue {
 		return q
 	}
 
-	q = queue.New(topic)
-	app.q[topic] = q
+	return app.newQueueLocked(topic)
+}
+
+// lookupQueue returns nil for unknown topics instead of creating them
+func (app *Application) lookupQueue(topic string) *queue.Queue {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	return app.q[topic]
+}
+
+func (app *Application) Topics(_ context.Context) []string {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	topics := make([]string, 0, len(app.q))
+	for topic := range app.q {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
 
-	return q
+	return topics
 }
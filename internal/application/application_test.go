@@ -0,0 +1,430 @@
+package application
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+	"github.com/ssqueue/ssqueue/internal/ratelimit"
+)
+
+// newApp returns the ready application, maintenance is run by tests when they need it
+func newApp(cfg *config.Config) *Application {
+	app := New(cfg, nil, ratelimit.New())
+	atomic.StoreInt64(&app.ready, 1)
+
+	return app
+}
+
+// cancelled returns a done context, the queue is still checked for an available message before waiting
+func cancelled() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	return ctx
+}
+
+// get takes a message without waiting, nil if there is none
+func get(t *testing.T, app *Application, topic string) *messages.OutputMessage {
+	t.Helper()
+
+	om, errGet := app.Get(cancelled(), topic, nil)
+	if errGet != nil {
+		t.Fatalf("get: %v", errGet)
+	}
+
+	return om
+}
+
+func TestValidTopic(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{name: "default", valid: true},
+		{name: "orders.eu-1/(a);$_+", valid: true},
+		{name: "", valid: false},
+		{name: "-orders", valid: false},
+		{name: "orders eu", valid: false},
+		{name: "orders*", valid: false},
+		{name: `a"b`, valid: false},
+		{name: "a\nb", valid: false},
+		{name: strings.Repeat("a", maxTopicName), valid: true},
+		{name: strings.Repeat("a", maxTopicName+1), valid: false},
+	}
+
+	for _, tt := range tests {
+		if got := ValidTopic(tt.name); got != tt.valid {
+			t.Errorf("ValidTopic(%q) = %v, want %v", tt.name, got, tt.valid)
+		}
+	}
+}
+
+func TestSendErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		topic string
+		im    *messages.InputMessage
+		err   error
+	}{
+		{name: "sent", topic: "orders", im: &messages.InputMessage{Data: "hello", Persistent: true}},
+		{name: "no consumers", topic: "orders", im: &messages.InputMessage{Data: "hello"}, err: ErrNoConsumers},
+		{name: "too large by default", topic: "orders", im: &messages.InputMessage{Data: strings.Repeat("x", 11), Persistent: true}, err: ErrMessageTooLarge},
+		{name: "topic limit", topic: "big", im: &messages.InputMessage{Data: strings.Repeat("x", 11), Persistent: true}},
+		{name: "over topic limit", topic: "big", im: &messages.InputMessage{Data: strings.Repeat("x", 21), Persistent: true}, err: ErrMessageTooLarge},
+		{name: "empty header name", topic: "orders", im: &messages.InputMessage{Data: "x", Headers: map[string]string{"": "v"}}, err: ErrInvalidHeaders},
+		{name: "full", topic: "small", im: &messages.InputMessage{Data: "x", Persistent: true}, err: ErrTopicFull},
+		{name: "invalid topic", topic: `a"b`, im: &messages.InputMessage{Data: "x", Persistent: true}, err: ErrInvalidTopic},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(&config.Config{MaxMessageSize: 10, DedupWindow: time.Minute})
+			app.ApplyTopics([]config.Topic{{Name: "big", MaxMessageSize: 20}, {Name: "small", MaxMessages: 1}})
+			_, errFill := app.Send(context.Background(), "small", &messages.InputMessage{Data: "x", Persistent: true})
+			if errFill != nil {
+				t.Fatal(errFill)
+			}
+
+			_, errSend := app.Send(context.Background(), tt.topic, tt.im)
+			if !errors.Is(errSend, tt.err) {
+				t.Errorf("error %v, want %v", errSend, tt.err)
+			}
+		})
+	}
+}
+
+func TestMessageSizes(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  int
+		topics  []config.Topic
+		topic   string
+		max     int
+		largest int
+	}{
+		{name: "global", global: 100, topic: "a", max: 100, largest: 100},
+		{name: "smaller topic", global: 100, topics: []config.Topic{{Name: "a", MaxMessageSize: 10}}, topic: "a", max: 10, largest: 100},
+		{name: "larger topic", global: 100, topics: []config.Topic{{Name: "a", MaxMessageSize: 1000}}, topic: "b", max: 100, largest: 1000},
+		{name: "unlimited", global: 0, topics: []config.Topic{{Name: "a", MaxMessageSize: 1000}}, topic: "b", max: 0, largest: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(&config.Config{MaxMessageSize: tt.global})
+			app.ApplyTopics(tt.topics)
+
+			if got := app.MaxMessageSize(tt.topic); got != tt.max {
+				t.Errorf("max message size %d, want %d", got, tt.max)
+			}
+			if got := app.LargestMessageSize(); got != tt.largest {
+				t.Errorf("largest message size %d, want %d", got, tt.largest)
+			}
+		})
+	}
+}
+
+func TestDedup(t *testing.T) {
+	app := newApp(&config.Config{DedupWindow: time.Minute})
+
+	im := &messages.InputMessage{Data: "a", Persistent: true, IdempotencyKey: "k"}
+	id, errSend := app.Send(context.Background(), "orders", im)
+	if errSend != nil {
+		t.Fatal(errSend)
+	}
+	again, errAgain := app.Send(context.Background(), "orders", im)
+	if !errors.Is(errAgain, ErrDuplicate) || again != id {
+		t.Errorf("repeated send returned %s %v, want %s %v", again, errAgain, id, ErrDuplicate)
+	}
+	other, errOther := app.Send(context.Background(), "payments", im)
+	if errOther != nil || other == id {
+		t.Errorf("send with the key to another topic returned %s %v", other, errOther)
+	}
+
+	_, errRequest := app.Request(context.Background(), "orders", &messages.InputMessage{Data: "a", IdempotencyKey: "r"})
+	if !errors.Is(errRequest, ErrIdempotentRequest) {
+		t.Errorf("request with a key returned %v, want %v", errRequest, ErrIdempotentRequest)
+	}
+}
+
+func TestGetHoldsGroup(t *testing.T) {
+	tests := []struct {
+		name  string
+		hold  time.Duration
+		first []string
+		after []string
+	}{
+		{name: "no hold", hold: 0, first: []string{"a1", "a2", "b1"}},
+		{name: "hold", hold: time.Minute, first: []string{"a1", "b1"}, after: []string{"a2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(&config.Config{GroupHold: tt.hold})
+			for _, m := range []struct{ data, group string }{{"a1", "a"}, {"a2", "a"}, {"b1", "b"}} {
+				_, errSend := app.Send(context.Background(), "orders", &messages.InputMessage{Data: m.data, Group: m.group, Persistent: true})
+				if errSend != nil {
+					t.Fatal(errSend)
+				}
+			}
+
+			getAll := func() []string {
+				var got []string
+				for om := get(t, app, "orders"); om != nil; om = get(t, app, "orders") {
+					got = append(got, om.Data)
+				}
+				return got
+			}
+
+			if got := getAll(); strings.Join(got, ",") != strings.Join(tt.first, ",") {
+				t.Fatalf("got %v, want %v", got, tt.first)
+			}
+			app.maintenance(time.Now().Add(tt.hold + time.Second))
+			if got := getAll(); strings.Join(got, ",") != strings.Join(tt.after, ",") {
+				t.Errorf("got %v after the hold, want %v", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestTenantQuotas(t *testing.T) {
+	tenant := config.Tenant{Name: "shop", Topics: []string{"shop.*"}, MaxTopics: 2, MaxBytes: 10, MaxConsumers: 1}
+
+	tests := []struct {
+		name string
+		run  func(app *Application) error
+		err  error
+	}{
+		{
+			name: "bytes",
+			run: func(app *Application) error {
+				_, errSend := app.Send(context.Background(), "shop.a", &messages.InputMessage{Data: "123456", Persistent: true})
+				if errSend != nil {
+					return errSend
+				}
+				_, errSend = app.Send(context.Background(), "shop.b", &messages.InputMessage{Data: "123456", Persistent: true})
+				return errSend
+			},
+			err: ErrQuotaExceeded,
+		},
+		{
+			name: "bytes are freed by get",
+			run: func(app *Application) error {
+				_, errSend := app.Send(context.Background(), "shop.a", &messages.InputMessage{Data: "123456", Persistent: true})
+				if errSend != nil {
+					return errSend
+				}
+				_, errGet := app.Get(cancelled(), "shop.a", nil)
+				if errGet != nil {
+					return errGet
+				}
+				_, errSend = app.Send(context.Background(), "shop.b", &messages.InputMessage{Data: "123456", Persistent: true})
+				return errSend
+			},
+		},
+		{
+			name: "delayed bytes are counted",
+			run: func(app *Application) error {
+				_, errSend := app.Send(context.Background(), "shop.a", &messages.InputMessage{Data: "123456", Persistent: true, Delay: time.Minute})
+				if errSend != nil {
+					return errSend
+				}
+				_, errSend = app.Send(context.Background(), "shop.a", &messages.InputMessage{Data: "123456", Persistent: true})
+				return errSend
+			},
+			err: ErrQuotaExceeded,
+		},
+		{
+			name: "other topics are not limited",
+			run: func(app *Application) error {
+				_, errSend := app.Send(context.Background(), "orders", &messages.InputMessage{Data: strings.Repeat("x", 100), Persistent: true})
+				return errSend
+			},
+		},
+		{
+			name: "topics",
+			run: func(app *Application) error {
+				for _, topic := range []string{"shop.a", "shop.b", "shop.c"} {
+					_, errCreate := app.CreateTopic(context.Background(), topic)
+					if errCreate != nil {
+						return errCreate
+					}
+				}
+				return nil
+			},
+			err: ErrQuotaExceeded,
+		},
+		{
+			name: "deleted topics are uncounted",
+			run: func(app *Application) error {
+				for _, topic := range []string{"shop.a", "shop.b"} {
+					_, errCreate := app.CreateTopic(context.Background(), topic)
+					if errCreate != nil {
+						return errCreate
+					}
+				}
+				errDelete := app.DeleteTopic(context.Background(), "shop.a")
+				if errDelete != nil {
+					return errDelete
+				}
+				_, errCreate := app.CreateTopic(context.Background(), "shop.c")
+				return errCreate
+			},
+		},
+		{
+			name: "consumers",
+			run: func(app *Application) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				waiting := make(chan struct{})
+				go func() {
+					defer close(waiting)
+					_, _ = app.Get(ctx, "shop.a", nil)
+				}()
+				for app.Tenants(ctx)[0].Consumers == 0 {
+					time.Sleep(time.Millisecond)
+				}
+
+				_, errGet := app.Get(cancelled(), "shop.b", nil)
+				cancel()
+				<-waiting
+				return errGet
+			},
+			err: ErrQuotaExceeded,
+		},
+		{
+			name: "reply waiters are consumers",
+			run: func(app *Application) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				waiting := make(chan struct{})
+				go func() {
+					defer close(waiting)
+					_, _ = app.Get(ctx, "shop.a", nil)
+				}()
+				for app.Tenants(ctx)[0].Consumers == 0 {
+					time.Sleep(time.Millisecond)
+				}
+
+				_, errRequest := app.Request(cancelled(), "orders", &messages.InputMessage{Data: "x", Persistent: true, ReplyTo: "shop.replies"})
+				cancel()
+				<-waiting
+				return errRequest
+			},
+			err: ErrQuotaExceeded,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newApp(&config.Config{DedupWindow: time.Minute})
+			app.ApplyTenants([]config.Tenant{tenant})
+
+			errRun := tt.run(app)
+			if !errors.Is(errRun, tt.err) {
+				t.Errorf("error %v, want %v", errRun, tt.err)
+			}
+		})
+	}
+}
+
+func TestTenantUsageMoves(t *testing.T) {
+	app := newApp(&config.Config{})
+	app.ApplyTenants([]config.Tenant{{Name: "shop", Topics: []string{"shop.*"}}})
+
+	_, errSend := app.Send(context.Background(), "shop.a", &messages.InputMessage{Data: "1234", Persistent: true})
+	if errSend != nil {
+		t.Fatal(errSend)
+	}
+
+	steps := []struct {
+		name    string
+		tenants []config.Tenant
+		want    map[string][2]int64
+	}{
+		{name: "declared", tenants: []config.Tenant{{Name: "shop", Topics: []string{"shop.*"}}}, want: map[string][2]int64{"shop": {1, 4}}},
+		{name: "moved", tenants: []config.Tenant{{Name: "all", Topics: []string{"*"}}, {Name: "shop", Topics: []string{"shop.*"}}}, want: map[string][2]int64{"all": {1, 4}, "shop": {0, 0}}},
+		{name: "undeclared", tenants: []config.Tenant{{Name: "shop", Topics: []string{"shop.*"}}}, want: map[string][2]int64{"shop": {1, 4}}},
+	}
+
+	for _, step := range steps {
+		app.ApplyTenants(step.tenants)
+
+		usage := app.Tenants(context.Background())
+		if len(usage) != len(step.want) {
+			t.Fatalf("%s: usage of %d tenants, want %d", step.name, len(usage), len(step.want))
+		}
+		for _, u := range usage {
+			if want := step.want[u.Name]; int64(u.Topics) != want[0] || u.Bytes != want[1] {
+				t.Errorf("%s: tenant %s has %d topics and %d bytes, want %v", step.name, u.Name, u.Topics, u.Bytes, want)
+			}
+		}
+	}
+}
+
+// exported returns the metrics exported for the topic
+func exported(topic string) string {
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+
+	var lines []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, `topic="`+topic+`"`) {
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func TestStrictTopicsAddNoMetrics(t *testing.T) {
+	app := newApp(&config.Config{StrictTopics: true})
+
+	_, errSend := app.Send(context.Background(), "strict.unknown", &messages.InputMessage{Data: "a", Persistent: true})
+	if !errors.Is(errSend, ErrTopicNotFound) {
+		t.Fatalf("send error %v, want %v", errSend, ErrTopicNotFound)
+	}
+	_, errGet := app.Get(cancelled(), "strict.unknown", nil)
+	if !errors.Is(errGet, ErrTopicNotFound) {
+		t.Fatalf("get error %v, want %v", errGet, ErrTopicNotFound)
+	}
+	_, _, errReserve := app.Reserve(cancelled(), "strict.unknown", time.Minute)
+	if !errors.Is(errReserve, ErrTopicNotFound) {
+		t.Fatalf("reserve error %v, want %v", errReserve, ErrTopicNotFound)
+	}
+
+	if got := exported("strict.unknown"); got != "" {
+		t.Errorf("metrics of the rejected topic:\n%s", got)
+	}
+}
+
+func TestRemovedTopicMetrics(t *testing.T) {
+	app := newApp(&config.Config{TopicIdleTTL: time.Minute})
+
+	_, errSend := app.Send(context.Background(), "idle.a", &messages.InputMessage{Data: "a", Persistent: true})
+	if errSend != nil {
+		t.Fatal(errSend)
+	}
+	if get(t, app, "idle.a") == nil {
+		t.Fatal("no message")
+	}
+	if exported("idle.a") == "" {
+		t.Fatal("no metrics of the topic")
+	}
+
+	app.maintenance(time.Now().Add(2 * time.Minute))
+	if topics := app.Topics(context.Background()); len(topics) != 0 {
+		t.Fatalf("topics %v left after removal", topics)
+	}
+	if got := exported("idle.a"); got != "" {
+		t.Errorf("metrics of the removed topic:\n%s", got)
+	}
+}
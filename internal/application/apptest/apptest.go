@@ -0,0 +1,41 @@
+// Package apptest runs the application for tests of the fronts
+package apptest
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+	"github.com/ssqueue/ssqueue/internal/ratelimit"
+)
+
+// Run starts the application with the rate limits and waits until it accepts requests, it is stopped when the test ends
+func Run(t testing.TB, cfg *config.Config, limits ...config.RateLimit) *application.Application {
+	t.Helper()
+
+	limiter := ratelimit.New()
+	limiter.Set(limits)
+	app := application.New(cfg, nil, limiter)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go app.Run(ctx, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// invalid headers are checked right after readiness, so the probe changes nothing
+	for {
+		_, errSend := app.Send(ctx, "probe", &messages.InputMessage{Headers: map[string]string{"": ""}})
+		if !errors.Is(errSend, application.ErrNotReady) {
+			return app
+		}
+		runtime.Gosched()
+	}
+}
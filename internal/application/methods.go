@@ -4,55 +4,509 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"maps"
+	"reflect"
+	"strconv"
 	"sync/atomic"
+	"time"
 
-	"github.com/VictoriaMetrics/metrics"
-
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
 	"github.com/ssqueue/ssqueue/internal/messages"
 	"github.com/ssqueue/ssqueue/internal/queue"
 )
 
 var (
-	ErrNoConsumers = errors.New("no consumers")
-	ErrNotReady    = errors.New("not ready")
+	ErrNoConsumers    = queue.ErrNoConsumers
+	ErrNotReady       = errors.New("not ready")
+	ErrNoReceipt      = errors.New("receipt not found")
+	ErrInvalidHeaders = errors.New("invalid headers")
+	// ErrDuplicate is returned by Send together with the ID of the original message
+	ErrDuplicate = errors.New("duplicate message")
+	// ErrIdempotentRequest is returned by Request for messages with an idempotency key, a duplicate would get no reply
+	ErrIdempotentRequest = errors.New("idempotency key is not supported by requests")
+	// ErrMessageNotFound is returned by Delete for messages which are not pending or delayed in the topic
+	ErrMessageNotFound = errors.New("message not found")
+	ErrTopicNotFound   = errors.New("topic not found")
+	// ErrTopicDeleted is returned to consumers waiting on the topic when it is deleted
+	ErrTopicDeleted = errors.New("topic deleted")
+	ErrInvalidTopic = errors.New("invalid topic")
+	// ErrTopicFull is returned by Send when the topic has max messages pending
+	ErrTopicFull = queue.ErrFull
+	// ErrMessageTooLarge is returned by Send when the data is larger than the max message size of the topic
+	ErrMessageTooLarge = errors.New("message is too large")
+	// ErrQuotaExceeded is returned when a new topic, message or consumer does not fit into the quotas of the tenant
+	ErrQuotaExceeded = queue.ErrQuotaExceeded
+	// ErrThrottled is returned by sends and gets over the rate limits, the error is *ThrottledError
+	ErrThrottled = errors.New("rate limit exceeded")
 )
 
-func (app *Application) Get(ctx context.Context, topic string) (*messages.OutputMessage, error) {
+// ThrottledError tells how long the client should wait until the rate limits allow the request
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return ErrThrottled.Error()
+}
+
+func (e *ThrottledError) Unwrap() error {
+	return ErrThrottled
+}
+
+// Throttled returns the wait of the error returned for a request over the rate limits
+func Throttled(err error) (time.Duration, bool) {
+	var te *ThrottledError
+	if !errors.As(err, &te) {
+		return 0, false
+	}
+
+	return te.Wait, true
+}
+
+const (
+	maxHeadersCount = 64
+	maxHeadersSize  = 16 * 1024
+)
+
+func outputMessage(item *queue.Item) *messages.OutputMessage {
+	return &messages.OutputMessage{ID: item.ID, Data: item.Data, Name: item.Name, ContentType: item.ContentType, Headers: item.Headers, Group: item.Group, ReplyTo: item.ReplyTo, CorrelationID: item.CorrelationID}
+}
+
+// throttle applies the rate limits of the principal and of the topics to the action, topics must exist
+func (app *Application) throttle(ctx context.Context, action string, topics ...string) error {
+	wait, ok := app.limiter.AllowAny(auth.Principal(ctx), topics, action)
+	if ok {
+		return nil
+	}
+
+	for _, topic := range topics {
+		app.counter(topic, "ssqueue_throttled_"+action).Inc()
+	}
+
+	return &ThrottledError{Wait: wait}
+}
+
+// validateHeaders limits the number of headers and the total size of their names and values
+func validateHeaders(headers map[string]string) error {
+	if len(headers) > maxHeadersCount {
+		return ErrInvalidHeaders
+	}
+
+	size := 0
+	for k, v := range headers {
+		if k == "" {
+			return ErrInvalidHeaders
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxHeadersSize {
+		return ErrInvalidHeaders
+	}
+
+	return nil
+}
+
+// Get waits for a message, with a non-empty filter only the messages matching it are taken
+func (app *Application) Get(ctx context.Context, topic string, filter messages.Filter) (*messages.OutputMessage, error) {
 	if atomic.LoadInt64(&app.ready) != 1 {
 		return nil, ErrNotReady
 	}
 
-	metrics.GetOrCreateCounter("ssqueue_method_get{topic=\"" + topic + "\"}").Inc()
-
-	q := app.getQueue(topic)
-	q.Inc()
+	// counters are created for existing topics only, so rejected names do not add metric series
+	q, errQueue := app.getQueue(topic)
+	if errQueue != nil {
+		return nil, errQueue
+	}
+	errThrottle := app.throttle(ctx, config.ActionGet, topic)
+	if errThrottle != nil {
+		return nil, errThrottle
+	}
+	app.counter(topic, "ssqueue_method_get").Inc()
+	errConsume := app.consume(topic, q)
+	if errConsume != nil {
+		return nil, errConsume
+	}
 	defer q.Dec()
 
-	item := q.Pop(ctx)
+	var match func(*queue.Item) bool
+	if len(filter) > 0 {
+		match = func(item *queue.Item) bool {
+			return filter.Match(item.Headers)
+		}
+	}
+
+	item := q.Pop(ctx, match, app.groupHold)
 
 	if item == nil {
+		if q.Closed() {
+			return nil, ErrTopicDeleted
+		}
 		return nil, nil
 	}
 
-	return &messages.OutputMessage{ID: item.ID, Data: item.Data, Name: item.Name}, nil
+	return outputMessage(item), nil
 }
 
-func (app *Application) Send(_ context.Context, topic string, im *messages.InputMessage) (string, error) {
+func (app *Application) Send(ctx context.Context, topic string, im *messages.InputMessage) (string, error) {
 	if atomic.LoadInt64(&app.ready) != 1 {
 		return "", ErrNotReady
 	}
 
-	metrics.GetOrCreateCounter("ssqueue_method_send{topic=\"" + topic + "\"}").Inc()
+	errHeaders := validateHeaders(im.Headers)
+	if errHeaders != nil {
+		return "", errHeaders
+	}
+
+	q, errQueue := app.getQueue(topic)
+	if errQueue != nil {
+		return "", errQueue
+	}
+	errThrottle := app.throttle(ctx, config.ActionSend, topic)
+	if errThrottle != nil {
+		return "", errThrottle
+	}
+	app.counter(topic, "ssqueue_method_send").Inc()
+
+	if maxSize := app.MaxMessageSize(topic); maxSize > 0 && len(im.Data) > maxSize {
+		app.counter(topic, "ssqueue_messages_too_large").Inc()
+		return "", ErrMessageTooLarge
+	}
 
 	item := queue.AcquireItem()
 	item.ID = rand.Text()
 	item.Data = im.Data
 	item.Name = im.Name
+	item.ContentType = im.ContentType
+	item.Headers = maps.Clone(im.Headers)
+	item.Group = im.Group
+	item.ReplyTo = im.ReplyTo
+	item.CorrelationID = im.CorrelationID
+	item.Created = time.Now()
 
-	added := app.getQueue(topic).Push(item, im.Persistent)
-	if !added {
-		return "", ErrNoConsumers
+	if im.IdempotencyKey != "" {
+		originalID, duplicate := q.Dedup(im.IdempotencyKey, item.ID, app.dedupWindow)
+		if duplicate {
+			queue.ReleaseItem(item)
+			return originalID, ErrDuplicate
+		}
+	}
+
+	var errPush error
+	if im.Delay > 0 {
+		errPush = q.PushDelayed(item, im.Delay)
+	} else {
+		errPush = q.Push(item, im.Persistent)
+	}
+	if errPush != nil {
+		if errors.Is(errPush, ErrQuotaExceeded) {
+			app.rejectQuota(topic, "bytes")
+		}
+		if im.IdempotencyKey != "" {
+			q.Forget(im.IdempotencyKey, item.ID)
+		}
+		queue.ReleaseItem(item)
+		return "", errPush
 	}
 
 	return item.ID, nil
 }
+
+// Request sends the message and waits for the reply with the same correlation ID.
+// Without ReplyTo the reply is awaited in a temporary topic, which is removed once it stays idle.
+func (app *Application) Request(ctx context.Context, topic string, im *messages.InputMessage) (*messages.OutputMessage, error) {
+	if atomic.LoadInt64(&app.ready) != 1 {
+		return nil, ErrNotReady
+	}
+	if im.IdempotencyKey != "" {
+		return nil, ErrIdempotentRequest
+	}
+
+	req := *im
+	if req.ReplyTo == "" {
+		req.ReplyTo = replyTopicPrefix + rand.Text()
+	}
+	if req.CorrelationID == "" {
+		req.CorrelationID = rand.Text()
+	}
+
+	// the consumer is counted before sending, so the reply topic is not removed while the reply is awaited
+	replies, errQueue := app.getQueue(req.ReplyTo)
+	if errQueue != nil {
+		return nil, errQueue
+	}
+	errConsume := app.consume(req.ReplyTo, replies)
+	if errConsume != nil {
+		return nil, errConsume
+	}
+	defer replies.Dec()
+
+	_, errSend := app.Send(ctx, topic, &req)
+	if errSend != nil {
+		return nil, errSend
+	}
+
+	item := replies.Pop(ctx, func(item *queue.Item) bool {
+		return item.CorrelationID == req.CorrelationID
+	}, 0)
+	if item == nil {
+		if replies.Closed() {
+			return nil, ErrTopicDeleted
+		}
+		return nil, nil
+	}
+
+	return outputMessage(item), nil
+}
+
+// Reserve gets a message and hides it from other consumers for the visibility period.
+// The message must be acknowledged with the returned receipt, otherwise it is delivered again.
+func (app *Application) Reserve(ctx context.Context, topic string, visibility time.Duration) (*messages.OutputMessage, string, error) {
+	if atomic.LoadInt64(&app.ready) != 1 {
+		return nil, "", ErrNotReady
+	}
+
+	q, errQueue := app.getQueue(topic)
+	if errQueue != nil {
+		return nil, "", errQueue
+	}
+	errThrottle := app.throttle(ctx, config.ActionGet, topic)
+	if errThrottle != nil {
+		return nil, "", errThrottle
+	}
+	app.counter(topic, "ssqueue_method_reserve").Inc()
+	errConsume := app.consume(topic, q)
+	if errConsume != nil {
+		return nil, "", errConsume
+	}
+	defer q.Dec()
+
+	item, receipt := q.Reserve(ctx, visibility)
+
+	if item == nil {
+		if q.Closed() {
+			return nil, "", ErrTopicDeleted
+		}
+		return nil, "", nil
+	}
+
+	return outputMessage(item), receipt, nil
+}
+
+// ReserveAny reserves a message from the first of the topics which has one
+func (app *Application) ReserveAny(ctx context.Context, topics []string, visibility time.Duration) (string, *messages.OutputMessage, string, error) {
+	if atomic.LoadInt64(&app.ready) != 1 {
+		return "", nil, "", ErrNotReady
+	}
+
+	queues := make([]*queue.Queue, 0, len(topics))
+	for _, topic := range topics {
+		q, errQueue := app.getQueue(topic)
+		if errQueue != nil {
+			return "", nil, "", errQueue
+		}
+		queues = append(queues, q)
+	}
+	// one reserve from any of the topics is one get for the principal
+	errThrottle := app.throttle(ctx, config.ActionGet, topics...)
+	if errThrottle != nil {
+		return "", nil, "", errThrottle
+	}
+	for i, q := range queues {
+		app.counter(topics[i], "ssqueue_method_reserve").Inc()
+		errConsume := app.consume(topics[i], q)
+		if errConsume != nil {
+			return "", nil, "", errConsume
+		}
+		defer q.Dec()
+	}
+
+	cases := make([]reflect.SelectCase, len(queues)+1)
+	cases[0] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}
+
+	for {
+		// channels are taken before the attempt, so a push between the attempt and the wait is not missed
+		for i, q := range queues {
+			cases[i+1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(q.Notify())}
+		}
+
+		for i, q := range queues {
+			item, receipt := q.TryReserve(visibility)
+			if item != nil {
+				return topics[i], outputMessage(item), receipt, nil
+			}
+		}
+
+		chosen, _, _ := reflect.Select(cases)
+		if chosen == 0 {
+			return "", nil, "", nil
+		}
+		if queues[chosen-1].Closed() {
+			return "", nil, "", ErrTopicDeleted
+		}
+	}
+}
+
+func (app *Application) Ack(_ context.Context, topic string, receipt string) error {
+	q := app.lookupQueue(topic)
+	if q == nil || !q.Ack(receipt) {
+		return ErrNoReceipt
+	}
+
+	return nil
+}
+
+func (app *Application) Release(_ context.Context, topic string, receipt string, delay time.Duration) error {
+	q := app.lookupQueue(topic)
+	if q == nil || !q.Release(receipt, delay) {
+		return ErrNoReceipt
+	}
+
+	return nil
+}
+
+func (app *Application) Touch(_ context.Context, topic string, receipt string, visibility time.Duration) error {
+	q := app.lookupQueue(topic)
+	if q == nil || !q.Touch(receipt, visibility) {
+		return ErrNoReceipt
+	}
+
+	return nil
+}
+
+func (app *Application) Bury(_ context.Context, topic string, receipt string) error {
+	q := app.lookupQueue(topic)
+	if q == nil || !q.Bury(receipt) {
+		return ErrNoReceipt
+	}
+
+	return nil
+}
+
+// Delete removes the pending message, reserved, delayed and buried messages are not removed
+func (app *Application) Delete(_ context.Context, topic string, id string) error {
+	q := app.lookupQueue(topic)
+	if q == nil || !q.Delete(id) {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (app *Application) Kick(_ context.Context, topic string, bound int) (int, error) {
+	q := app.lookupQueue(topic)
+	if q == nil {
+		return 0, nil
+	}
+
+	return q.Kick(bound), nil
+}
+
+func (app *Application) Describe(_ context.Context, topic string) (*messages.TopicInfo, error) {
+	q := app.lookupQueue(topic)
+	if q == nil {
+		return nil, ErrTopicNotFound
+	}
+	reserved, delayed := q.LeasesCount()
+
+	return &messages.TopicInfo{
+		Name:      topic,
+		Messages:  q.Count(),
+		InFlight:  reserved,
+		Delayed:   delayed,
+		Buried:    q.BuriedCount(),
+		Consumers: q.ConsumersCount(),
+	}, nil
+}
+
+// Peek returns pending messages without taking them, starting at offset in the order of delivery
+func (app *Application) Peek(_ context.Context, topic string, offset int, limit int) ([]messages.MessageInfo, error) {
+	q := app.lookupQueue(topic)
+	if q == nil {
+		return nil, nil
+	}
+
+	return messageInfos(q.Peek(offset, limit)), nil
+}
+
+// Browse is Peek over reserved, delayed and buried messages as well, each one is returned with its state
+func (app *Application) Browse(_ context.Context, topic string, offset int, limit int) ([]messages.MessageInfo, error) {
+	q := app.lookupQueue(topic)
+	if q == nil {
+		return nil, nil
+	}
+
+	return messageInfos(q.Browse(offset, limit)), nil
+}
+
+func messageInfos(views []queue.ItemView) []messages.MessageInfo {
+	now := time.Now()
+
+	infos := make([]messages.MessageInfo, len(views))
+	for i, v := range views {
+		infos[i] = messages.MessageInfo{ID: v.ID, Name: v.Name, Size: len(v.Data), State: v.State}
+		if !v.Created.IsZero() {
+			infos[i].Age = now.Sub(v.Created)
+		}
+	}
+
+	return infos
+}
+
+// CreateTopic creates the topic if it does not exist yet and reports whether it was created.
+// The topic becomes declared, so it is kept when idle, even if it was created implicitly before.
+func (app *Application) CreateTopic(ctx context.Context, topic string) (bool, error) {
+	if !ValidTopic(topic) {
+		return false, ErrInvalidTopic
+	}
+
+	app.qMu.Lock()
+	if _, ok := app.q[topic]; ok {
+		app.declared[topic] = struct{}{}
+		app.qMu.Unlock()
+		return false, nil
+	}
+	errQuota := app.checkTopicsLocked(topic)
+	if errQuota != nil {
+		app.qMu.Unlock()
+		return false, errQuota
+	}
+	app.declared[topic] = struct{}{}
+	app.newQueueLocked(topic)
+	app.qMu.Unlock()
+
+	// the record is synced to disk, so it is written without blocking other topics
+	app.audit.Record(audit.ActionTopicCreate, auth.Principal(ctx), topic, "")
+
+	return true, nil
+}
+
+// PurgeTopic removes all messages of the topic and returns their number
+func (app *Application) PurgeTopic(ctx context.Context, topic string) (int, error) {
+	q := app.lookupQueue(topic)
+	if q == nil {
+		return 0, ErrTopicNotFound
+	}
+
+	n := q.Purge()
+	app.audit.Record(audit.ActionTopicPurge, auth.Principal(ctx), topic, strconv.Itoa(n)+" messages")
+
+	return n, nil
+}
+
+// DeleteTopic removes the topic with all its messages, waiting consumers get ErrTopicDeleted
+func (app *Application) DeleteTopic(ctx context.Context, topic string) error {
+	app.qMu.Lock()
+	q, ok := app.q[topic]
+	if !ok {
+		app.qMu.Unlock()
+		return ErrTopicNotFound
+	}
+	app.removeLocked(topic, q)
+	app.qMu.Unlock()
+
+	app.audit.Record(audit.ActionTopicDelete, auth.Principal(ctx), topic, "")
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package application
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+	"github.com/ssqueue/ssqueue/internal/queue"
+)
+
+// tenantMetrics are the usage gauges of tenants, they are unregistered together with the tenant
+var tenantMetrics = []string{
+	"ssqueue_tenant_topics",
+	"ssqueue_tenant_bytes",
+	"ssqueue_tenant_consumers",
+}
+
+// ApplyTenants replaces the tenants with the ones from the configuration file and returns the list of changes.
+// Quotas are checked for new topics, messages and consumers only, usage over a lowered quota is kept.
+func (app *Application) ApplyTenants(tenants []config.Tenant) []string {
+	app.qMu.Lock()
+	defer app.qMu.Unlock()
+
+	var changes []string
+
+	declared := make(map[string]struct{}, len(tenants))
+	for _, t := range tenants {
+		declared[t.Name] = struct{}{}
+
+		old, ok := app.tenant(t.Name)
+		switch {
+		case !ok:
+			changes = append(changes, "tenant "+strconv.Quote(t.Name)+" declared")
+			app.accounts[t.Name] = queue.NewAccount()
+			app.registerTenantMetrics(t.Name)
+		case !reflect.DeepEqual(old, t):
+			changes = append(changes, "tenant "+strconv.Quote(t.Name)+" changed")
+		}
+		app.accounts[t.Name].SetLimits(t.MaxBytes, t.MaxConsumers)
+	}
+	for _, t := range app.tenants {
+		if _, ok := declared[t.Name]; !ok {
+			changes = append(changes, "tenant "+strconv.Quote(t.Name)+" undeclared")
+		}
+	}
+	sort.Strings(changes)
+
+	app.tenants = tenants
+
+	// topics may move between tenants, their usage moves with them
+	for topic, q := range app.q {
+		q.SetAccount(app.accountOf(topic))
+	}
+
+	for name := range app.accounts {
+		if _, ok := declared[name]; !ok {
+			delete(app.accounts, name)
+			for _, metric := range tenantMetrics {
+				metrics.UnregisterMetric(metric + "{tenant=\"" + name + "\"}")
+			}
+		}
+	}
+
+	return changes
+}
+
+// Tenants returns usage of all tenants in the order of the configuration file
+func (app *Application) Tenants(_ context.Context) []messages.TenantUsage {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	usage := make([]messages.TenantUsage, 0, len(app.tenants))
+	for _, t := range app.tenants {
+		a := app.accounts[t.Name]
+		usage = append(usage, messages.TenantUsage{
+			Name:         t.Name,
+			Topics:       a.Topics(),
+			Bytes:        a.Bytes(),
+			Consumers:    a.Consumers(),
+			MaxTopics:    t.MaxTopics,
+			MaxBytes:     t.MaxBytes,
+			MaxConsumers: t.MaxConsumers,
+		})
+	}
+
+	return usage
+}
+
+func (app *Application) registerTenantMetrics(tenant string) {
+	usage := func(f func(a *queue.Account) float64) func() float64 {
+		return func() float64 {
+			app.qMu.RLock()
+			defer app.qMu.RUnlock()
+
+			a, ok := app.accounts[tenant]
+			if !ok {
+				return 0
+			}
+
+			return f(a)
+		}
+	}
+
+	metrics.GetOrCreateGauge("ssqueue_tenant_topics{tenant=\""+tenant+"\"}", usage(func(a *queue.Account) float64 { return float64(a.Topics()) }))
+	metrics.GetOrCreateGauge("ssqueue_tenant_bytes{tenant=\""+tenant+"\"}", usage(func(a *queue.Account) float64 { return float64(a.Bytes()) }))
+	metrics.GetOrCreateGauge("ssqueue_tenant_consumers{tenant=\""+tenant+"\"}", usage(func(a *queue.Account) float64 { return float64(a.Consumers()) }))
+}
+
+// tenant returns the tenant by name, qMu must be locked
+func (app *Application) tenant(name string) (config.Tenant, bool) {
+	for _, t := range app.tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+
+	return config.Tenant{}, false
+}
+
+// tenantOf returns the tenant the topic belongs to, nil if there is none, qMu must be locked
+func (app *Application) tenantOf(topic string) *config.Tenant {
+	for i := range app.tenants {
+		if app.tenants[i].Matches(topic) {
+			return &app.tenants[i]
+		}
+	}
+
+	return nil
+}
+
+// accountOf returns the account of the tenant the topic belongs to, nil if there is none, qMu must be locked
+func (app *Application) accountOf(topic string) *queue.Account {
+	t := app.tenantOf(topic)
+	if t == nil {
+		return nil
+	}
+
+	return app.accounts[t.Name]
+}
+
+// rejectQuota counts the rejection by the tenant of the topic
+func (app *Application) rejectQuota(topic string, quota string) {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	app.rejectQuotaLocked(topic, quota)
+}
+
+// rejectQuotaLocked counts the rejection by the tenant of the topic, qMu must be locked
+func (app *Application) rejectQuotaLocked(topic string, quota string) {
+	if t := app.tenantOf(topic); t != nil {
+		metrics.GetOrCreateCounter("ssqueue_tenant_rejected{tenant=\"" + t.Name + "\",quota=\"" + quota + "\"}").Inc()
+	}
+}
+
+// checkTopicsLocked returns ErrQuotaExceeded if the tenant of the new topic has all its topics, qMu must be locked
+func (app *Application) checkTopicsLocked(topic string) error {
+	t := app.tenantOf(topic)
+	if t == nil || t.MaxTopics == 0 {
+		return nil
+	}
+	if app.accounts[t.Name].Topics() >= t.MaxTopics {
+		app.rejectQuotaLocked(topic, "topics")
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// consume counts the consumer of the queue, it must be released with q.Dec.
+// ErrQuotaExceeded is returned and nothing is counted if the tenant of the topic has all its consumers.
+func (app *Application) consume(topic string, q *queue.Queue) error {
+	errInc := q.TryInc()
+	if errInc != nil {
+		app.rejectQuota(topic, "consumers")
+		return errInc
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package application
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/queue"
+)
+
+const (
+	maxTopicName = 200
+	// topicChars are the characters of beanstalk tube names, other fronts map their names to topics as is
+	topicChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-+/;.$_()"
+)
+
+// ValidTopic reports whether the name can be used for a topic
+func ValidTopic(name string) bool {
+	if name == "" || len(name) > maxTopicName || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune(topicChars, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyTopics replaces settings of topics with the ones from the configuration file and returns the list of changes.
+// Declared topics are created, topics which are not declared anymore lose their limits and may be removed when idle.
+func (app *Application) ApplyTopics(topics []config.Topic) []string {
+	app.qMu.Lock()
+	defer app.qMu.Unlock()
+
+	var changes []string
+
+	declared := make(map[string]config.Topic, len(topics))
+	for _, t := range topics {
+		declared[t.Name] = t
+
+		old, ok := app.topics[t.Name]
+		if !ok {
+			changes = append(changes, "topic "+strconv.Quote(t.Name)+" declared")
+		} else {
+			for _, change := range t.Changes(&old) {
+				changes = append(changes, "topic "+strconv.Quote(t.Name)+": "+change)
+			}
+		}
+	}
+	for name := range app.topics {
+		if _, ok := declared[name]; !ok {
+			changes = append(changes, "topic "+strconv.Quote(name)+" undeclared")
+		}
+	}
+	sort.Strings(changes)
+
+	// undeclared topics get zero limits
+	for name, q := range app.q {
+		_, wasDeclared := app.topics[name]
+		t, isDeclared := declared[name]
+		if wasDeclared || isDeclared {
+			q.SetLimits(topicLimits(t))
+		}
+	}
+
+	app.topics = declared
+	app.largestTopicMessageSize = 0
+	for _, t := range declared {
+		app.largestTopicMessageSize = max(app.largestTopicMessageSize, t.MaxMessageSize)
+	}
+	for name := range declared {
+		if _, ok := app.q[name]; !ok {
+			app.newQueueLocked(name)
+		}
+	}
+
+	return changes
+}
+
+// newQueueLocked adds the queue for the topic with its configured limits, qMu must be locked
+func (app *Application) newQueueLocked(topic string) *queue.Queue {
+	q := queue.New(topic)
+	if t, ok := app.topics[topic]; ok {
+		q.SetLimits(topicLimits(t))
+	}
+	q.SetAccount(app.accountOf(topic))
+	app.q[topic] = q
+
+	set := metrics.NewSet()
+	metrics.RegisterSet(set)
+	app.topicMetrics[topic] = set
+
+	return q
+}
+
+// MaxMessageSize returns the max message size of the topic, topics without their own use the global one, zero is unlimited
+func (app *Application) MaxMessageSize(topic string) int {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	if t, ok := app.topics[topic]; ok && t.MaxMessageSize > 0 {
+		return t.MaxMessageSize
+	}
+
+	return app.defaultMaxMessageSize
+}
+
+// LargestMessageSize returns the largest max message size of all topics, zero if topics without their own are unlimited
+func (app *Application) LargestMessageSize() int {
+	app.qMu.RLock()
+	defer app.qMu.RUnlock()
+
+	if app.defaultMaxMessageSize == 0 {
+		return 0
+	}
+
+	return max(app.defaultMaxMessageSize, app.largestTopicMessageSize)
+}
+
+func topicLimits(t config.Topic) queue.Limits {
+	return queue.Limits{MaxMessages: t.MaxMessages, MaxReceives: t.MaxReceives}
+}
+
+// expire drops messages which outlived the TTL of their topic and takes dead ones, qMu must be locked for reading
+func (app *Application) expire(now time.Time, topic string, q *queue.Queue) []*queue.Item {
+	t, ok := app.topics[topic]
+	if !ok {
+		return nil
+	}
+
+	if t.MessageTTL > 0 {
+		if n := q.Expire(now.Add(-time.Duration(t.MessageTTL))); n > 0 {
+			app.counterLocked(topic, "ssqueue_messages_expired").Add(n)
+		}
+	}
+
+	if t.DeadLetterTopic == "" {
+		return nil
+	}
+
+	return q.TakeDead()
+}
+
+// deadLetter moves dead messages of the topic to its dead letter topic, they are dropped if it is full
+// or its tenant has not enough bytes left
+func (app *Application) deadLetter(topic string, dead []*queue.Item) {
+	app.qMu.RLock()
+	t := app.topics[topic]
+	app.qMu.RUnlock()
+
+	dlq := app.createQueue(t.DeadLetterTopic)
+	for _, item := range dead {
+		errPush := dlq.Push(item, true)
+		if errPush != nil {
+			slog.Error("error move message to dead letter topic", slog.String("topic", topic), slog.String("dead_letter_topic", t.DeadLetterTopic), slog.String("error", errPush.Error()))
+		}
+	}
+	app.counter(topic, "ssqueue_messages_dead").Add(len(dead))
+
+	slog.Debug("messages moved to dead letter topic", slog.String("topic", topic), slog.Int("count", len(dead)))
+}
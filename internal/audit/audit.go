@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/encryption"
+)
+
+// recentRecords is how many of the last records are kept in memory for queries
+const recentRecords = 1000
+
+// actions of audit records
+const (
+	ActionTopicCreate     = "topic.create"
+	ActionTopicDelete     = "topic.delete"
+	ActionTopicPurge      = "topic.purge"
+	ActionACLDeny         = "acl.deny"
+	ActionSnapshotSave    = "snapshot.save"
+	ActionSnapshotRestore = "snapshot.restore"
+	ActionConfigReload    = "config.reload"
+)
+
+// Record is one line of the audit file.
+// Hash is the HMAC-SHA256 of the record encoded with an empty Hash, keyed by the encryption key named in Key,
+// Prev is the hash of the previous record, so a changed or removed line breaks the chain and cannot be re-hashed
+// without the key. Without encryption keys Hash is a plain SHA-256, which detects accidental changes only.
+type Record struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Principal string    `json:"principal,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+	Key       string    `json:"key,omitempty"`
+}
+
+// encode returns the record without its hash, it is the hashed data
+func (r *Record) encode() []byte {
+	h := r.Hash
+	r.Hash = ""
+	data, _ := json.Marshal(r)
+	r.Hash = h
+
+	return data
+}
+
+// sign sets the key and the hash of the record, the current encryption key is used if there are keys
+func (r *Record) sign(keys *encryption.Keys) {
+	r.Key = keys.Current()
+	if r.Key == "" {
+		sum := sha256.Sum256(r.encode())
+		r.Hash = hex.EncodeToString(sum[:])
+		return
+	}
+
+	_, sum := keys.Sum(r.encode())
+	r.Hash = hex.EncodeToString(sum)
+}
+
+// valid checks the hash of the record, with encryption keys unkeyed records are rejected, they could be forged
+func (r *Record) valid(keys *encryption.Keys) bool {
+	if keys.Current() == "" {
+		sum := sha256.Sum256(r.encode())
+		return r.Key == "" && r.Hash == hex.EncodeToString(sum[:])
+	}
+
+	sum, ok := keys.SumWith(r.Key, r.encode())
+	if !ok {
+		return false
+	}
+	decoded, errDecode := hex.DecodeString(r.Hash)
+
+	return errDecode == nil && hmac.Equal(decoded, sum)
+}
+
+// Log appends hash chained records to the JSON lines file, a nil Log records nothing
+type Log struct {
+	mu     sync.Mutex
+	f      *os.File
+	keys   *encryption.Keys
+	last   Record
+	recent []Record
+}
+
+// Open opens the audit file for appending, existing records are checked and the chain is continued.
+// Records are keyed by the encryption keys, nil keys hash them without a key.
+func Open(path string, keys *encryption.Keys) (*Log, error) {
+	l := &Log{keys: keys}
+	if keys == nil {
+		slog.Warn("audit log is not keyed, configure encryption keys to protect it against rewriting")
+	}
+
+	errRead := l.read(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	f, errOpen := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if errOpen != nil {
+		return nil, errOpen
+	}
+	l.f = f
+
+	return l, nil
+}
+
+// read loads the last records of the existing file, a broken chain is reported but the file is still used
+func (l *Log) read(path string) error {
+	f, errOpen := os.Open(path)
+	if errOpen != nil {
+		if os.IsNotExist(errOpen) {
+			return nil
+		}
+		return errOpen
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		errDecode := json.Unmarshal(scanner.Bytes(), &r)
+		if errDecode != nil || r.Prev != l.last.Hash || !r.valid(l.keys) {
+			slog.Error("audit log chain is broken", slog.String("file", path), slog.Int("line", line))
+		}
+		if errDecode != nil {
+			continue
+		}
+		l.last = r
+		l.remember(r)
+	}
+
+	return scanner.Err()
+}
+
+func (l *Log) remember(r Record) {
+	if len(l.recent) == recentRecords {
+		l.recent = append(l.recent[:0], l.recent[1:]...)
+	}
+	l.recent = append(l.recent, r)
+}
+
+// Record appends the record, write errors are logged and do not fail the audited action
+func (l *Log) Record(action string, principal string, topic string, detail string) {
+	l.RecordBatch([]Record{{Action: action, Principal: principal, Topic: topic, Detail: detail}})
+}
+
+// RecordBatch appends the records with one sync, only their action, principal, topic and detail are taken
+func (l *Log) RecordBatch(records []Record) {
+	if l == nil || len(records) == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var buf []byte
+	last := l.last
+	signed := make([]Record, 0, len(records))
+	for _, src := range records {
+		r := Record{
+			Seq:       last.Seq + 1,
+			Time:      time.Now().UTC(),
+			Action:    src.Action,
+			Principal: src.Principal,
+			Topic:     src.Topic,
+			Detail:    src.Detail,
+			Prev:      last.Hash,
+		}
+		r.sign(l.keys)
+
+		data, _ := json.Marshal(r)
+		buf = append(append(buf, data...), '\n')
+		signed = append(signed, r)
+		last = r
+	}
+
+	_, errWrite := l.f.Write(buf)
+	if errWrite != nil {
+		slog.Error("error write audit record", slog.String("action", records[0].Action), slog.String("error", errWrite.Error()))
+		return
+	}
+	// the record is on disk before the audited action is reported as done
+	errSync := l.f.Sync()
+	if errSync != nil {
+		slog.Error("error sync audit record", slog.String("action", records[0].Action), slog.String("error", errSync.Error()))
+	}
+
+	l.last = last
+	for _, r := range signed {
+		l.remember(r)
+	}
+}
+
+// Recent returns up to limit last records, newest first, optionally only with the action
+func (l *Log) Recent(action string, limit int) []Record {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := make([]Record, 0, min(limit, len(l.recent)))
+	for i := len(l.recent) - 1; i >= 0 && len(records) < limit; i-- {
+		if action != "" && l.recent[i].Action != action {
+			continue
+		}
+		records = append(records, l.recent[i])
+	}
+
+	return records
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	return l.f.Close()
+}
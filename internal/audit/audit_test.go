@@ -0,0 +1,172 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ssqueue/ssqueue/internal/encryption"
+)
+
+func loadKeys(t *testing.T, value string) *encryption.Keys {
+	t.Helper()
+
+	k, errLoad := encryption.Load("", value)
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+
+	return k
+}
+
+func key(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func TestChainContinues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	k := loadKeys(t, "a:"+key(1))
+
+	l, errOpen := Open(path, k)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	l.Record(ActionTopicCreate, "bob", "orders", "")
+	l.Record(ActionTopicPurge, "bob", "orders", "2 messages")
+	_ = l.Close()
+
+	l, errOpen = Open(path, k)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	l.Record(ActionTopicDelete, "bob", "orders", "")
+	_ = l.Close()
+
+	records := l.Recent("", 10)
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+	for i, r := range records {
+		if r.Seq != int64(3-i) || r.Key != "a" || !r.valid(k) {
+			t.Errorf("record %d: seq %d key %q valid %v", i, r.Seq, r.Key, r.valid(k))
+		}
+	}
+	if records[0].Prev != records[1].Hash || records[1].Prev != records[2].Hash {
+		t.Error("records are not chained")
+	}
+	if got := l.Recent(ActionTopicPurge, 10); len(got) != 1 || got[0].Detail != "2 messages" {
+		t.Errorf("recent purges %v", got)
+	}
+
+	data, errRead := os.ReadFile(path)
+	if errRead != nil {
+		t.Fatal(errRead)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 3 {
+		t.Errorf("%d lines in the file, want 3", lines)
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	k := loadKeys(t, "a:"+key(1))
+
+	l, errOpen := Open(path, k)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	l.Record(ActionTopicCreate, "bob", "orders", "")
+	l.RecordBatch([]Record{
+		{Action: ActionACLDeny, Principal: "eve", Topic: "orders", Detail: "get x3"},
+		{Action: ActionACLDeny, Principal: "eve", Topic: "events", Detail: "send x1", Seq: 100, Hash: "forged"},
+	})
+	_ = l.Close()
+
+	// the file is read back with the chain checked, the batch continues it like single records
+	l, errOpen = Open(path, k)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	_ = l.Close()
+
+	records := l.Recent("", 10)
+	if len(records) != 3 {
+		t.Fatalf("%d records, want 3", len(records))
+	}
+	for i, r := range records {
+		if r.Seq != int64(3-i) || !r.valid(k) {
+			t.Errorf("record %d: seq %d valid %v", i, r.Seq, r.valid(k))
+		}
+		if i > 0 && records[i-1].Prev != r.Hash {
+			t.Errorf("record %d is not chained", i)
+		}
+	}
+	if got := l.Recent(ActionACLDeny, 10); len(got) != 2 || got[0].Detail != "send x1" {
+		t.Errorf("recent denials %v", got)
+	}
+}
+
+func TestRecordValid(t *testing.T) {
+	k := loadKeys(t, "a:"+key(1))
+	rotated := loadKeys(t, "b:"+key(2)+",a:"+key(1))
+	other := loadKeys(t, "a:"+key(3))
+
+	signed := func(keys *encryption.Keys) Record {
+		r := Record{Seq: 1, Action: ActionTopicCreate, Principal: "bob", Topic: "orders"}
+		r.sign(keys)
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		record func() Record
+		keys   *encryption.Keys
+		want   bool
+	}{
+		{name: "keyed", record: func() Record { return signed(k) }, keys: k, want: true},
+		{name: "keyed after rotation", record: func() Record { return signed(k) }, keys: rotated, want: true},
+		{name: "unkeyed without keys", record: func() Record { return signed(nil) }, keys: nil, want: true},
+		{name: "changed topic", record: func() Record {
+			r := signed(k)
+			r.Topic = "payments"
+			return r
+		}, keys: k, want: false},
+		{name: "changed seq", record: func() Record {
+			r := signed(k)
+			r.Seq = 2
+			return r
+		}, keys: k, want: false},
+		{name: "another key with the same id", record: func() Record { return signed(other) }, keys: k, want: false},
+		{name: "unknown key", record: func() Record { return signed(rotated) }, keys: k, want: false},
+		{name: "unkeyed with keys", record: func() Record { return signed(nil) }, keys: k, want: false},
+		{name: "keyed without keys", record: func() Record { return signed(k) }, keys: nil, want: false},
+		{name: "not hex hash", record: func() Record {
+			r := signed(k)
+			r.Hash = "zz"
+			return r
+		}, keys: k, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.record()
+			if got := r.valid(tt.keys); got != tt.want {
+				t.Errorf("valid %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+
+	l.Record(ActionTopicCreate, "bob", "orders", "")
+	if records := l.Recent("", 10); records != nil {
+		t.Errorf("nil log has records %v", records)
+	}
+	if errClose := l.Close(); errClose != nil {
+		t.Error(errClose)
+	}
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+const (
+	// anyPrincipal in a rule matches all clients
+	anyPrincipal = "*"
+
+	// denials are recorded in the audit log in batches, each record counts the same denials of the interval
+	denialsInterval = time.Second * 10
+	// maxDenials bounds distinct denials kept between batches, the rest are counted in one record
+	maxDenials = 1000
+)
+
+// labelEscaper escapes metric label values as the Prometheus text format does
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type denial struct {
+	principal string
+	action    string
+	topic     string
+}
+
+// ACL checks actions of principals on topics, it can be replaced while in use
+type ACL struct {
+	mu    sync.RWMutex
+	rules []config.ACLRule
+	audit *audit.Log
+
+	dMu     sync.Mutex
+	denials map[denial]int
+	// dropped counts denials over maxDenials
+	dropped int
+}
+
+// NewACL returns the ACL which records denials in the audit log, Run writes them
+func NewACL(auditLog *audit.Log) *ACL {
+	return &ACL{audit: auditLog, denials: make(map[denial]int)}
+}
+
+// Run records denials in the audit log every interval and at the end
+func (a *ACL) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(denialsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			a.recordDenials()
+			return
+		case <-ticker.C:
+			a.recordDenials()
+		}
+	}
+}
+
+// recordDenials writes one audit record per distinct denial with the number of times it happened
+func (a *ACL) recordDenials() {
+	a.dMu.Lock()
+	denials, dropped := a.denials, a.dropped
+	a.denials, a.dropped = make(map[denial]int), 0
+	a.dMu.Unlock()
+
+	records := make([]audit.Record, 0, len(denials)+1)
+	for d, count := range denials {
+		records = append(records, audit.Record{Action: audit.ActionACLDeny, Principal: d.principal, Topic: d.topic, Detail: d.action + " x" + strconv.Itoa(count)})
+	}
+	if dropped > 0 {
+		records = append(records, audit.Record{Action: audit.ActionACLDeny, Detail: "other x" + strconv.Itoa(dropped)})
+	}
+	a.audit.RecordBatch(records)
+}
+
+// Set replaces the rules and reports whether they differ from the previous ones.
+// Rules must be validated by config.File.Validate.
+func (a *ACL) Set(rules []config.ACLRule) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	changed := !reflect.DeepEqual(a.rules, rules) && len(a.rules)+len(rules) > 0
+	a.rules = slices.Clone(rules)
+
+	return changed
+}
+
+// Allowed reports whether any rule allows the action on the topic to the principal, without rules everything is allowed.
+// Denials are counted in the ssqueue_acl_denied metric and recorded in the audit log by Run.
+func (a *ACL) Allowed(principal string, action string, topic string) bool {
+	if a.allowed(principal, topic, func(actions []string) bool { return slices.Contains(actions, action) }) {
+		return true
+	}
+
+	metrics.GetOrCreateCounter("ssqueue_acl_denied{principal=\"" + labelEscaper.Replace(principal) + "\",action=\"" + action + "\"}").Inc()
+
+	d := denial{principal: principal, action: action, topic: topic}
+	a.dMu.Lock()
+	if _, ok := a.denials[d]; ok || len(a.denials) < maxDenials {
+		a.denials[d]++
+	} else {
+		a.dropped++
+	}
+	a.dMu.Unlock()
+
+	return false
+}
+
+// Visible reports whether any action on the topic is allowed to the principal, it is not counted as a denial
+func (a *ACL) Visible(principal string, topic string) bool {
+	return a.allowed(principal, topic, func(actions []string) bool { return len(actions) > 0 })
+}
+
+func (a *ACL) allowed(principal string, topic string, matchActions func(actions []string) bool) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if len(a.rules) == 0 {
+		return true
+	}
+
+	for _, rule := range a.rules {
+		if rule.Principal != anyPrincipal && rule.Principal != principal {
+			continue
+		}
+		if !matchActions(rule.Actions) {
+			continue
+		}
+		for _, pattern := range rule.Topics {
+			if config.Match(pattern, topic) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+type principalKey struct{}
+
+// WithPrincipal returns the context carrying the name of the authenticated client
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the name of the authenticated client, it is empty if authentication is disabled
+func Principal(ctx context.Context) string {
+	principal, _ := ctx.Value(principalKey{}).(string)
+	return principal
+}
+
+// Tokens authenticates bearer tokens by their SHA-256 hashes, it can be replaced while in use
+type Tokens struct {
+	mu     sync.RWMutex
+	byHash map[[sha256.Size]byte]string
+}
+
+func NewTokens() *Tokens {
+	return &Tokens{byHash: make(map[[sha256.Size]byte]string)}
+}
+
+// Set replaces the tokens and returns the names of added and removed ones.
+// Tokens must be validated by config.File.Validate.
+func (t *Tokens) Set(tokens []config.Token) (added []string, removed []string) {
+	byHash := make(map[[sha256.Size]byte]string, len(tokens))
+	for _, token := range tokens {
+		var hash [sha256.Size]byte
+		_, _ = hex.Decode(hash[:], []byte(token.SHA256))
+		byHash[hash] = token.Name
+	}
+
+	t.mu.Lock()
+	old := t.byHash
+	t.byHash = byHash
+	t.mu.Unlock()
+
+	for hash, name := range byHash {
+		if _, ok := old[hash]; !ok {
+			added = append(added, name)
+		}
+	}
+	for hash, name := range old {
+		if _, ok := byHash[hash]; !ok {
+			removed = append(removed, name)
+		}
+	}
+	slices.Sort(added)
+	slices.Sort(removed)
+
+	return added, removed
+}
+
+// Enabled reports whether any tokens are set, without them all requests are allowed
+func (t *Tokens) Enabled() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.byHash) > 0
+}
+
+// Authenticate returns the name of the token
+func (t *Tokens) Authenticate(token string) (string, bool) {
+	hash := sha256.Sum256([]byte(token))
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	name, ok := t.byHash[hash]
+
+	return name, ok
+}
+
+// AuthenticateConn authenticates a client of a front without HTTP by its certificate or by the token passed
+// in the credentials of the protocol. Without tokens a client without a certificate is allowed anonymously.
+func (t *Tokens) AuthenticateConn(nc net.Conn, token string) (string, bool) {
+	if principal, ok := ConnPrincipal(nc); ok {
+		return principal, true
+	}
+	if !t.Enabled() {
+		return "", true
+	}
+	if token == "" {
+		return "", false
+	}
+
+	return t.Authenticate(token)
+}
+
+// certPrincipalPrefix keeps principals of certificates apart from token names
+const certPrincipalPrefix = "cert:"
+
+// CertificatePrincipal returns cert: and the subject common name of the client certificate verified by mutual TLS
+func CertificatePrincipal(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return "", false
+	}
+
+	return certPrincipalPrefix + state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// ConnPrincipal returns the principal of the client certificate of the TLS connection, the handshake is completed first
+func ConnPrincipal(nc net.Conn) (string, bool) {
+	tc, ok := nc.(*tls.Conn)
+	if !ok || tc.Handshake() != nil {
+		return "", false
+	}
+	state := tc.ConnectionState()
+
+	return CertificatePrincipal(&state)
+}
+
+// Middleware requires the Authorization: Bearer header with a known token and adds its name to the request context.
+// A client certificate verified by mutual TLS is used instead, its principal is cert:<common name>.
+// Paths listed in public are served without authentication.
+func (t *Tokens) Middleware(next http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if name, ok := CertificatePrincipal(req.TLS); ok {
+			slog.Debug("request authenticated by certificate", slog.String("principal", name), slog.String("path", req.URL.Path))
+			next.ServeHTTP(rw, req.WithContext(WithPrincipal(req.Context(), name)))
+			return
+		}
+
+		if !t.Enabled() || slices.Contains(public, req.URL.Path) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			var name string
+			name, ok = t.Authenticate(token)
+			if ok {
+				slog.Debug("request authenticated", slog.String("principal", name), slog.String("path", req.URL.Path))
+				next.ServeHTTP(rw, req.WithContext(WithPrincipal(req.Context(), name)))
+				return
+			}
+		}
+
+		slog.Warn("request not authenticated", slog.String("remote", req.RemoteAddr), slog.String("path", req.URL.Path))
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="ssqueue"`)
+		http.Error(rw, "unauthorized", http.StatusUnauthorized)
+	})
+}
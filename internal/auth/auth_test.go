@@ -0,0 +1,273 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func token(name string, secret string) config.Token {
+	hash := sha256.Sum256([]byte(secret))
+	return config.Token{Name: name, SHA256: hex.EncodeToString(hash[:])}
+}
+
+func TestACL(t *testing.T) {
+	rules := []config.ACLRule{
+		{Principal: "producer", Topics: []string{"orders.*"}, Actions: []string{config.ActionSend}},
+		{Principal: "consumer", Topics: []string{"orders.*", "events"}, Actions: []string{config.ActionGet}},
+		{Principal: "*", Topics: []string{"public"}, Actions: []string{config.ActionSend, config.ActionGet}},
+	}
+
+	tests := []struct {
+		name      string
+		rules     []config.ACLRule
+		principal string
+		action    string
+		topic     string
+		allowed   bool
+		visible   bool
+	}{
+		{name: "no rules", rules: nil, principal: "", action: config.ActionAdmin, topic: "any", allowed: true, visible: true},
+		{name: "pattern", rules: rules, principal: "producer", action: config.ActionSend, topic: "orders.new", allowed: true, visible: true},
+		{name: "other action", rules: rules, principal: "producer", action: config.ActionGet, topic: "orders.new", allowed: false, visible: true},
+		{name: "other topic", rules: rules, principal: "producer", action: config.ActionSend, topic: "events", allowed: false, visible: false},
+		{name: "exact topic", rules: rules, principal: "consumer", action: config.ActionGet, topic: "events", allowed: true, visible: true},
+		{name: "any principal", rules: rules, principal: "guest", action: config.ActionGet, topic: "public", allowed: true, visible: true},
+		{name: "anonymous", rules: rules, principal: "", action: config.ActionSend, topic: "orders.new", allowed: false, visible: false},
+		{name: "unknown principal", rules: rules, principal: "guest", action: config.ActionAdmin, topic: "public", allowed: false, visible: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := NewACL(nil)
+			acl.Set(tt.rules)
+
+			if got := acl.Allowed(tt.principal, tt.action, tt.topic); got != tt.allowed {
+				t.Errorf("allowed %v, want %v", got, tt.allowed)
+			}
+			if got := acl.Visible(tt.principal, tt.topic); got != tt.visible {
+				t.Errorf("visible %v, want %v", got, tt.visible)
+			}
+		})
+	}
+}
+
+func TestACLDenials(t *testing.T) {
+	auditLog, errOpen := audit.Open(filepath.Join(t.TempDir(), "audit.log"), nil)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer func() {
+		_ = auditLog.Close()
+	}()
+
+	acl := NewACL(auditLog)
+	acl.Set([]config.ACLRule{{Principal: "bob", Topics: []string{"orders"}, Actions: []string{config.ActionGet}}})
+
+	for range 3 {
+		acl.Allowed("bob", config.ActionSend, "orders")
+	}
+	// a principal is any certificate name, it must not break the metric
+	acl.Allowed("cert:a\"b\\c\nd", config.ActionGet, "orders")
+
+	if got := auditLog.Recent(audit.ActionACLDeny, 10); len(got) != 0 {
+		t.Fatalf("%d denials recorded before the batch", len(got))
+	}
+	acl.recordDenials()
+
+	got := auditLog.Recent(audit.ActionACLDeny, 10)
+	details := make([]string, 0, len(got))
+	for _, r := range got {
+		details = append(details, r.Principal+" "+r.Detail)
+	}
+	slices.Sort(details)
+	if want := []string{"bob send x3", "cert:a\"b\\c\nd get x1"}; !slices.Equal(details, want) {
+		t.Errorf("recorded %q, want %q", details, want)
+	}
+
+	var buf bytes.Buffer
+	metrics.WritePrometheus(&buf, false)
+	if !strings.Contains(buf.String(), `ssqueue_acl_denied{principal="cert:a\"b\\c\nd",action="get"} 1`) {
+		t.Error("escaped denial metric is not exported")
+	}
+}
+
+func TestACLSet(t *testing.T) {
+	rules := []config.ACLRule{{Principal: "a", Topics: []string{"t"}, Actions: []string{config.ActionGet}}}
+
+	acl := NewACL(nil)
+	if acl.Set(nil) {
+		t.Error("empty rules reported as changed")
+	}
+	if !acl.Set(rules) {
+		t.Error("new rules not reported as changed")
+	}
+	if acl.Set(slices.Clone(rules)) {
+		t.Error("same rules reported as changed")
+	}
+	if !acl.Set(nil) {
+		t.Error("removed rules not reported as changed")
+	}
+}
+
+func TestTokensSet(t *testing.T) {
+	tokens := NewTokens()
+	if tokens.Enabled() {
+		t.Fatal("enabled without tokens")
+	}
+
+	added, removed := tokens.Set([]config.Token{token("b", "secret-b"), token("a", "secret-a")})
+	if !slices.Equal(added, []string{"a", "b"}) || removed != nil {
+		t.Errorf("added %v removed %v, want [a b] and none", added, removed)
+	}
+
+	added, removed = tokens.Set([]config.Token{token("a", "secret-a"), token("c", "secret-c")})
+	if !slices.Equal(added, []string{"c"}) || !slices.Equal(removed, []string{"b"}) {
+		t.Errorf("added %v removed %v, want [c] and [b]", added, removed)
+	}
+
+	tests := []struct {
+		secret string
+		name   string
+		ok     bool
+	}{
+		{secret: "secret-a", name: "a", ok: true},
+		{secret: "secret-c", name: "c", ok: true},
+		{secret: "secret-b", name: "", ok: false},
+		{secret: "", name: "", ok: false},
+	}
+	for _, tt := range tests {
+		name, ok := tokens.Authenticate(tt.secret)
+		if name != tt.name || ok != tt.ok {
+			t.Errorf("authenticate %q: %q %v, want %q %v", tt.secret, name, ok, tt.name, tt.ok)
+		}
+	}
+}
+
+func TestAuthenticateConn(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokens    []config.Token
+		token     string
+		principal string
+		ok        bool
+	}{
+		{name: "anonymous without tokens", tokens: nil, token: "", principal: "", ok: true},
+		{name: "token ignored without tokens", tokens: nil, token: "secret", principal: "", ok: true},
+		{name: "missing token", tokens: []config.Token{token("a", "secret")}, token: "", principal: "", ok: false},
+		{name: "wrong token", tokens: []config.Token{token("a", "secret")}, token: "other", principal: "", ok: false},
+		{name: "token", tokens: []config.Token{token("a", "secret")}, token: "secret", principal: "a", ok: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := NewTokens()
+			tokens.Set(tt.tokens)
+
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+
+			principal, ok := tokens.AuthenticateConn(server, tt.token)
+			if principal != tt.principal || ok != tt.ok {
+				t.Errorf("got %q %v, want %q %v", principal, ok, tt.principal, tt.ok)
+			}
+		})
+	}
+}
+
+func TestCertificatesConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		clientCA *x509.CertPool
+		config   func(c *Certificates) *tls.Config
+		want     tls.ClientAuthType
+	}{
+		{name: "without client CA", clientCA: nil, config: (*Certificates).Config, want: tls.NoClientCert},
+		{name: "client certificates are optional", clientCA: x509.NewCertPool(), config: (*Certificates).Config, want: tls.VerifyClientCertIfGiven},
+		{name: "server config", clientCA: x509.NewCertPool(), config: (*Certificates).ServerConfig, want: tls.NoClientCert},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Certificates{cert: &tls.Certificate{}, clientCA: tt.clientCA}
+
+			cfg, errConfig := tt.config(c).GetConfigForClient(&tls.ClientHelloInfo{})
+			if errConfig != nil {
+				t.Fatal(errConfig)
+			}
+			if cfg.ClientAuth != tt.want {
+				t.Errorf("client auth %v, want %v", cfg.ClientAuth, tt.want)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokens    []config.Token
+		path      string
+		header    string
+		code      int
+		principal string
+		// cert is the common name of a verified client certificate
+		cert string
+	}{
+		{name: "disabled", tokens: nil, path: "/api", header: "", code: http.StatusOK, principal: ""},
+		{name: "missing header", tokens: []config.Token{token("a", "secret")}, path: "/api", header: "", code: http.StatusUnauthorized},
+		{name: "not bearer", tokens: []config.Token{token("a", "secret")}, path: "/api", header: "Basic secret", code: http.StatusUnauthorized},
+		{name: "wrong token", tokens: []config.Token{token("a", "secret")}, path: "/api", header: "Bearer other", code: http.StatusUnauthorized},
+		{name: "token", tokens: []config.Token{token("a", "secret")}, path: "/api", header: "Bearer secret", code: http.StatusOK, principal: "a"},
+		{name: "public path", tokens: []config.Token{token("a", "secret")}, path: "/health", header: "", code: http.StatusOK, principal: ""},
+		{name: "certificate", tokens: []config.Token{token("admin", "secret")}, path: "/api", header: "", code: http.StatusOK, principal: "cert:admin", cert: "admin"},
+		{name: "certificate before token", tokens: []config.Token{token("admin", "secret")}, path: "/api", header: "Bearer secret", code: http.StatusOK, principal: "cert:b", cert: "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens := NewTokens()
+			tokens.Set(tt.tokens)
+
+			var principal string
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				principal = Principal(req.Context())
+			})
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cert != "" {
+				req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: tt.cert}}}}}
+			}
+			rec := httptest.NewRecorder()
+			tokens.Middleware(next, "/health").ServeHTTP(rec, req)
+
+			if rec.Code != tt.code {
+				t.Fatalf("code %d, want %d", rec.Code, tt.code)
+			}
+			if principal != tt.principal {
+				t.Errorf("principal %q, want %q", principal, tt.principal)
+			}
+			if tt.code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certificate files are checked for changes
+const certCheckInterval = time.Second * 10
+
+var errNoClientCA = errors.New("no certificates in the client CA file")
+
+// Certificates serves the server certificate and the client CA from files and reloads them when the files change
+type Certificates struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes []time.Time
+}
+
+// NewCertificates loads the certificate and key, the client CA file is optional and enables mutual TLS
+func NewCertificates(certFile string, keyFile string, clientCAFile string) (*Certificates, error) {
+	c := &Certificates{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+
+	errLoad := c.load()
+	if errLoad != nil {
+		return nil, errLoad
+	}
+
+	return c, nil
+}
+
+// Config returns the TLS config for listeners, every handshake uses the latest loaded files.
+// With the client CA, clients may present a certificate signed by it instead of a token.
+func (c *Certificates) Config() *tls.Config {
+	return c.config(true)
+}
+
+// ServerConfig returns the TLS config which never asks clients for certificates, for listeners authenticating otherwise
+func (c *Certificates) ServerConfig() *tls.Config {
+	return c.config(false)
+}
+
+func (c *Certificates) config(clientAuth bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+			}
+			if clientAuth && c.clientCA != nil {
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+				cfg.ClientCAs = c.clientCA
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// Run checks the files for changes until the context is done, broken files are logged and the previous ones are kept
+func (c *Certificates) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !c.changed() {
+			continue
+		}
+
+		errLoad := c.load()
+		if errLoad != nil {
+			slog.Error("error reload certificates", slog.String("error", errLoad.Error()))
+			continue
+		}
+
+		slog.Info("certificates reloaded", slog.String("cert", c.certFile))
+	}
+}
+
+func (c *Certificates) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientCAFile != "" {
+		files = append(files, c.clientCAFile)
+	}
+
+	return files
+}
+
+// changed reports whether modification times of the files differ from the loaded ones
+func (c *Certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for i, file := range c.files() {
+		stat, errStat := os.Stat(file)
+		if errStat != nil {
+			// a file being replaced may be missing for a moment, it is checked again later
+			return false
+		}
+		if !stat.ModTime().Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Certificates) load() error {
+	var modTimes []time.Time
+	for _, file := range c.files() {
+		stat, errStat := os.Stat(file)
+		if errStat != nil {
+			return errStat
+		}
+		modTimes = append(modTimes, stat.ModTime())
+	}
+
+	cert, errCert := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if errCert != nil {
+		return errCert
+	}
+
+	var clientCA *x509.CertPool
+	if c.clientCAFile != "" {
+		data, errRead := os.ReadFile(c.clientCAFile)
+		if errRead != nil {
+			return errRead
+		}
+		clientCA = x509.NewCertPool()
+		if !clientCA.AppendCertsFromPEM(data) {
+			return errNoClientCA
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.clientCA = clientCA
+	c.modTimes = modTimes
+	c.mu.Unlock()
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/cristalhq/aconfig"
 )
 
@@ -9,11 +11,57 @@ type Snapshot struct {
 	Path    string `env:"PATH"`
 }
 
+// TLS enables TLS on all listeners when the certificate is set, the files are reloaded when they change
+type TLS struct {
+	CertFile string `env:"CERT_FILE"`
+	KeyFile  string `env:"KEY_FILE"`
+	// ClientCAFile enables mutual TLS, clients may present a certificate signed by this CA instead of a token.
+	// The principal of a certificate is cert:<common name>, so it never matches a token name.
+	// The service server never asks for client certificates, it is authenticated by service tokens.
+	ClientCAFile string `env:"CLIENT_CA_FILE"`
+}
+
+// Encryption keys encrypt files at rest, entries are id:base64key, the first key encrypts and all keys decrypt
+type Encryption struct {
+	Keys    string `env:"KEYS"`
+	KeyFile string `env:"KEY_FILE"`
+	// MigratePlaintext accepts unencrypted files while keys are configured, they are encrypted when written next.
+	// Enable it for one start after turning encryption on, otherwise unencrypted files are rejected.
+	MigratePlaintext bool `env:"MIGRATE_PLAINTEXT"`
+}
+
 type Config struct {
-	Debug          bool     `env:"DEBUG"`
-	Address        string   `env:"ADDRESS" default:":8080"`
-	ServiceAddress string   `env:"SERVICE_ADDRESS" default:":8081"`
-	Snapshot       Snapshot `envPrefix:"SNAPSHOT"`
+	Debug            bool       `env:"DEBUG"`
+	Address          string     `env:"ADDRESS" default:":8080"`
+	ServiceAddress   string     `env:"SERVICE_ADDRESS" default:":8081"`
+	SQSAddress       string     `env:"SQS_ADDRESS"`
+	STOMPAddress     string     `env:"STOMP_ADDRESS"`
+	MQTTAddress      string     `env:"MQTT_ADDRESS"`
+	BeanstalkAddress string     `env:"BEANSTALK_ADDRESS"`
+	Snapshot         Snapshot   `envPrefix:"SNAPSHOT"`
+	TLS              TLS        `envPrefix:"TLS"`
+	Encryption       Encryption `envPrefix:"ENCRYPTION"`
+	// DedupWindow is how long idempotency keys of sent messages are remembered
+	DedupWindow time.Duration `env:"DEDUP_WINDOW" default:"5m"`
+	// GroupHold is how long the group of a message taken by get stays busy, get has no acknowledgement to free it earlier.
+	// Get delivers one message of a group per hold, groups are consumed in order at full speed with reserve and ack.
+	// Zero keeps no hold, get then delivers messages of a group without waiting for the previous one to be processed.
+	GroupHold time.Duration `env:"GROUP_HOLD" default:"30s"`
+	// ReplyTopicTTL is how long an idle temporary reply topic is kept
+	ReplyTopicTTL time.Duration `env:"REPLY_TOPIC_TTL" default:"1m"`
+	// TopicIdleTTL is how long an empty topic without consumers is kept, zero keeps topics forever.
+	// Topics created with the topic API are never removed.
+	TopicIdleTTL time.Duration `env:"TOPIC_IDLE_TTL"`
+	// StrictTopics disables implicit creation of topics, they must be created with the topic API first
+	StrictTopics bool `env:"STRICT_TOPICS"`
+	// File is the path to the JSON or TOML file declaring topics, see File
+	File string `env:"CONFIG_FILE"`
+	// MaxMessageSize limits message data of topics without their own limit, zero is unlimited.
+	// Requests sending messages are limited by it too, or by the larger limit of the topic, before they are read.
+	MaxMessageSize int `env:"MAX_MESSAGE_SIZE" default:"1048576"`
+	// AuditFile is the path to the append-only audit log, without it nothing is audited.
+	// Records are chained with HMAC keyed by the encryption keys, so the keys must be kept to verify older records.
+	AuditFile string `env:"AUDIT_FILE"`
 }
 
 func Load() *Config {
@@ -0,0 +1,338 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// decodeTOML converts a TOML document to JSON, so both formats are decoded into File by the same field names.
+// The subset of TOML needed by File is supported: key = value pairs, [table] and [[array of tables]] headers,
+// strings, integers, floats, booleans, arrays and inline tables. Dotted keys, multi-line strings and dates are not.
+func decodeTOML(data []byte) ([]byte, error) {
+	p := &tomlParser{src: string(data), line: 1}
+
+	root := make(map[string]any)
+	tableArrays := make(map[string]bool)
+	current := root
+	for {
+		p.skip(true)
+		if p.pos == len(p.src) {
+			break
+		}
+
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], "[["):
+			p.pos += 2
+			key, errKey := p.key()
+			if errKey != nil {
+				return nil, errKey
+			}
+			errExpect := p.expect("]]")
+			if errExpect != nil {
+				return nil, errExpect
+			}
+			if _, ok := root[key]; ok && !tableArrays[key] {
+				return nil, p.errorf("key %q is declared twice", key)
+			}
+			table := make(map[string]any)
+			tables, _ := root[key].([]any)
+			root[key] = append(tables, table)
+			tableArrays[key] = true
+			current = table
+		case p.src[p.pos] == '[':
+			p.pos++
+			key, errKey := p.key()
+			if errKey != nil {
+				return nil, errKey
+			}
+			errExpect := p.expect("]")
+			if errExpect != nil {
+				return nil, errExpect
+			}
+			if _, ok := root[key]; ok {
+				return nil, p.errorf("key %q is declared twice", key)
+			}
+			table := make(map[string]any)
+			root[key] = table
+			current = table
+		default:
+			errPair := p.keyValue(current)
+			if errPair != nil {
+				return nil, errPair
+			}
+		}
+
+		p.skip(false)
+		if p.pos < len(p.src) && p.src[p.pos] != '\n' {
+			return nil, p.errorf("unexpected %q at the end of the line", p.src[p.pos])
+		}
+	}
+
+	return json.Marshal(root)
+}
+
+type tomlParser struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (p *tomlParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", p.line, fmt.Sprintf(format, args...))
+}
+
+func (p *tomlParser) peek() byte {
+	if p.pos == len(p.src) {
+		return 0
+	}
+
+	return p.src[p.pos]
+}
+
+// skip moves past spaces and comments, and past line ends too when lines is set
+func (p *tomlParser) skip(lines bool) {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && lines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) expect(s string) error {
+	p.skip(false)
+	if !strings.HasPrefix(p.src[p.pos:], s) {
+		return p.errorf("%q expected", s)
+	}
+	p.pos += len(s)
+
+	return nil
+}
+
+func (p *tomlParser) key() (string, error) {
+	p.skip(false)
+
+	var key string
+	if c := p.peek(); c == '"' || c == '\'' {
+		s, errString := p.string()
+		if errString != nil {
+			return "", errString
+		}
+		key = s
+	} else {
+		start := p.pos
+		for p.pos < len(p.src) && isBareKey(p.src[p.pos]) {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("key expected")
+		}
+		key = p.src[start:p.pos]
+	}
+
+	p.skip(false)
+	if p.peek() == '.' {
+		return "", p.errorf("dotted keys are not supported")
+	}
+
+	return key, nil
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) keyValue(table map[string]any) error {
+	key, errKey := p.key()
+	if errKey != nil {
+		return errKey
+	}
+	errExpect := p.expect("=")
+	if errExpect != nil {
+		return errExpect
+	}
+	p.skip(false)
+	v, errValue := p.value()
+	if errValue != nil {
+		return errValue
+	}
+	if _, ok := table[key]; ok {
+		return p.errorf("key %q is declared twice", key)
+	}
+	table[key] = v
+
+	return nil
+}
+
+func (p *tomlParser) value() (any, error) {
+	rest := p.src[p.pos:]
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return p.string()
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	case strings.HasPrefix(rest, "true"):
+		p.pos += len("true")
+		return true, nil
+	case strings.HasPrefix(rest, "false"):
+		p.pos += len("false")
+		return false, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.src) && (isBareKey(p.src[p.pos]) || p.src[p.pos] == '.' || p.src[p.pos] == '+') {
+		p.pos++
+	}
+	s := p.src[start:p.pos]
+	if s == "" {
+		return nil, p.errorf("value expected")
+	}
+	number := strings.ReplaceAll(s, "_", "")
+	if i, errInt := strconv.ParseInt(number, 10, 64); errInt == nil {
+		return i, nil
+	}
+	if f, errFloat := strconv.ParseFloat(number, 64); errFloat == nil {
+		return f, nil
+	}
+
+	return nil, p.errorf("invalid value %q", s)
+}
+
+func (p *tomlParser) string() (string, error) {
+	quote := p.src[p.pos]
+	if strings.HasPrefix(p.src[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	p.pos++
+
+	var b strings.Builder
+	for {
+		if p.pos == len(p.src) || p.src[p.pos] == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			errEscape := p.escape(&b)
+			if errEscape != nil {
+				return "", errEscape
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+func (p *tomlParser) escape(b *strings.Builder) error {
+	c := p.peek()
+	p.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if p.pos+size > len(p.src) {
+			return p.errorf("invalid escape")
+		}
+		r, errParse := strconv.ParseUint(p.src[p.pos:p.pos+size], 16, 32)
+		if errParse != nil || !utf8.ValidRune(rune(r)) {
+			return p.errorf("invalid escape")
+		}
+		p.pos += size
+		b.WriteRune(rune(r))
+	default:
+		return p.errorf("invalid escape")
+	}
+
+	return nil
+}
+
+// array may span lines, a trailing comma is allowed
+func (p *tomlParser) array() ([]any, error) {
+	p.pos++
+
+	values := []any{}
+	for {
+		p.skip(true)
+		if p.peek() == ']' {
+			p.pos++
+			return values, nil
+		}
+
+		v, errValue := p.value()
+		if errValue != nil {
+			return nil, errValue
+		}
+		values = append(values, v)
+
+		p.skip(true)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+			p.pos++
+			return values, nil
+		default:
+			return nil, p.errorf("',' or ']' expected in array")
+		}
+	}
+}
+
+// inlineTable is written on one line, without a trailing comma
+func (p *tomlParser) inlineTable() (map[string]any, error) {
+	p.pos++
+
+	table := make(map[string]any)
+	p.skip(false)
+	if p.peek() == '}' {
+		p.pos++
+		return table, nil
+	}
+	for {
+		errPair := p.keyValue(table)
+		if errPair != nil {
+			return nil, errPair
+		}
+
+		p.skip(false)
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return table, nil
+		default:
+			return nil, p.errorf("',' or '}' expected in inline table")
+		}
+	}
+}
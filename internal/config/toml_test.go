@@ -0,0 +1,52 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+		// err is a part of the expected error message
+		err string
+	}{
+		{name: "empty", data: "", want: `{}`},
+		{name: "comments", data: "# comment\n\na = 1 # comment\n", want: `{"a":1}`},
+		{name: "values", data: "a = -1_000\nb = 2.5\nc = true\nd = false\ne = [1, \"x\"]\n", want: `{"a":-1000,"b":2.5,"c":true,"d":false,"e":[1,"x"]}`},
+		{name: "strings", data: `a = "q\"\\\n\u00e9"` + "\nb = 'c:\\dir'\n\"quoted key\" = 1\n", want: `{"a":"q\"\\\né","b":"c:\\dir","quoted key":1}`},
+		{name: "multi-line array", data: "a = [\n  [1, 2],\n  [],\n]\n", want: `{"a":[[1,2],[]]}`},
+		{name: "inline table", data: "a = [{ name = \"x\", n = 1 }, {}]\n", want: `{"a":[{"n":1,"name":"x"},{}]}`},
+		{name: "tables", data: "[[a]]\nn = 1\n[[a]]\nn = 2\n[b]\nc = \"d\"\n", want: `{"a":[{"n":1},{"n":2}],"b":{"c":"d"}}`},
+		{name: "duplicate key", data: "a = 1\na = 2\n", err: "line 2: key \"a\" is declared twice"},
+		{name: "duplicate table", data: "[a]\n[a]\n", err: "declared twice"},
+		{name: "table after value", data: "a = 1\n[[a]]\n", err: "declared twice"},
+		{name: "dotted key", data: "a.b = 1\n", err: "dotted keys"},
+		{name: "missing value", data: "a =\n", err: "value expected"},
+		{name: "invalid value", data: "a = 1979-05-27\n", err: "invalid value"},
+		{name: "two values", data: "a = 1 2\n", err: "at the end of the line"},
+		{name: "unterminated array", data: "a = [1\n", err: "expected in array"},
+		{name: "invalid escape", data: `a = "\x"`, err: "invalid escape"},
+		{name: "multi-line string", data: `a = """x"""`, err: "multi-line strings"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeTOML([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("decoded %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package config
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File is the configuration file, it declares topics with their settings and credentials of clients
+type File struct {
+	Topics []Topic `json:"topics"`
+	// Tokens authenticate clients of the API server, without tokens the API server is open
+	Tokens []Token `json:"tokens"`
+	// ServiceTokens authenticate clients of the service server, except for the liveness probe
+	ServiceTokens []Token `json:"service_tokens"`
+	// ACL allows actions on topics to principals named by tokens, without rules everything is allowed
+	ACL []ACLRule `json:"acl"`
+	// RateLimits throttle sends and gets, all matching limits must allow the request
+	RateLimits []RateLimit `json:"rate_limits"`
+	// Tenants share quotas between their topics
+	Tenants []Tenant `json:"tenants"`
+}
+
+// ACLRule allows the actions on topics matching any of the patterns, * in a pattern matches any characters.
+// The principal * matches all clients, including anonymous ones when there are no tokens.
+type ACLRule struct {
+	Principal string   `json:"principal"`
+	Topics    []string `json:"topics"`
+	Actions   []string `json:"actions"`
+}
+
+// actions which can be allowed by ACL rules
+const (
+	ActionSend  = "send"
+	ActionGet   = "get"
+	ActionAdmin = "admin"
+)
+
+// RateLimit is a token bucket for the action of a principal or on a topic, exactly one of them is set.
+// The principal or topic * gives each principal or topic its own bucket.
+// Rate is the number of requests per second, Burst is the bucket size and defaults to the rate rounded up.
+type RateLimit struct {
+	Principal string  `json:"principal"`
+	Topic     string  `json:"topic"`
+	Action    string  `json:"action"`
+	Rate      float64 `json:"rate"`
+	Burst     int     `json:"burst"`
+}
+
+// Tenant shares quotas between topics matching any of its patterns, a topic belongs to the first matching tenant.
+// Zero quotas are unlimited.
+type Tenant struct {
+	Name   string   `json:"name"`
+	Topics []string `json:"topics"`
+	// MaxTopics limits the number of topics, topics declared in the file and dead letter topics are created anyway
+	MaxTopics int `json:"max_topics"`
+	// MaxBytes limits the total data size of messages held in all topics, pending, leased, delayed, buried and dead ones
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxConsumers limits the number of consumers waiting in all topics at the same time
+	MaxConsumers int `json:"max_consumers"`
+}
+
+// Matches reports whether the topic belongs to the tenant
+func (t *Tenant) Matches(topic string) bool {
+	for _, pattern := range t.Topics {
+		if Match(pattern, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Match reports whether the name matches the pattern, * in the pattern matches any sequence of characters
+func Match(pattern string, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+
+	rest, ok := strings.CutPrefix(name, parts[0])
+	if !ok {
+		return false
+	}
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, part)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(part):]
+	}
+
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// Token is a bearer token known by its name, only the hash of the token is stored.
+// The hash is made with: echo -n "$TOKEN" | sha256sum
+type Token struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+}
+
+// Topic settings, zero values are unlimited
+type Topic struct {
+	Name string `json:"name"`
+	// MaxMessages limits the number of pending messages, sends to the full topic fail
+	MaxMessages int `json:"max_messages"`
+	// MessageTTL is how long a pending message waits for delivery before it is dropped
+	MessageTTL Duration `json:"message_ttl"`
+	// DeadLetterTopic receives messages which were reserved MaxReceives times and not acknowledged
+	DeadLetterTopic string `json:"dead_letter_topic"`
+	MaxReceives     int    `json:"max_receives"`
+	// MaxMessageSize limits message data in bytes, it replaces the global limit for the topic
+	MaxMessageSize int `json:"max_message_size"`
+	// Durable topics keep their messages in snapshots, it is true if not set
+	Durable *bool `json:"durable"`
+}
+
+func (t *Topic) IsDurable() bool {
+	return t.Durable == nil || *t.Durable
+}
+
+// Duration is time.Duration written as a string like 1m30s in the file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(src []byte) error {
+	var s string
+	errDecode := json.Unmarshal(src, &s)
+	if errDecode != nil {
+		return errDecode
+	}
+
+	v, errParse := time.ParseDuration(s)
+	if errParse != nil {
+		return errParse
+	}
+	*d = Duration(v)
+
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadFile reads and validates the configuration file, it is TOML with the .toml extension and JSON otherwise.
+// Unknown fields are rejected.
+func LoadFile(path string) (*File, error) {
+	data, errRead := os.ReadFile(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		var errTOML error
+		data, errTOML = decodeTOML(data)
+		if errTOML != nil {
+			return nil, fmt.Errorf("decode config file %q: %w", path, errTOML)
+		}
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	f := &File{}
+	errDecode := dec.Decode(f)
+	if errDecode != nil {
+		return nil, fmt.Errorf("decode config file %q: %w", path, errDecode)
+	}
+
+	errValidate := f.Validate()
+	if errValidate != nil {
+		return nil, fmt.Errorf("invalid config file %q: %w", path, errValidate)
+	}
+
+	return f, nil
+}
+
+// Validate checks settings of each topic and tokens, dead letter topics must be declared in the same file
+func (f *File) Validate() error {
+	errTokens := validateTokens("tokens", f.Tokens)
+	if errTokens != nil {
+		return errTokens
+	}
+	errTokens = validateTokens("service_tokens", f.ServiceTokens)
+	if errTokens != nil {
+		return errTokens
+	}
+	for i, rule := range f.ACL {
+		errRule := rule.validate()
+		if errRule != nil {
+			return fmt.Errorf("acl rule %d: %w", i+1, errRule)
+		}
+	}
+	for i, limit := range f.RateLimits {
+		errLimit := limit.validate()
+		if errLimit != nil {
+			return fmt.Errorf("rate limit %d: %w", i+1, errLimit)
+		}
+	}
+	tenants := make(map[string]struct{}, len(f.Tenants))
+	for _, t := range f.Tenants {
+		errTenant := t.validate()
+		if errTenant != nil {
+			return fmt.Errorf("tenant %q: %w", t.Name, errTenant)
+		}
+		if _, ok := tenants[t.Name]; ok {
+			return fmt.Errorf("tenant %q is declared twice", t.Name)
+		}
+		tenants[t.Name] = struct{}{}
+	}
+
+	names := make(map[string]struct{}, len(f.Topics))
+	for _, t := range f.Topics {
+		if t.Name == "" {
+			return errors.New("topic name is required")
+		}
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("topic %q is declared twice", t.Name)
+		}
+		names[t.Name] = struct{}{}
+	}
+
+	var errs []error
+	for _, t := range f.Topics {
+		if t.MaxMessages < 0 {
+			errs = append(errs, fmt.Errorf("topic %q: max_messages must not be negative", t.Name))
+		}
+		if t.MessageTTL < 0 {
+			errs = append(errs, fmt.Errorf("topic %q: message_ttl must not be negative", t.Name))
+		}
+		if t.MaxMessageSize < 0 {
+			errs = append(errs, fmt.Errorf("topic %q: max_message_size must not be negative", t.Name))
+		}
+		if t.MaxReceives < 0 {
+			errs = append(errs, fmt.Errorf("topic %q: max_receives must not be negative", t.Name))
+		}
+		if (t.DeadLetterTopic == "") != (t.MaxReceives == 0) {
+			errs = append(errs, fmt.Errorf("topic %q: dead_letter_topic and max_receives must be set together", t.Name))
+		}
+		if t.DeadLetterTopic == t.Name {
+			errs = append(errs, fmt.Errorf("topic %q: dead_letter_topic must be another topic", t.Name))
+		}
+		if _, ok := names[t.DeadLetterTopic]; t.DeadLetterTopic != "" && !ok {
+			errs = append(errs, fmt.Errorf("topic %q: dead_letter_topic %q is not declared", t.Name, t.DeadLetterTopic))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Changes describes how the topic settings differ from the old ones, one line per changed setting
+func (t *Topic) Changes(old *Topic) []string {
+	var changes []string
+	add := func(name string, from any, to any) {
+		if from != to {
+			changes = append(changes, fmt.Sprintf("%s %v -> %v", name, from, to))
+		}
+	}
+
+	add("max_messages", old.MaxMessages, t.MaxMessages)
+	add("message_ttl", time.Duration(old.MessageTTL), time.Duration(t.MessageTTL))
+	add("dead_letter_topic", strconv.Quote(old.DeadLetterTopic), strconv.Quote(t.DeadLetterTopic))
+	add("max_receives", old.MaxReceives, t.MaxReceives)
+	add("max_message_size", old.MaxMessageSize, t.MaxMessageSize)
+	add("durable", old.IsDurable(), t.IsDurable())
+
+	return changes
+}
+
+func validateTokens(field string, tokens []Token) error {
+	names := make(map[string]struct{}, len(tokens))
+	for _, t := range tokens {
+		if t.Name == "" {
+			return fmt.Errorf("%s: token name is required", field)
+		}
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("%s: token %q is declared twice", field, t.Name)
+		}
+		names[t.Name] = struct{}{}
+
+		hash, errDecode := hex.DecodeString(t.SHA256)
+		if errDecode != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s: token %q must have a hex encoded SHA-256 hash", field, t.Name)
+		}
+	}
+
+	return nil
+}
+
+func (r *ACLRule) validate() error {
+	if r.Principal == "" {
+		return errors.New("principal is required")
+	}
+	if len(r.Topics) == 0 || slices.Contains(r.Topics, "") {
+		return errors.New("topic patterns must not be empty")
+	}
+	if len(r.Actions) == 0 {
+		return errors.New("actions are required")
+	}
+	for _, action := range r.Actions {
+		if action != ActionSend && action != ActionGet && action != ActionAdmin {
+			return fmt.Errorf("unknown action %q", action)
+		}
+	}
+
+	return nil
+}
+
+func (l *RateLimit) validate() error {
+	if (l.Principal == "") == (l.Topic == "") {
+		return errors.New("either principal or topic is required")
+	}
+	if l.Action != ActionSend && l.Action != ActionGet {
+		return fmt.Errorf("action must be %q or %q", ActionSend, ActionGet)
+	}
+	if !(l.Rate > 0) {
+		return errors.New("rate must be positive")
+	}
+	if l.Burst < 0 {
+		return errors.New("burst must not be negative")
+	}
+
+	return nil
+}
+
+func (t *Tenant) validate() error {
+	if t.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(t.Topics) == 0 || slices.Contains(t.Topics, "") {
+		return errors.New("topic patterns must not be empty")
+	}
+	if t.MaxTopics < 0 || t.MaxBytes < 0 || t.MaxConsumers < 0 {
+		return errors.New("quotas must not be negative")
+	}
+
+	return nil
+}
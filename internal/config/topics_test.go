@@ -0,0 +1,199 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tokenHash = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		file File
+		// err is a part of the expected error message, empty for a valid file
+		err string
+	}{
+		{name: "empty", file: File{}},
+		{
+			name: "valid",
+			file: File{
+				Topics: []Topic{
+					{Name: "orders", MaxMessages: 10, DeadLetterTopic: "orders.dead", MaxReceives: 3},
+					{Name: "orders.dead"},
+				},
+				Tokens:     []Token{{Name: "bob", SHA256: tokenHash}},
+				ACL:        []ACLRule{{Principal: "bob", Topics: []string{"orders*"}, Actions: []string{ActionSend, ActionGet}}},
+				RateLimits: []RateLimit{{Principal: "*", Action: ActionSend, Rate: 10}},
+				Tenants:    []Tenant{{Name: "shop", Topics: []string{"orders*"}, MaxBytes: 100}},
+			},
+		},
+		{name: "topic without name", file: File{Topics: []Topic{{}}}, err: "topic name is required"},
+		{name: "topic declared twice", file: File{Topics: []Topic{{Name: "a"}, {Name: "a"}}}, err: "declared twice"},
+		{name: "negative max messages", file: File{Topics: []Topic{{Name: "a", MaxMessages: -1}}}, err: "max_messages"},
+		{name: "negative message size", file: File{Topics: []Topic{{Name: "a", MaxMessageSize: -1}}}, err: "max_message_size"},
+		{name: "dead letter without receives", file: File{Topics: []Topic{{Name: "a", DeadLetterTopic: "b"}, {Name: "b"}}}, err: "set together"},
+		{name: "dead letter to itself", file: File{Topics: []Topic{{Name: "a", DeadLetterTopic: "a", MaxReceives: 1}}}, err: "another topic"},
+		{name: "undeclared dead letter", file: File{Topics: []Topic{{Name: "a", DeadLetterTopic: "b", MaxReceives: 1}}}, err: "not declared"},
+		{name: "token without name", file: File{Tokens: []Token{{SHA256: tokenHash}}}, err: "token name is required"},
+		{name: "token declared twice", file: File{Tokens: []Token{{Name: "a", SHA256: tokenHash}, {Name: "a", SHA256: tokenHash}}}, err: "declared twice"},
+		{name: "bad token hash", file: File{Tokens: []Token{{Name: "a", SHA256: "abc"}}}, err: "SHA-256"},
+		{name: "bad service token", file: File{ServiceTokens: []Token{{Name: "a"}}}, err: "service_tokens"},
+		{name: "acl without principal", file: File{ACL: []ACLRule{{Topics: []string{"*"}, Actions: []string{ActionGet}}}}, err: "principal is required"},
+		{name: "acl without topics", file: File{ACL: []ACLRule{{Principal: "a", Actions: []string{ActionGet}}}}, err: "topic patterns"},
+		{name: "acl with unknown action", file: File{ACL: []ACLRule{{Principal: "a", Topics: []string{"*"}, Actions: []string{"read"}}}}, err: "unknown action"},
+		{name: "rate limit with both subjects", file: File{RateLimits: []RateLimit{{Principal: "a", Topic: "b", Action: ActionSend, Rate: 1}}}, err: "either principal or topic"},
+		{name: "rate limit of admin", file: File{RateLimits: []RateLimit{{Topic: "b", Action: ActionAdmin, Rate: 1}}}, err: "action must be"},
+		{name: "zero rate", file: File{RateLimits: []RateLimit{{Topic: "b", Action: ActionGet}}}, err: "rate must be positive"},
+		{name: "negative burst", file: File{RateLimits: []RateLimit{{Topic: "b", Action: ActionGet, Rate: 1, Burst: -1}}}, err: "burst"},
+		{name: "tenant without name", file: File{Tenants: []Tenant{{Topics: []string{"*"}}}}, err: "name is required"},
+		{name: "tenant without topics", file: File{Tenants: []Tenant{{Name: "a"}}}, err: "topic patterns"},
+		{name: "negative quota", file: File{Tenants: []Tenant{{Name: "a", Topics: []string{"*"}, MaxBytes: -1}}}, err: "quotas"},
+		{name: "tenant declared twice", file: File{Tenants: []Tenant{{Name: "a", Topics: []string{"*"}}, {Name: "a", Topics: []string{"b"}}}}, err: "declared twice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.file.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error %v, want one containing %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{pattern: "orders", name: "orders", want: true},
+		{pattern: "orders", name: "orders.eu", want: false},
+		{pattern: "*", name: "anything", want: true},
+		{pattern: "*", name: "", want: true},
+		{pattern: "orders.*", name: "orders.eu", want: true},
+		{pattern: "orders.*", name: "orders", want: false},
+		{pattern: "*.dead", name: "orders.dead", want: true},
+		{pattern: "*.dead", name: "orders.dead.eu", want: false},
+		{pattern: "a*b*c", name: "abc", want: true},
+		{pattern: "a*b*c", name: "a-b-b-c", want: true},
+		{pattern: "a*b*c", name: "a-c-b", want: false},
+		{pattern: "ab*ba", name: "aba", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			if got := Match(tt.pattern, tt.name); got != tt.want {
+				t.Errorf("Match(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	durable := false
+	want := File{
+		Topics: []Topic{
+			{Name: "orders", MaxMessages: 10, MessageTTL: Duration(time.Minute + 30*time.Second), DeadLetterTopic: "orders.dead", MaxReceives: 3},
+			{Name: "orders.dead", Durable: &durable},
+		},
+		Tokens:     []Token{{Name: "bob", SHA256: tokenHash}},
+		ACL:        []ACLRule{{Principal: "bob", Topics: []string{"orders*"}, Actions: []string{ActionSend, ActionGet}}},
+		RateLimits: []RateLimit{{Principal: "*", Action: ActionSend, Rate: 2.5, Burst: 5}},
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data string
+		// err is a part of the expected error message, empty for a valid file
+		err string
+	}{
+		{
+			name: "json",
+			file: "config.json",
+			data: `{
+				"topics": [
+					{"name": "orders", "max_messages": 10, "message_ttl": "1m30s", "dead_letter_topic": "orders.dead", "max_receives": 3},
+					{"name": "orders.dead", "durable": false}
+				],
+				"tokens": [{"name": "bob", "sha256": "` + tokenHash + `"}],
+				"acl": [{"principal": "bob", "topics": ["orders*"], "actions": ["send", "get"]}],
+				"rate_limits": [{"principal": "*", "action": "send", "rate": 2.5, "burst": 5}]
+			}`,
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			data: `# topics of the shop
+[[topics]]
+name = "orders"
+max_messages = 10
+message_ttl = "1m30s"
+dead_letter_topic = "orders.dead"
+max_receives = 3
+
+[[topics]]
+name = "orders.dead"
+durable = false
+
+[[tokens]]
+name = "bob"
+sha256 = "` + tokenHash + `"
+
+[[acl]]
+principal = "bob"
+topics = ["orders*"]
+actions = [
+	"send",
+	"get", # a trailing comma is allowed
+]
+
+[[rate_limits]]
+principal = "*"
+action = "send"
+rate = 2.5
+burst = 5
+`,
+		},
+		{name: "unknown json field", file: "config.json", data: `{"topic": []}`, err: "unknown field"},
+		{name: "unknown toml field", file: "config.toml", data: "[[topics]]\nname = \"a\"\nmax_size = 1\n", err: "unknown field"},
+		{name: "invalid toml", file: "config.toml", data: "[[topics]]\nname = \"a\n", err: "line 2: unterminated string"},
+		{name: "invalid settings", file: "config.toml", data: "[[topics]]\nmax_messages = 1\n", err: "topic name is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			errWrite := os.WriteFile(path, []byte(tt.data), 0o600)
+			if errWrite != nil {
+				t.Fatal(errWrite)
+			}
+
+			f, err := LoadFile(path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*f, want) {
+				t.Errorf("loaded %+v, want %+v", *f, want)
+			}
+		})
+	}
+}
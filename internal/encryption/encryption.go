@@ -0,0 +1,190 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// macLabel derives MAC keys from the AES keys, so a key is never used for two purposes
+const macLabel = "ssqueue-mac"
+
+// header starts encrypted data, it is followed by the key ID and a newline.
+// The header line is authenticated together with the ciphertext.
+const header = "ssqueue-aes-gcm:"
+
+var (
+	errNoKeys     = errors.New("data is encrypted, but no keys are configured")
+	errUnknownKey = errors.New("data is encrypted with an unknown key")
+	errMalformed  = errors.New("malformed encrypted data")
+	errPlaintext  = errors.New("data is not encrypted, but keys are configured")
+)
+
+// Keys are AES keys by their IDs, the first key encrypts and all of them decrypt, so older files are still read
+// after rotation. Nil Keys do not encrypt.
+type Keys struct {
+	current string
+	aeads   map[string]cipher.AEAD
+	macs    map[string][]byte
+	// plaintext lets data without the header through, for migrating files written before encryption was enabled
+	plaintext bool
+}
+
+// Load reads keys from the file and the env value, both have one id:base64key entry per line or comma.
+// Keys of the env value come first. Keys must be 16, 24 or 32 bytes long for AES-128, AES-192 or AES-256.
+// Nil is returned without any keys.
+func Load(file string, value string) (*Keys, error) {
+	entries := strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == '\n' })
+	if file != "" {
+		data, errRead := os.ReadFile(file)
+		if errRead != nil {
+			return nil, errRead
+		}
+		entries = append(entries, strings.FieldsFunc(string(data), func(r rune) bool { return r == ',' || r == '\n' })...)
+	}
+
+	var k *Keys
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" || strings.ContainsAny(id, " \n") {
+			return nil, errors.New("key entries must be id:base64key")
+		}
+		key, errDecode := base64.StdEncoding.DecodeString(encoded)
+		if errDecode != nil {
+			return nil, fmt.Errorf("key %q is not base64: %w", id, errDecode)
+		}
+		block, errCipher := aes.NewCipher(key)
+		if errCipher != nil {
+			return nil, fmt.Errorf("key %q: %w", id, errCipher)
+		}
+		aead, errGCM := cipher.NewGCM(block)
+		if errGCM != nil {
+			return nil, fmt.Errorf("key %q: %w", id, errGCM)
+		}
+
+		if k == nil {
+			k = &Keys{current: id, aeads: make(map[string]cipher.AEAD), macs: make(map[string][]byte)}
+		}
+		if _, exists := k.aeads[id]; exists {
+			return nil, fmt.Errorf("key %q is declared twice", id)
+		}
+		k.aeads[id] = aead
+		k.macs[id] = mac(key, []byte(macLabel))
+	}
+
+	return k, nil
+}
+
+// AllowPlaintext makes Decrypt return data without the header as is instead of rejecting it.
+// It is meant for one start migrating unencrypted files, anyone able to write the files can replace them meanwhile.
+func (k *Keys) AllowPlaintext() {
+	if k == nil {
+		return
+	}
+
+	k.plaintext = true
+}
+
+// Current returns the ID of the key used for encryption
+func (k *Keys) Current() string {
+	if k == nil {
+		return ""
+	}
+
+	return k.current
+}
+
+// Sum returns the HMAC-SHA256 of the data keyed by the current key, together with the ID of the key.
+// Nil Keys return nothing.
+func (k *Keys) Sum(data []byte) (string, []byte) {
+	if k == nil {
+		return "", nil
+	}
+
+	return k.current, mac(k.macs[k.current], data)
+}
+
+// SumWith returns the HMAC-SHA256 of the data keyed by the key with the ID, false if there is no such key
+func (k *Keys) SumWith(id string, data []byte) ([]byte, bool) {
+	if k == nil {
+		return nil, false
+	}
+	key, ok := k.macs[id]
+	if !ok {
+		return nil, false
+	}
+
+	return mac(key, data), true
+}
+
+func mac(key []byte, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+
+	return h.Sum(nil)
+}
+
+// Encrypt seals the data with the current key, the result starts with the header naming the key
+func (k *Keys) Encrypt(plain []byte) ([]byte, error) {
+	if k == nil {
+		return plain, nil
+	}
+
+	aead := k.aeads[k.current]
+	line := []byte(header + k.current + "\n")
+
+	nonce := make([]byte, aead.NonceSize())
+	_, errRand := rand.Read(nonce)
+	if errRand != nil {
+		return nil, errRand
+	}
+
+	out := make([]byte, 0, len(line)+len(nonce)+len(plain)+aead.Overhead())
+	out = append(out, line...)
+	out = append(out, nonce...)
+
+	return aead.Seal(out, nonce, plain, line), nil
+}
+
+// Decrypt opens the data with the key named in its header. Data without the header is plaintext, it is returned as is
+// by nil Keys or after AllowPlaintext and rejected otherwise.
+func (k *Keys) Decrypt(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(header)) {
+		if k != nil && !k.plaintext {
+			return nil, errPlaintext
+		}
+		return data, nil
+	}
+	if k == nil {
+		return nil, errNoKeys
+	}
+
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, errMalformed
+	}
+	line, rest := data[:i+1], data[i+1:]
+
+	aead, ok := k.aeads[string(line[len(header):i])]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownKey, line[len(header):i])
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errMalformed
+	}
+
+	return aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], line)
+}
@@ -0,0 +1,200 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func key(b byte, size int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, size))
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		current string
+		wantErr bool
+	}{
+		{name: "no keys", value: "", current: ""},
+		{name: "aes-128", value: "a:" + key(1, 16), current: "a"},
+		{name: "aes-256 first encrypts", value: "b:" + key(1, 32) + ",a:" + key(2, 24), current: "b"},
+		{name: "comments and lines", value: "# old keys\nb:" + key(1, 32) + "\n\na:" + key(2, 16), current: "b"},
+		{name: "without id", value: key(1, 32), wantErr: true},
+		{name: "not base64", value: "a:???", wantErr: true},
+		{name: "bad key size", value: "a:" + key(1, 10), wantErr: true},
+		{name: "declared twice", value: "a:" + key(1, 16) + ",a:" + key(2, 16), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Load("", tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if k.Current() != tt.current {
+				t.Errorf("current key %q, want %q", k.Current(), tt.current)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	errWrite := os.WriteFile(file, []byte("b:"+key(2, 32)+"\n"), 0o600)
+	if errWrite != nil {
+		t.Fatal(errWrite)
+	}
+
+	k, errLoad := Load(file, "a:"+key(1, 32))
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+	if k.Current() != "a" {
+		t.Errorf("current key %q, env keys come first", k.Current())
+	}
+	if _, ok := k.SumWith("b", nil); !ok {
+		t.Error("key of the file is not loaded")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	old, errOld := Load("", "old:"+key(1, 32))
+	if errOld != nil {
+		t.Fatal(errOld)
+	}
+	rotated, errRotated := Load("", "new:"+key(2, 32)+",old:"+key(1, 32))
+	if errRotated != nil {
+		t.Fatal(errRotated)
+	}
+	migrating, errMigrating := Load("", "old:"+key(1, 32))
+	if errMigrating != nil {
+		t.Fatal(errMigrating)
+	}
+	migrating.AllowPlaintext()
+
+	tests := []struct {
+		name    string
+		encrypt *Keys
+		decrypt *Keys
+		plain   []byte
+	}{
+		{name: "same keys", encrypt: old, decrypt: old, plain: []byte("hello")},
+		{name: "empty data", encrypt: old, decrypt: old, plain: []byte{}},
+		{name: "binary data", encrypt: old, decrypt: old, plain: []byte{0, 1, 2, '\n', 255}},
+		{name: "after rotation", encrypt: old, decrypt: rotated, plain: []byte("hello")},
+		{name: "rotated key", encrypt: rotated, decrypt: rotated, plain: []byte("hello")},
+		{name: "plaintext without keys", encrypt: nil, decrypt: nil, plain: []byte("hello")},
+		{name: "plaintext migration", encrypt: nil, decrypt: migrating, plain: []byte("hello")},
+		{name: "encrypted during migration", encrypt: old, decrypt: migrating, plain: []byte("hello")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, errEncrypt := tt.encrypt.Encrypt(tt.plain)
+			if errEncrypt != nil {
+				t.Fatal(errEncrypt)
+			}
+			if tt.encrypt != nil && bytes.Contains(data, []byte("hello")) {
+				t.Error("encrypted data contains the plaintext")
+			}
+
+			got, errDecrypt := tt.decrypt.Decrypt(data)
+			if errDecrypt != nil {
+				t.Fatal(errDecrypt)
+			}
+			if !bytes.Equal(got, tt.plain) {
+				t.Errorf("decrypted %q, want %q", got, tt.plain)
+			}
+		})
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	k, errLoad := Load("", "a:"+key(1, 32))
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+	other, errOther := Load("", "b:"+key(2, 32))
+	if errOther != nil {
+		t.Fatal(errOther)
+	}
+	sameID, errSameID := Load("", "a:"+key(2, 32))
+	if errSameID != nil {
+		t.Fatal(errSameID)
+	}
+
+	data, errEncrypt := k.Encrypt([]byte("secret message"))
+	if errEncrypt != nil {
+		t.Fatal(errEncrypt)
+	}
+	headerLen := bytes.IndexByte(data, '\n') + 1
+
+	tests := []struct {
+		name    string
+		keys    *Keys
+		data    func() []byte
+		wantErr error
+	}{
+		{name: "changed ciphertext", keys: k, data: func() []byte { return flip(data, len(data)-20) }},
+		{name: "changed tag", keys: k, data: func() []byte { return flip(data, len(data)-1) }},
+		{name: "changed nonce", keys: k, data: func() []byte { return flip(data, headerLen) }},
+		{name: "renamed key", keys: k, data: func() []byte { return bytes.Replace(data, []byte(":a\n"), []byte(":b\n"), 1) }, wantErr: errUnknownKey},
+		{name: "truncated", keys: k, data: func() []byte { return data[:headerLen+4] }, wantErr: errMalformed},
+		{name: "no newline", keys: k, data: func() []byte { return []byte(header + "a") }, wantErr: errMalformed},
+		{name: "unknown key", keys: other, data: func() []byte { return data }, wantErr: errUnknownKey},
+		{name: "wrong key with the same id", keys: sameID, data: func() []byte { return data }},
+		{name: "no keys", keys: nil, data: func() []byte { return data }, wantErr: errNoKeys},
+		{name: "plaintext", keys: k, data: func() []byte { return []byte("secret message") }, wantErr: errPlaintext},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, err := tt.keys.Decrypt(tt.data())
+			if err == nil {
+				t.Fatalf("decrypted %q", plain)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSum(t *testing.T) {
+	k, errLoad := Load("", "b:"+key(2, 32)+",a:"+key(1, 32))
+	if errLoad != nil {
+		t.Fatal(errLoad)
+	}
+
+	id, sum := k.Sum([]byte("data"))
+	if id != "b" || len(sum) != 32 {
+		t.Fatalf("sum by %q of %d bytes", id, len(sum))
+	}
+	again, ok := k.SumWith("b", []byte("data"))
+	if !ok || !bytes.Equal(again, sum) {
+		t.Error("sum with the same key differs")
+	}
+	byOld, ok := k.SumWith("a", []byte("data"))
+	if !ok || bytes.Equal(byOld, sum) {
+		t.Error("sums of different keys are equal")
+	}
+	if _, ok = k.SumWith("c", []byte("data")); ok {
+		t.Error("sum with an unknown key")
+	}
+	if id, sum = (*Keys)(nil).Sum([]byte("data")); id != "" || sum != nil {
+		t.Error("nil keys sum")
+	}
+}
+
+// flip returns a copy of the data with the byte at i changed
+func flip(data []byte, i int) []byte {
+	changed := bytes.Clone(data)
+	changed[i] ^= 0xff
+
+	return changed
+}
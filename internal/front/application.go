@@ -2,11 +2,71 @@ package front
 
 import (
 	"context"
+	"time"
 
 	"github.com/ssqueue/ssqueue/internal/messages"
 )
 
 type Application interface {
-	Get(ctx context.Context, topic string) (om *messages.OutputMessage, err error)
+	Get(ctx context.Context, topic string, filter messages.Filter) (om *messages.OutputMessage, err error)
 	Send(ctx context.Context, topic string, im *messages.InputMessage) (id string, err error)
 }
+
+// RequestApplication sends a message and waits for the reply to it
+type RequestApplication interface {
+	Request(ctx context.Context, topic string, im *messages.InputMessage) (reply *messages.OutputMessage, err error)
+}
+
+// LeaseApplication delivers messages which must be acknowledged by the consumer
+type LeaseApplication interface {
+	Application
+	Reserve(ctx context.Context, topic string, visibility time.Duration) (om *messages.OutputMessage, receipt string, err error)
+	ReserveAny(ctx context.Context, topics []string, visibility time.Duration) (topic string, om *messages.OutputMessage, receipt string, err error)
+	Ack(ctx context.Context, topic string, receipt string) error
+	Release(ctx context.Context, topic string, receipt string, delay time.Duration) error
+	Touch(ctx context.Context, topic string, receipt string, visibility time.Duration) error
+}
+
+// BuryApplication keeps failed messages aside until they are kicked back to the queue
+type BuryApplication interface {
+	Bury(ctx context.Context, topic string, receipt string) error
+	Kick(ctx context.Context, topic string, bound int) (kicked int, err error)
+}
+
+// PeekApplication shows messages without taking them
+type PeekApplication interface {
+	Peek(ctx context.Context, topic string, offset int, limit int) ([]messages.MessageInfo, error)
+}
+
+// DeleteApplication removes pending messages by their IDs
+type DeleteApplication interface {
+	Delete(ctx context.Context, topic string, id string) error
+}
+
+// LimitApplication tells the size limits of messages, zero is unlimited
+type LimitApplication interface {
+	MaxMessageSize(topic string) int
+	// LargestMessageSize is the limit of all topics, it bounds requests before their topic is known
+	LargestMessageSize() int
+}
+
+// envelopeSize is allowed in requests over the message size for the topic, headers and encoding of the data
+const envelopeSize = 64 * 1024
+
+// MaxRequestSize returns the size limit of requests carrying one message to any topic, zero is unlimited
+func MaxRequestSize(app LimitApplication) int64 {
+	largest := app.LargestMessageSize()
+	if largest == 0 {
+		return 0
+	}
+
+	return int64(largest) + envelopeSize
+}
+
+type TopicApplication interface {
+	Topics(ctx context.Context) []string
+	Describe(ctx context.Context, topic string) (*messages.TopicInfo, error)
+	CreateTopic(ctx context.Context, topic string) (created bool, err error)
+	PurgeTopic(ctx context.Context, topic string) (purged int, err error)
+	DeleteTopic(ctx context.Context, topic string) error
+}
@@ -0,0 +1,35 @@
+package front
+
+import (
+	"testing"
+)
+
+type limits int
+
+func (l limits) MaxMessageSize(string) int {
+	return int(l)
+}
+
+func (l limits) LargestMessageSize() int {
+	return int(l)
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		largest int
+		want    int64
+	}{
+		{name: "unlimited", largest: 0, want: 0},
+		{name: "small", largest: 1, want: 1 + envelopeSize},
+		{name: "large", largest: 1 << 20, want: 1<<20 + envelopeSize},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MaxRequestSize(limits(tt.largest)); got != tt.want {
+				t.Errorf("max request size %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package beanstalk
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/front"
+)
+
+const (
+	acceptRetryDelay = time.Millisecond * 100
+)
+
+type backend interface {
+	front.LeaseApplication
+	front.BuryApplication
+	front.TopicApplication
+	front.LimitApplication
+}
+
+// Beanstalk speaks the beanstalkd protocol, tubes are topics and reserved jobs are leased messages.
+// Job priorities are accepted but ignored, jobs are delivered in FIFO order.
+// The protocol has no credentials, with tokens configured only clients with a certificate of mutual TLS are served.
+// It has no error for denied access either, tubes denied by the ACL are reported as NOT_FOUND.
+type Beanstalk struct {
+	app    backend
+	tokens *auth.Tokens
+	acl    *auth.ACL
+}
+
+func New(app backend, tokens *auth.Tokens, acl *auth.ACL) *Beanstalk {
+	return &Beanstalk{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+	}
+}
+
+func (b *Beanstalk) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
+	defer wg.Done()
+
+	var connWg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		slog.Info("shutting down beanstalk server")
+		errClose := ln.Close()
+		if errClose != nil && !errors.Is(errClose, net.ErrClosed) {
+			slog.Error("error shutdown beanstalk server", slog.String("error", errClose.Error()))
+		}
+	}()
+
+	slog.Info("start beanstalk server", slog.String("addr", ln.Addr().String()))
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Error("error accept beanstalk connection", slog.String("error", err.Error()))
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		connWg.Add(1)
+		go func() {
+			defer connWg.Done()
+			newConn(b.app, b.tokens, b.acl, nc).serve(ctx)
+		}()
+	}
+
+	connWg.Wait()
+}
@@ -0,0 +1,530 @@
+package beanstalk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+const (
+	defaultTube = "default"
+	// the ttr of put is not stored with the message, reserved jobs are leased for the default ttr
+	defaultTTR = time.Minute * 2
+	// maxJobSize bounds jobs of tubes without a max message size
+	maxJobSize    = 8 * 1024 * 1024
+	maxLineSize   = 1024
+	writeDeadline = time.Second * 10
+)
+
+var (
+	errLineTooLong = errors.New("line too long")
+	errBadFormat   = errors.New("bad format")
+)
+
+type job struct {
+	topic   string
+	receipt string
+}
+
+type conn struct {
+	app       backend
+	tokens    *auth.Tokens
+	acl       *auth.ACL
+	nc        net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	used      string
+	principal string
+	watched   []string
+	reserved  map[uint64]*job
+}
+
+func newConn(app backend, tokens *auth.Tokens, acl *auth.ACL, nc net.Conn) *conn {
+	return &conn{
+		app:      app,
+		tokens:   tokens,
+		acl:      acl,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		w:        bufio.NewWriter(nc),
+		used:     defaultTube,
+		watched:  []string{defaultTube},
+		reserved: make(map[uint64]*job),
+	}
+}
+
+// allow checks the action on the tube against the ACL for the principal of the connection
+func (c *conn) allow(action string, topic string) bool {
+	if c.acl.Allowed(c.principal, action, topic) {
+		return true
+	}
+
+	slog.Warn("beanstalk command denied", slog.String("principal", c.principal), slog.String("action", action), slog.String("topic", topic))
+
+	return false
+}
+
+// jobID maps the message ID to the numeric ID beanstalkd clients expect
+func jobID(messageID string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(messageID))
+	return h.Sum64()>>1 | 1
+}
+
+// recoverPanic logs a panic of a connection goroutine and closes the connection instead of crashing the server
+func (c *conn) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	slog.Error("panic in beanstalk connection", slog.String("remote", c.nc.RemoteAddr().String()), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+	_ = c.nc.Close()
+}
+
+func (c *conn) serve(ctx context.Context) {
+	defer c.recoverPanic()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		_ = c.nc.Close()
+		c.releaseAll()
+	}()
+
+	// ctx is replaced by the one with the principal later, the channel is taken before
+	done := ctx.Done()
+	go func() {
+		<-done
+		_ = c.nc.Close()
+	}()
+
+	principal, ok := c.tokens.AuthenticateConn(c.nc, "")
+	if !ok {
+		slog.Warn("beanstalk connection not authenticated", slog.String("remote", c.nc.RemoteAddr().String()))
+		return
+	}
+	c.principal = principal
+	ctx = auth.WithPrincipal(ctx, principal)
+
+	for {
+		line, errRead := c.readLine()
+		if errRead != nil {
+			if errors.Is(errRead, errLineTooLong) {
+				_ = c.reply("BAD_FORMAT")
+			} else if !errors.Is(errRead, io.EOF) && !errors.Is(errRead, net.ErrClosed) {
+				slog.Debug("error read beanstalk command", slog.String("error", errRead.Error()))
+			}
+			return
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			if c.reply("BAD_FORMAT") != nil {
+				return
+			}
+			continue
+		}
+		if args[0] == "quit" {
+			return
+		}
+
+		errHandle := c.handle(ctx, args[0], args[1:])
+		if errHandle != nil {
+			if !errors.Is(errHandle, net.ErrClosed) && !errors.Is(errHandle, io.EOF) {
+				slog.Debug("error handle beanstalk command", slog.String("command", args[0]), slog.String("error", errHandle.Error()))
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := c.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLineSize {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func (c *conn) handle(ctx context.Context, command string, args []string) error {
+	switch command {
+	case "put":
+		return c.handlePut(ctx, args)
+	case "use":
+		return c.handleUse(args)
+	case "watch":
+		return c.handleWatch(args)
+	case "ignore":
+		return c.handleIgnore(args)
+	case "reserve":
+		if len(args) != 0 {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.handleReserve(ctx, -1)
+	case "reserve-with-timeout":
+		if len(args) != 1 {
+			return c.reply("BAD_FORMAT")
+		}
+		seconds, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return c.reply("BAD_FORMAT")
+		}
+		return c.handleReserve(ctx, time.Duration(seconds)*time.Second)
+	case "delete":
+		return c.handleJob(args, 1, "DELETED", func(j *job) error {
+			return c.app.Ack(ctx, j.topic, j.receipt)
+		})
+	case "release":
+		return c.handleJob(args, 3, "RELEASED", func(j *job) error {
+			delay, err := strconv.ParseUint(args[2], 10, 32)
+			if err != nil {
+				return errBadFormat
+			}
+			return c.app.Release(ctx, j.topic, j.receipt, time.Duration(delay)*time.Second)
+		})
+	case "bury":
+		return c.handleJob(args, 2, "BURIED", func(j *job) error {
+			return c.app.Bury(ctx, j.topic, j.receipt)
+		})
+	case "touch":
+		return c.handleJob(args, 1, "TOUCHED", func(j *job) error {
+			return c.app.Touch(ctx, j.topic, j.receipt, defaultTTR)
+		})
+	case "kick":
+		return c.handleKick(ctx, args)
+	case "list-tubes":
+		return c.replyList(slices.DeleteFunc(c.app.Topics(ctx), func(topic string) bool {
+			return !c.acl.Visible(c.principal, topic)
+		}))
+	case "list-tube-used":
+		return c.reply("USING " + c.used)
+	case "list-tubes-watched":
+		return c.replyList(c.watched)
+	case "stats-tube":
+		return c.handleStatsTube(ctx, args)
+	default:
+		return c.reply("UNKNOWN_COMMAND")
+	}
+}
+
+func (c *conn) handlePut(ctx context.Context, args []string) error {
+	if len(args) != 4 {
+		return c.reply("BAD_FORMAT")
+	}
+
+	var nums [4]uint64
+	for i, arg := range args {
+		n, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return c.reply("BAD_FORMAT")
+		}
+		nums[i] = n
+	}
+	delay, size := nums[1], nums[3]
+
+	// the body of a job over the limit of the tube is skipped without buffering it
+	limit := uint64(maxJobSize)
+	if topicLimit := c.app.MaxMessageSize(c.used); topicLimit > 0 {
+		limit = uint64(topicLimit)
+	}
+	if size > limit {
+		if _, err := io.CopyN(io.Discard, c.r, int64(size)+2); err != nil {
+			return err
+		}
+		return c.reply("JOB_TOO_BIG")
+	}
+
+	body := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return err
+	}
+	if body[size] != '\r' || body[size+1] != '\n' {
+		return c.reply("EXPECTED_CRLF")
+	}
+
+	if !c.allow(config.ActionSend, c.used) {
+		return c.reply("NOT_FOUND")
+	}
+
+	im := &messages.InputMessage{
+		Data:       string(body[:size]),
+		Persistent: true,
+		Delay:      time.Duration(delay) * time.Second,
+	}
+
+	id, errSend := c.app.Send(ctx, c.used, im)
+	if errSend != nil {
+		if errors.Is(errSend, application.ErrNotReady) {
+			return c.reply("DRAINING")
+		}
+		// tubes must be created beforehand when topics are strict
+		if errors.Is(errSend, application.ErrTopicNotFound) {
+			return c.reply("NOT_FOUND")
+		}
+		if errors.Is(errSend, application.ErrTopicFull) || errors.Is(errSend, application.ErrQuotaExceeded) {
+			return c.reply("OUT_OF_MEMORY")
+		}
+		if errors.Is(errSend, application.ErrMessageTooLarge) {
+			return c.reply("JOB_TOO_BIG")
+		}
+		// beanstalk has no reply for the rate limit or a tube without consumers, a draining server also refuses the job for now
+		if errors.Is(errSend, application.ErrThrottled) || errors.Is(errSend, application.ErrNoConsumers) {
+			return c.reply("DRAINING")
+		}
+		slog.Error("error send message", slog.String("topic", c.used), slog.String("error", errSend.Error()))
+		return c.reply("INTERNAL_ERROR")
+	}
+
+	return c.reply("INSERTED " + strconv.FormatUint(jobID(id), 10))
+}
+
+func (c *conn) handleUse(args []string) error {
+	if len(args) != 1 || !application.ValidTopic(args[0]) {
+		return c.reply("BAD_FORMAT")
+	}
+
+	c.used = args[0]
+
+	return c.reply("USING " + c.used)
+}
+
+func (c *conn) handleWatch(args []string) error {
+	if len(args) != 1 || !application.ValidTopic(args[0]) {
+		return c.reply("BAD_FORMAT")
+	}
+	if !c.allow(config.ActionGet, args[0]) {
+		return c.reply("NOT_FOUND")
+	}
+
+	if !slices.Contains(c.watched, args[0]) {
+		c.watched = append(c.watched, args[0])
+	}
+
+	return c.reply("WATCHING " + strconv.Itoa(len(c.watched)))
+}
+
+func (c *conn) handleIgnore(args []string) error {
+	if len(args) != 1 || !application.ValidTopic(args[0]) {
+		return c.reply("BAD_FORMAT")
+	}
+
+	idx := slices.Index(c.watched, args[0])
+	if idx >= 0 {
+		if len(c.watched) == 1 {
+			return c.reply("NOT_IGNORED")
+		}
+		c.watched = slices.Delete(c.watched, idx, idx+1)
+	}
+
+	return c.reply("WATCHING " + strconv.Itoa(len(c.watched)))
+}
+
+// handleReserve waits for a job on any watched tube, a negative timeout waits forever
+func (c *conn) handleReserve(ctx context.Context, timeout time.Duration) error {
+	if timeout >= 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// rules may have changed since the watch, and the default tube is watched without one
+	var watched []string
+	for _, tube := range c.watched {
+		if c.allow(config.ActionGet, tube) {
+			watched = append(watched, tube)
+		}
+	}
+	if len(watched) == 0 {
+		return c.reply("NOT_FOUND")
+	}
+
+	topic, om, receipt, err := c.app.ReserveAny(ctx, watched, defaultTTR)
+	// a deleted tube is created again on the next use, the reserve starts over with it,
+	// over the rate limit the reserve waits until it is allowed or times out
+	for {
+		if errors.Is(err, application.ErrTopicDeleted) {
+			topic, om, receipt, err = c.app.ReserveAny(ctx, watched, defaultTTR)
+			continue
+		}
+		wait, ok := application.Throttled(err)
+		if !ok {
+			break
+		}
+		select {
+		case <-time.After(wait):
+			topic, om, receipt, err = c.app.ReserveAny(ctx, watched, defaultTTR)
+		case <-ctx.Done():
+			err = nil
+		}
+	}
+	if err != nil {
+		if errors.Is(err, application.ErrNotReady) {
+			return c.reply("DRAINING")
+		}
+		if errors.Is(err, application.ErrTopicNotFound) {
+			return c.reply("NOT_FOUND")
+		}
+		// the consumer quota of the tenant is a resource limit of the server like memory
+		if errors.Is(err, application.ErrQuotaExceeded) {
+			return c.reply("OUT_OF_MEMORY")
+		}
+		slog.Error("error reserve message", slog.String("error", err.Error()))
+		return c.reply("INTERNAL_ERROR")
+	}
+	if om == nil {
+		return c.reply("TIMED_OUT")
+	}
+
+	id := jobID(om.ID)
+	c.reserved[id] = &job{topic: topic, receipt: receipt}
+
+	return c.replyData("RESERVED "+strconv.FormatUint(id, 10), []byte(om.Data))
+}
+
+// handleJob runs the action on the job reserved by this connection, the job ID is the first argument
+func (c *conn) handleJob(args []string, argsCount int, response string, action func(j *job) error) error {
+	if len(args) != argsCount {
+		return c.reply("BAD_FORMAT")
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return c.reply("BAD_FORMAT")
+	}
+
+	j, ok := c.reserved[id]
+	if !ok {
+		return c.reply("NOT_FOUND")
+	}
+
+	errAction := action(j)
+	if errAction != nil {
+		switch {
+		case errors.Is(errAction, errBadFormat):
+			return c.reply("BAD_FORMAT")
+		case errors.Is(errAction, application.ErrNoReceipt), errors.Is(errAction, application.ErrTopicNotFound):
+			// the ttr passed and the job went back to the tube, or the tube was deleted with it
+			delete(c.reserved, id)
+			return c.reply("NOT_FOUND")
+		}
+		slog.Error("error process job", slog.String("topic", j.topic), slog.String("error", errAction.Error()))
+		return c.reply("INTERNAL_ERROR")
+	}
+
+	if response != "TOUCHED" {
+		delete(c.reserved, id)
+	}
+
+	return c.reply(response)
+}
+
+func (c *conn) handleKick(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return c.reply("BAD_FORMAT")
+	}
+	bound, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		return c.reply("BAD_FORMAT")
+	}
+	if !c.allow(config.ActionAdmin, c.used) {
+		return c.reply("NOT_FOUND")
+	}
+
+	kicked, errKick := c.app.Kick(ctx, c.used, int(bound))
+	if errKick != nil {
+		slog.Error("error kick jobs", slog.String("topic", c.used), slog.String("error", errKick.Error()))
+		return c.reply("INTERNAL_ERROR")
+	}
+
+	return c.reply("KICKED " + strconv.Itoa(kicked))
+}
+
+func (c *conn) handleStatsTube(ctx context.Context, args []string) error {
+	if len(args) != 1 || !application.ValidTopic(args[0]) {
+		return c.reply("BAD_FORMAT")
+	}
+	if !c.allow(config.ActionGet, args[0]) {
+		return c.reply("NOT_FOUND")
+	}
+	info, err := c.app.Describe(ctx, args[0])
+	if errors.Is(err, application.ErrTopicNotFound) {
+		return c.reply("NOT_FOUND")
+	}
+	if err != nil {
+		slog.Error("error describe topic", slog.String("topic", args[0]), slog.String("error", err.Error()))
+		return c.reply("INTERNAL_ERROR")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	sb.WriteString("name: " + info.Name + "\n")
+	sb.WriteString("current-jobs-urgent: 0\n")
+	sb.WriteString("current-jobs-ready: " + strconv.Itoa(info.Messages) + "\n")
+	sb.WriteString("current-jobs-reserved: " + strconv.Itoa(info.InFlight) + "\n")
+	sb.WriteString("current-jobs-delayed: " + strconv.Itoa(info.Delayed) + "\n")
+	sb.WriteString("current-jobs-buried: " + strconv.Itoa(info.Buried) + "\n")
+	sb.WriteString("current-waiting: " + strconv.Itoa(info.Consumers) + "\n")
+
+	return c.replyData("OK", []byte(sb.String()))
+}
+
+// releaseAll returns jobs reserved by the closed connection to their tubes
+func (c *conn) releaseAll() {
+	for id, j := range c.reserved {
+		errRelease := c.app.Release(context.Background(), j.topic, j.receipt, 0)
+		if errRelease != nil && !errors.Is(errRelease, application.ErrNoReceipt) {
+			slog.Error("error release job", slog.String("topic", j.topic), slog.String("error", errRelease.Error()))
+		}
+		delete(c.reserved, id)
+	}
+}
+
+func (c *conn) reply(line string) error {
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeDeadline))
+	c.w.WriteString(line)
+	c.w.WriteString("\r\n")
+	return c.w.Flush()
+}
+
+func (c *conn) replyList(items []string) error {
+	var sb strings.Builder
+	sb.WriteString("---\n")
+	for _, item := range items {
+		sb.WriteString("- " + item + "\n")
+	}
+	return c.replyData("OK", []byte(sb.String()))
+}
+
+func (c *conn) replyData(line string, data []byte) error {
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeDeadline))
+	c.w.WriteString(line)
+	c.w.WriteString(" ")
+	c.w.WriteString(strconv.Itoa(len(data)))
+	c.w.WriteString("\r\n")
+	c.w.Write(data)
+	c.w.WriteString("\r\n")
+	return c.w.Flush()
+}
@@ -0,0 +1,178 @@
+package beanstalk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application/apptest"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+// readReply reads the reply line and the data block of replies with data
+func readReply(r *bufio.Reader) (string, error) {
+	line, errRead := r.ReadString('\n')
+	if errRead != nil {
+		return "", errRead
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || (fields[0] != "OK" && fields[0] != "RESERVED") {
+		return line, nil
+	}
+	size, errSize := strconv.Atoi(fields[len(fields)-1])
+	if errSize != nil {
+		return "", errSize
+	}
+	data := make([]byte, size+2)
+	_, errRead = io.ReadFull(r, data)
+
+	return line + string(data), errRead
+}
+
+func TestSession(t *testing.T) {
+	type step struct {
+		// send is the command, $id is replaced by the ID of the last reserved job
+		send string
+		// want is a regular expression matching the whole reply
+		want string
+	}
+
+	tests := []struct {
+		name    string
+		rules   []config.ACLRule
+		limits  []config.RateLimit
+		tenants []config.Tenant
+		steps   []step
+	}{
+		{
+			name: "put and reserve",
+			steps: []step{
+				{send: "use orders\r\n", want: "USING orders\r\n"},
+				{send: "put 0 0 60 5\r\nhello\r\n", want: `INSERTED \d+\r\n`},
+				{send: "watch orders\r\n", want: "WATCHING 2\r\n"},
+				{send: "reserve-with-timeout 0\r\n", want: `RESERVED \d+ 5\r\nhello\r\n`},
+				{send: "touch $id\r\n", want: "TOUCHED\r\n"},
+				{send: "delete $id\r\n", want: "DELETED\r\n"},
+				{send: "delete $id\r\n", want: "NOT_FOUND\r\n"},
+				{send: "reserve-with-timeout 0\r\n", want: "TIMED_OUT\r\n"},
+			},
+		},
+		{
+			name: "release and bury",
+			steps: []step{
+				{send: "put 0 0 60 3\r\nabc\r\n", want: `INSERTED \d+\r\n`},
+				{send: "reserve\r\n", want: `RESERVED \d+ 3\r\nabc\r\n`},
+				{send: "release $id 0 0\r\n", want: "RELEASED\r\n"},
+				{send: "reserve\r\n", want: `RESERVED \d+ 3\r\nabc\r\n`},
+				{send: "bury $id 0\r\n", want: "BURIED\r\n"},
+				{send: "stats-tube default\r\n", want: `OK \d+\r\n(?s:.*)current-jobs-ready: 0\n(?s:.*)current-jobs-buried: 1\n(?s:.*)`},
+				{send: "kick 10\r\n", want: "KICKED 1\r\n"},
+				{send: "reserve-with-timeout 0\r\n", want: `RESERVED \d+ 3\r\nabc\r\n`},
+				{send: "release $id 0 30\r\n", want: "RELEASED\r\n"},
+				{send: "stats-tube default\r\n", want: `OK \d+\r\n(?s:.*)current-jobs-reserved: 0\ncurrent-jobs-delayed: 1\n(?s:.*)`},
+			},
+		},
+		{
+			name: "parse errors",
+			steps: []step{
+				{send: "\r\n", want: "BAD_FORMAT\r\n"},
+				{send: "frobnicate\r\n", want: "UNKNOWN_COMMAND\r\n"},
+				{send: "use -bad\r\n", want: "BAD_FORMAT\r\n"},
+				{send: "put 0 0 60\r\n", want: "BAD_FORMAT\r\n"},
+				{send: "put 0 0 60 x\r\n", want: "BAD_FORMAT\r\n"},
+				// size and CRLF bytes are read, whatever they are
+				{send: "put 0 0 60 1\r\nabc", want: "EXPECTED_CRLF\r\n"},
+				{send: "reserve-with-timeout\r\n", want: "BAD_FORMAT\r\n"},
+				{send: "delete x\r\n", want: "BAD_FORMAT\r\n"},
+				{send: "delete 1\r\n", want: "NOT_FOUND\r\n"},
+				{send: "ignore default\r\n", want: "NOT_IGNORED\r\n"},
+				{send: "stats-tube missing\r\n", want: "NOT_FOUND\r\n"},
+				{send: "put 0 0 60 65\r\n" + strings.Repeat("x", 65) + "\r\n", want: "JOB_TOO_BIG\r\n"},
+				{send: "list-tube-used\r\n", want: "USING default\r\n"},
+			},
+		},
+		{
+			name:  "acl",
+			rules: []config.ACLRule{{Principal: "*", Topics: []string{"orders"}, Actions: []string{config.ActionSend}}},
+			steps: []step{
+				{send: "use orders\r\n", want: "USING orders\r\n"},
+				{send: "put 0 0 60 1\r\na\r\n", want: `INSERTED \d+\r\n`},
+				{send: "watch orders\r\n", want: "NOT_FOUND\r\n"},
+				{send: "reserve-with-timeout 0\r\n", want: "NOT_FOUND\r\n"},
+				{send: "kick 1\r\n", want: "NOT_FOUND\r\n"},
+				{send: "use payments\r\n", want: "USING payments\r\n"},
+				{send: "put 0 0 60 1\r\na\r\n", want: "NOT_FOUND\r\n"},
+				{send: "list-tubes\r\n", want: "OK \\d+\r\n---\n- orders\n\r\n"},
+			},
+		},
+		{
+			name:    "quotas",
+			tenants: []config.Tenant{{Name: "shop", Topics: []string{"shop.*"}, MaxBytes: 4}},
+			steps: []step{
+				{send: "use shop.a\r\n", want: "USING shop.a\r\n"},
+				{send: "put 0 0 60 3\r\nabc\r\n", want: `INSERTED \d+\r\n`},
+				{send: "put 0 0 60 3\r\ndef\r\n", want: "OUT_OF_MEMORY\r\n"},
+			},
+		},
+		{
+			name:   "rate limits",
+			limits: []config.RateLimit{{Principal: "*", Action: config.ActionSend, Rate: 1}, {Principal: "*", Action: config.ActionGet, Rate: 1}},
+			steps: []step{
+				{send: "put 0 0 60 1\r\na\r\n", want: `INSERTED \d+\r\n`},
+				{send: "put 0 0 60 1\r\nb\r\n", want: "DRAINING\r\n"},
+				{send: "reserve-with-timeout 0\r\n", want: `RESERVED \d+ 1\r\na\r\n`},
+				// the reserve waits for the limit until its timeout
+				{send: "reserve-with-timeout 0\r\n", want: "TIMED_OUT\r\n"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := apptest.Run(t, &config.Config{MaxMessageSize: 64, DedupWindow: time.Minute}, tt.limits...)
+			app.ApplyTenants(tt.tenants)
+			acl := auth.NewACL(nil)
+			acl.Set(tt.rules)
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newConn(app, auth.NewTokens(), acl, server).serve(context.Background())
+			}()
+			defer func() {
+				_ = client.Close()
+				<-done
+			}()
+
+			r := bufio.NewReader(client)
+			reserved := regexp.MustCompile(`^RESERVED (\d+) `)
+			var id string
+			for i, s := range tt.steps {
+				_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+				_, errWrite := client.Write([]byte(strings.ReplaceAll(s.send, "$id", id)))
+				if errWrite != nil {
+					t.Fatalf("step %d: %v", i, errWrite)
+				}
+				reply, errRead := readReply(r)
+				if errRead != nil {
+					t.Fatalf("step %d: %v", i, errRead)
+				}
+				if !regexp.MustCompile(`^` + s.want + `$`).MatchString(reply) {
+					t.Errorf("step %d %q: reply %q, want %q", i, s.send, reply, s.want)
+				}
+				if m := reserved.FindStringSubmatch(reply); m != nil {
+					id = m[1]
+				}
+			}
+		})
+	}
+}
@@ -4,29 +4,142 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
+
+	"github.com/VictoriaMetrics/metrics"
 
 	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
 	"github.com/ssqueue/ssqueue/internal/front"
 	"github.com/ssqueue/ssqueue/internal/messages"
 )
 
 const (
-	defaultGetTimeout = time.Second * 20
+	defaultGetTimeout  = time.Second * 20
+	defaultContentType = "application/octet-stream"
+	defaultPeekLimit   = 100
+	maxPeekLimit       = 1000
+
+	headerMessageID     = "X-Message-Id"
+	headerMessageFrom   = "X-Message-From"
+	headerMessageHeader = "X-Message-Header-"
+	headerMessageGroup  = "X-Message-Group"
+
+	headerMessageReplyTo       = "X-Message-Reply-To"
+	headerMessageCorrelationID = "X-Message-Correlation-Id"
+
+	headerIdempotencyKey = "Idempotency-Key"
 )
 
+type backend interface {
+	front.Application
+	front.RequestApplication
+	front.PeekApplication
+	front.DeleteApplication
+	front.TopicApplication
+	front.LimitApplication
+}
+
 type HTTP struct {
-	app front.Application
+	app    backend
+	tokens *auth.Tokens
+	acl    *auth.ACL
 }
 
-func New(app front.Application) *HTTP {
+func New(app backend, tokens *auth.Tokens, acl *auth.ACL) *HTTP {
 	return &HTTP{
-		app: app,
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+	}
+}
+
+// limitBody makes reading the request body fail after limit bytes, so large bodies are never held in memory, zero is unlimited
+func limitBody(rw http.ResponseWriter, req *http.Request, limit int64) {
+	if limit > 0 {
+		req.Body = http.MaxBytesReader(rw, req.Body, limit)
+	}
+}
+
+// bodyError writes 413 if the body is over the size limit and 400 for other read errors
+func bodyError(rw http.ResponseWriter, err error) {
+	var errMaxBytes *http.MaxBytesError
+	if errors.As(err, &errMaxBytes) {
+		metrics.GetOrCreateCounter("ssqueue_requests_too_large").Inc()
+		http.Error(rw, "request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	http.Error(rw, "bad request, invalid message", http.StatusBadRequest)
+}
+
+// allow checks the action on the topic for the principal of the request, 403 is written if it is denied
+func (h *HTTP) allow(rw http.ResponseWriter, req *http.Request, action string, topic string) bool {
+	principal := auth.Principal(req.Context())
+	if h.acl.Allowed(principal, action, topic) {
+		return true
+	}
+
+	slog.Warn("request denied", slog.String("principal", principal), slog.String("action", action), slog.String("topic", topic))
+	http.Error(rw, "forbidden", http.StatusForbidden)
+
+	return false
+}
+
+// throttled writes 429 with Retry-After in whole seconds if the request is over the rate limits
+func throttled(rw http.ResponseWriter, err error) bool {
+	wait, ok := application.Throttled(err)
+	if !ok {
+		return false
+	}
+
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(rw, "too many requests", http.StatusTooManyRequests)
+
+	return true
+}
+
+// outputMessage is the JSON form of a received message
+type outputMessage struct {
+	ID            string            `json:"id"`
+	From          string            `json:"from"`
+	Data          string            `json:"data"`
+	DataBase64    []byte            `json:"data_base64,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Group         string            `json:"group,omitempty"`
+	ReplyTo       string            `json:"reply_to,omitempty"`
+	CorrelationID string            `json:"correlation_id,omitempty"`
+}
+
+func newOutputMessage(om *messages.OutputMessage) outputMessage {
+	resp := outputMessage{
+		ID:            om.ID,
+		From:          om.Name,
+		Data:          om.Data,
+		ContentType:   om.ContentType,
+		Headers:       om.Headers,
+		Group:         om.Group,
+		ReplyTo:       om.ReplyTo,
+		CorrelationID: om.CorrelationID,
 	}
+	// binary data does not survive JSON strings, it is returned base64 encoded
+	if !utf8.ValidString(om.Data) {
+		resp.Data = ""
+		resp.DataBase64 = []byte(om.Data)
+	}
+
+	return resp
 }
 
 func sendResponse(rw http.ResponseWriter, status int, v any) {
@@ -45,14 +158,58 @@ func sendResponse(rw http.ResponseWriter, status int, v any) {
 	}
 }
 
-func (h *HTTP) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
-	defer wg.Done()
+// sendError maps errors of Send to response statuses
+func sendError(rw http.ResponseWriter, err error) {
+	if throttled(rw, err) {
+		return
+	}
 
+	switch {
+	case errors.Is(err, application.ErrNoConsumers):
+		http.Error(rw, err.Error(), http.StatusGone)
+	case errors.Is(err, application.ErrNotReady):
+		http.Error(rw, err.Error(), http.StatusServiceUnavailable)
+	case errors.Is(err, application.ErrInvalidHeaders), errors.Is(err, application.ErrInvalidTopic), errors.Is(err, application.ErrIdempotentRequest):
+		http.Error(rw, "bad request, "+err.Error(), http.StatusBadRequest)
+	case errors.Is(err, application.ErrTopicNotFound):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case errors.Is(err, application.ErrTopicDeleted):
+		http.Error(rw, err.Error(), http.StatusGone)
+	case errors.Is(err, application.ErrTopicFull):
+		http.Error(rw, err.Error(), http.StatusInsufficientStorage)
+	case errors.Is(err, application.ErrMessageTooLarge):
+		http.Error(rw, err.Error(), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, application.ErrQuotaExceeded):
+		http.Error(rw, err.Error(), http.StatusForbidden)
+	default:
+		slog.Error("error send message", slog.String("error", err.Error()))
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// handler routes the API, requests are authenticated first
+func (h *HTTP) handler() http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/v1/send", h.handlerSend)
 	mux.HandleFunc("/api/v1/get", h.handlerGet)
+	mux.HandleFunc("/api/v1/request", h.handlerRequest)
+	mux.HandleFunc("GET /api/v1/peek", h.handlerPeek)
+	mux.HandleFunc("DELETE /api/v1/messages/{id}", h.handlerDelete)
+	mux.HandleFunc("GET /api/v1/topics", h.handlerTopics)
+	mux.HandleFunc("GET /api/v1/topics/{topic}", h.handlerDescribeTopic)
+	mux.HandleFunc("PUT /api/v1/topics/{topic}", h.handlerCreateTopic)
+	mux.HandleFunc("DELETE /api/v1/topics/{topic}", h.handlerDeleteTopic)
+	mux.HandleFunc("POST /api/v1/topics/{topic}/purge", h.handlerPurgeTopic)
+	mux.HandleFunc("POST /api/v1/topics/{topic}/messages", h.handlerSendRaw)
+	mux.HandleFunc("GET /api/v1/topics/{topic}/messages", h.handlerGetRaw)
 
-	server := &http.Server{Handler: mux}
+	return h.tokens.Middleware(mux)
+}
+
+func (h *HTTP) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
+	defer wg.Done()
+
+	server := &http.Server{Handler: h.handler()}
 
 	wg.Add(1)
 	go func() {
@@ -78,81 +235,359 @@ func (h *HTTP) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
 	}
 }
 
-func (h *HTTP) handlerSend(rw http.ResponseWriter, req *http.Request) {
-	type request struct {
-		Name       string `json:"name"`
-		Topic      string `json:"topic"`
-		Data       string `json:"data"`
-		Persistent bool   `json:"persistent"`
+// inputMessage is the JSON form of a sent message
+type inputMessage struct {
+	Name       string            `json:"name"`
+	Topic      string            `json:"topic"`
+	Data       string            `json:"data"`
+	Persistent bool              `json:"persistent"`
+	Headers    map[string]string `json:"headers"`
+	// Group keeps messages in order, a message of the group is not delivered while another one is reserved or held after get
+	Group string `json:"group"`
+	// IdempotencyKey deduplicates retried sends, a repeated send returns 200 with the original ID
+	IdempotencyKey string `json:"idempotency_key"`
+	ReplyTo        string `json:"reply_to"`
+	CorrelationID  string `json:"correlation_id"`
+}
+
+func (r *inputMessage) message() *messages.InputMessage {
+	return &messages.InputMessage{
+		Name:           r.Name,
+		Data:           r.Data,
+		Persistent:     r.Persistent,
+		Headers:        r.Headers,
+		Group:          r.Group,
+		IdempotencyKey: r.IdempotencyKey,
+		ReplyTo:        r.ReplyTo,
+		CorrelationID:  r.CorrelationID,
 	}
+}
 
+func (h *HTTP) handlerSend(rw http.ResponseWriter, req *http.Request) {
 	type response struct {
 		ID string `json:"id"`
 	}
 
-	r := request{}
+	r := inputMessage{}
 
+	// the topic is in the body, so it is limited for the largest topic
+	limitBody(rw, req, front.MaxRequestSize(h.app))
 	errDecode := json.NewDecoder(req.Body).Decode(&r)
 	if errDecode != nil {
-		http.Error(rw, "bad request, invalid message", http.StatusBadRequest)
+		bodyError(rw, errDecode)
+		return
+	}
+	if !h.allow(rw, req, config.ActionSend, r.Topic) {
 		return
 	}
 
-	internalID, err := h.app.Send(req.Context(), r.Topic, &messages.InputMessage{Data: r.Data, Persistent: r.Persistent, Name: r.Name})
+	internalID, err := h.app.Send(req.Context(), r.Topic, r.message())
+	if errors.Is(err, application.ErrDuplicate) {
+		sendResponse(rw, http.StatusOK, response{ID: internalID})
+		return
+	}
 	if err != nil {
-		if errors.Is(err, application.ErrNoConsumers) {
-			http.Error(rw, err.Error(), http.StatusGone)
-			return
-		}
-		slog.Error("error send message", slog.String("error", err.Error()))
-		http.Error(rw, "internal error", http.StatusInternalServerError)
+		sendError(rw, err)
 		return
 	}
 
 	sendResponse(rw, http.StatusCreated, response{ID: internalID})
 }
 
+// handlerRequest sends the message and waits for the reply, 504 is returned if it does not come within the timeout
+func (h *HTTP) handlerRequest(rw http.ResponseWriter, req *http.Request) {
+	timeout, ok := parseTimeout(rw, req)
+	if !ok {
+		return
+	}
+
+	r := inputMessage{}
+
+	// the topic is in the body, so it is limited for the largest topic
+	limitBody(rw, req, front.MaxRequestSize(h.app))
+	errDecode := json.NewDecoder(req.Body).Decode(&r)
+	if errDecode != nil {
+		bodyError(rw, errDecode)
+		return
+	}
+	if !h.allow(rw, req, config.ActionSend, r.Topic) {
+		return
+	}
+	// the reply is read from the topic, so a reply topic chosen by the client needs the get permission
+	if r.ReplyTo != "" && !h.allow(rw, req, config.ActionGet, r.ReplyTo) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	reply, err := h.app.Request(ctx, r.Topic, r.message())
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+	if reply == nil {
+		http.Error(rw, "reply timeout", http.StatusGatewayTimeout)
+		return
+	}
+
+	sendResponse(rw, http.StatusOK, newOutputMessage(reply))
+}
+
 func (h *HTTP) handlerGet(rw http.ResponseWriter, req *http.Request) {
+	om, ok := h.get(rw, req, req.URL.Query().Get("topic"))
+	if !ok {
+		return
+	}
+
+	sendResponse(rw, http.StatusOK, newOutputMessage(om))
+}
+
+// handlerSendRaw stores the request body as is, together with its content type
+func (h *HTTP) handlerSendRaw(rw http.ResponseWriter, req *http.Request) {
 	type response struct {
+		ID string `json:"id"`
+	}
+
+	if !h.allow(rw, req, config.ActionSend, req.PathValue("topic")) {
+		return
+	}
+
+	limitBody(rw, req, int64(h.app.MaxMessageSize(req.PathValue("topic"))))
+	data, errRead := io.ReadAll(req.Body)
+	if errRead != nil {
+		bodyError(rw, errRead)
+		return
+	}
+
+	contentType := req.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	im := &messages.InputMessage{
+		Name:           req.URL.Query().Get("name"),
+		Data:           string(data),
+		Persistent:     req.URL.Query().Get("persistent") == "true",
+		ContentType:    contentType,
+		IdempotencyKey: req.Header.Get(headerIdempotencyKey),
+		Group:          req.Header.Get(headerMessageGroup),
+		ReplyTo:        req.Header.Get(headerMessageReplyTo),
+		CorrelationID:  req.Header.Get(headerMessageCorrelationID),
+	}
+
+	// message headers are passed as prefixed HTTP headers, names are lowercased
+	for k, v := range req.Header {
+		if name, ok := strings.CutPrefix(k, headerMessageHeader); ok && len(v) > 0 {
+			if im.Headers == nil {
+				im.Headers = make(map[string]string)
+			}
+			im.Headers[strings.ToLower(name)] = v[0]
+		}
+	}
+
+	internalID, err := h.app.Send(req.Context(), req.PathValue("topic"), im)
+	if errors.Is(err, application.ErrDuplicate) {
+		sendResponse(rw, http.StatusOK, response{ID: internalID})
+		return
+	}
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	sendResponse(rw, http.StatusCreated, response{ID: internalID})
+}
+
+// handlerGetRaw returns the message data as the body with the content type it was sent with
+func (h *HTTP) handlerGetRaw(rw http.ResponseWriter, req *http.Request) {
+	om, ok := h.get(rw, req, req.PathValue("topic"))
+	if !ok {
+		return
+	}
+
+	contentType := om.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set(headerMessageID, om.ID)
+	if om.Name != "" {
+		rw.Header().Set(headerMessageFrom, om.Name)
+	}
+	if om.Group != "" {
+		rw.Header().Set(headerMessageGroup, om.Group)
+	}
+	if om.ReplyTo != "" {
+		rw.Header().Set(headerMessageReplyTo, om.ReplyTo)
+	}
+	if om.CorrelationID != "" {
+		rw.Header().Set(headerMessageCorrelationID, om.CorrelationID)
+	}
+	for k, v := range om.Headers {
+		rw.Header().Set(headerMessageHeader+k, v)
+	}
+	rw.WriteHeader(http.StatusOK)
+	_, errWrite := io.WriteString(rw, om.Data)
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}
+
+// handlerPeek lists pending messages of the topic without taking them
+func (h *HTTP) handlerPeek(rw http.ResponseWriter, req *http.Request) {
+	type message struct {
 		ID   string `json:"id"`
-		From string `json:"from"`
-		Data string `json:"data"`
+		Name string `json:"name,omitempty"`
+		// Age is in seconds, it is zero for messages restored from snapshots of older versions
+		Age  float64 `json:"age"`
+		Size int     `json:"size"`
 	}
 
-	name := req.URL.Query().Get("name")
+	type response struct {
+		Messages []message `json:"messages"`
+	}
+
+	offset, errOffset := parseInt(req.URL.Query().Get("offset"), 0)
+	if errOffset != nil || offset < 0 {
+		http.Error(rw, "bad request, invalid offset", http.StatusBadRequest)
+		return
+	}
+	limit, errLimit := parseInt(req.URL.Query().Get("limit"), defaultPeekLimit)
+	if errLimit != nil || limit < 1 || limit > maxPeekLimit {
+		http.Error(rw, "bad request, invalid limit", http.StatusBadRequest)
+		return
+	}
+
+	topic := req.URL.Query().Get("topic")
+	if !h.allow(rw, req, config.ActionGet, topic) {
+		return
+	}
+
+	infos, err := h.app.Peek(req.Context(), topic, offset, limit)
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	resp := response{Messages: make([]message, 0, len(infos))}
+	for _, info := range infos {
+		resp.Messages = append(resp.Messages, message{ID: info.ID, Name: info.Name, Age: info.Age.Seconds(), Size: info.Size})
+	}
+
+	sendResponse(rw, http.StatusOK, resp)
+}
+
+// handlerDelete removes the pending message, 404 is returned if it was already taken or does not exist
+func (h *HTTP) handlerDelete(rw http.ResponseWriter, req *http.Request) {
 	topic := req.URL.Query().Get("topic")
+	if topic == "" {
+		http.Error(rw, "bad request, topic is required", http.StatusBadRequest)
+		return
+	}
+	if !h.allow(rw, req, config.ActionAdmin, topic) {
+		return
+	}
+
+	err := h.app.Delete(req.Context(), topic, req.PathValue("id"))
+	if errors.Is(err, application.ErrMessageNotFound) {
+		http.Error(rw, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
 
-	timeout := defaultGetTimeout
+func parseInt(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	return strconv.Atoi(s)
+}
 
+// parseTimeout reads the timeout query parameter, the bad request response is written here
+func parseTimeout(rw http.ResponseWriter, req *http.Request) (time.Duration, bool) {
 	timeoutStr := req.URL.Query().Get("timeout")
-	if timeoutStr != "" {
-		var err error
-		timeout, err = time.ParseDuration(timeoutStr)
-		if err != nil {
-			http.Error(rw, "bad request, invalid timeout", http.StatusBadRequest)
-			return
+	if timeoutStr == "" {
+		return defaultGetTimeout, true
+	}
+
+	timeout, err := time.ParseDuration(timeoutStr)
+	if err != nil {
+		http.Error(rw, "bad request, invalid timeout", http.StatusBadRequest)
+		return 0, false
+	}
+
+	return timeout, true
+}
+
+// get waits for a message, responses for errors and empty results are written here.
+// The group of the message is held for GroupHold, the next message of the group is not delivered before it ends.
+func (h *HTTP) get(rw http.ResponseWriter, req *http.Request, topic string) (*messages.OutputMessage, bool) {
+	if !h.allow(rw, req, config.ActionGet, topic) {
+		return nil, false
+	}
+
+	name := req.URL.Query().Get("name")
+
+	timeout, ok := parseTimeout(rw, req)
+	if !ok {
+		return nil, false
+	}
+
+	// filters are passed as filter=name=value, a message must match all of them
+	var filter messages.Filter
+	for _, v := range req.URL.Query()["filter"] {
+		k, val, ok := strings.Cut(v, "=")
+		if !ok || k == "" {
+			http.Error(rw, "bad request, invalid filter", http.StatusBadRequest)
+			return nil, false
 		}
+		if filter == nil {
+			filter = make(messages.Filter)
+		}
+		filter[k] = val
 	}
 
 	ctx, cancel := context.WithTimeout(req.Context(), timeout)
 	defer cancel()
 
-	om, err := h.app.Get(ctx, topic)
+	om, err := h.app.Get(ctx, topic, filter)
 	if err != nil {
+		if throttled(rw, err) {
+			return nil, false
+		}
 		if errors.Is(err, application.ErrNotReady) {
 			http.Error(rw, err.Error(), http.StatusServiceUnavailable)
-			return
+			return nil, false
+		}
+		if errors.Is(err, application.ErrTopicDeleted) {
+			http.Error(rw, err.Error(), http.StatusGone)
+			return nil, false
+		}
+		if errors.Is(err, application.ErrTopicNotFound) {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return nil, false
+		}
+		if errors.Is(err, application.ErrQuotaExceeded) {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return nil, false
 		}
 		slog.Error("error get message", slog.String("error", err.Error()))
 		http.Error(rw, "internal error", http.StatusInternalServerError)
-		return
+		return nil, false
 	}
 	if om == nil {
 		rw.WriteHeader(http.StatusNoContent)
-		return
+		return nil, false
 	}
 
-	slog.Log(ctx, slog.LevelInfo+1, "receive message", "tag", "trace", slog.String("topic", topic), slog.String("consumer", name), slog.String("producer", om.Name))
+	slog.Log(ctx, slog.LevelInfo+1, "receive message", "tag", "trace", slog.String("topic", topic), slog.String("consumer", name), slog.String("producer", om.Name), slog.String("principal", auth.Principal(ctx)))
 
-	sendResponse(rw, http.StatusOK, response{ID: om.ID, From: om.Name, Data: om.Data})
+	return om, true
 }
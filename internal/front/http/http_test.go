@@ -0,0 +1,134 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application/apptest"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func TestHandler(t *testing.T) {
+	type call struct {
+		method string
+		// target may contain $id, it is replaced by the last ID returned
+		target string
+		body   string
+		status int
+		// contains is a part of the expected response
+		contains string
+	}
+
+	tests := []struct {
+		name   string
+		rules  []config.ACLRule
+		limits []config.RateLimit
+		calls  []call
+	}{
+		{
+			name: "send and get",
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"hello","persistent":true,"headers":{"k":"v"}}`, status: http.StatusCreated, contains: `"id":`},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s&filter=k=x", status: http.StatusNoContent},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s&filter=k=v", status: http.StatusOK, contains: `"data":"hello"`},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s", status: http.StatusNoContent},
+			},
+		},
+		{
+			name: "peek and delete",
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"a","persistent":true}`, status: http.StatusCreated},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"b","persistent":true}`, status: http.StatusCreated},
+				{method: http.MethodGet, target: "/api/v1/peek?topic=orders&offset=1", status: http.StatusOK, contains: `"size":1`},
+				{method: http.MethodDelete, target: "/api/v1/messages/$id?topic=orders", status: http.StatusNoContent},
+				{method: http.MethodDelete, target: "/api/v1/messages/$id?topic=orders", status: http.StatusNotFound},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s", status: http.StatusOK, contains: `"data":"a"`},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s", status: http.StatusNoContent},
+			},
+		},
+		{
+			name: "raw messages",
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/topics/orders/messages?persistent=true", body: "hello", status: http.StatusCreated, contains: `"id":`},
+				{method: http.MethodGet, target: "/api/v1/topics/orders/messages?timeout=0s", status: http.StatusOK, contains: "hello"},
+			},
+		},
+		{
+			name: "errors",
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":`, status: http.StatusBadRequest, contains: "invalid message"},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"` + strings.Repeat("x", 65) + `","persistent":true}`, status: http.StatusRequestEntityTooLarge, contains: "too large"},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"` + strings.Repeat("x", 70*1024) + `"}`, status: http.StatusRequestEntityTooLarge, contains: "request body is too large"},
+				{method: http.MethodPost, target: "/api/v1/topics/orders/messages", body: strings.Repeat("x", 65), status: http.StatusRequestEntityTooLarge, contains: "request body is too large"},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"a"}`, status: http.StatusGone},
+				{method: http.MethodPost, target: "/api/v1/request?timeout=1s", body: `{"topic":"orders","data":"a","idempotency_key":"k"}`, status: http.StatusBadRequest, contains: "idempotency"},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=x", status: http.StatusBadRequest, contains: "invalid timeout"},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&filter=k", status: http.StatusBadRequest, contains: "invalid filter"},
+				{method: http.MethodGet, target: "/api/v1/peek?topic=orders&limit=0", status: http.StatusBadRequest, contains: "invalid limit"},
+				{method: http.MethodGet, target: "/api/v1/peek?topic=orders&offset=-1", status: http.StatusBadRequest, contains: "invalid offset"},
+				{method: http.MethodDelete, target: "/api/v1/messages/x", status: http.StatusBadRequest, contains: "topic is required"},
+			},
+		},
+		{
+			name: "acl",
+			rules: []config.ACLRule{
+				{Principal: "*", Topics: []string{"orders"}, Actions: []string{config.ActionSend, config.ActionGet}},
+				{Principal: "*", Topics: []string{"events"}, Actions: []string{config.ActionSend}},
+			},
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"events","data":"a","persistent":true}`, status: http.StatusCreated},
+				{method: http.MethodGet, target: "/api/v1/get?topic=events&timeout=0s", status: http.StatusForbidden},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"payments","data":"a","persistent":true}`, status: http.StatusForbidden},
+				{method: http.MethodPost, target: "/api/v1/request?timeout=1s", body: `{"topic":"orders","data":"a","reply_to":"events"}`, status: http.StatusForbidden},
+				{method: http.MethodDelete, target: "/api/v1/messages/x?topic=orders", status: http.StatusForbidden},
+				{method: http.MethodPut, target: "/api/v1/topics/orders", status: http.StatusForbidden},
+				{method: http.MethodGet, target: "/api/v1/topics", status: http.StatusOK, contains: `"topics":[{"name":"events"`},
+			},
+		},
+		{
+			name:   "rate limits",
+			limits: []config.RateLimit{{Topic: "orders", Action: config.ActionSend, Rate: 1}, {Principal: "*", Action: config.ActionGet, Rate: 1}},
+			calls: []call{
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"a","persistent":true}`, status: http.StatusCreated},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"orders","data":"b","persistent":true}`, status: http.StatusTooManyRequests, contains: "too many requests"},
+				{method: http.MethodPost, target: "/api/v1/topics/orders/messages", body: "c", status: http.StatusTooManyRequests},
+				{method: http.MethodPost, target: "/api/v1/send", body: `{"topic":"events","data":"a","persistent":true}`, status: http.StatusCreated},
+				{method: http.MethodGet, target: "/api/v1/get?topic=orders&timeout=0s", status: http.StatusOK, contains: `"data":"a"`},
+				{method: http.MethodGet, target: "/api/v1/get?topic=events&timeout=0s", status: http.StatusTooManyRequests},
+			},
+		},
+	}
+
+	idPattern := regexp.MustCompile(`"id":"([^"]+)"`)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := apptest.Run(t, &config.Config{MaxMessageSize: 64, DedupWindow: time.Minute}, tt.limits...)
+			acl := auth.NewACL(nil)
+			acl.Set(tt.rules)
+			h := New(app, auth.NewTokens(), acl).handler()
+
+			var id string
+			for i, c := range tt.calls {
+				req := httptest.NewRequest(c.method, strings.ReplaceAll(c.target, "$id", id), strings.NewReader(c.body))
+				rw := httptest.NewRecorder()
+				h.ServeHTTP(rw, req)
+
+				if rw.Code != c.status || !strings.Contains(rw.Body.String(), c.contains) {
+					t.Errorf("call %d: %d %s, want %d with %s", i, rw.Code, rw.Body.String(), c.status, c.contains)
+				}
+				if rw.Code == http.StatusTooManyRequests && rw.Header().Get("Retry-After") != "1" {
+					t.Errorf("call %d: Retry-After %q, want 1", i, rw.Header().Get("Retry-After"))
+				}
+				if m := idPattern.FindStringSubmatch(rw.Body.String()); m != nil {
+					id = m[1]
+				}
+			}
+		})
+	}
+}
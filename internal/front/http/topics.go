@@ -0,0 +1,130 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+// topicInfo is the JSON form of a topic description
+type topicInfo struct {
+	Name      string `json:"name"`
+	Messages  int    `json:"messages"`
+	InFlight  int    `json:"in_flight"`
+	Delayed   int    `json:"delayed"`
+	Buried    int    `json:"buried"`
+	Consumers int    `json:"consumers"`
+}
+
+func newTopicInfo(info *messages.TopicInfo) topicInfo {
+	return topicInfo{
+		Name:      info.Name,
+		Messages:  info.Messages,
+		InFlight:  info.InFlight,
+		Delayed:   info.Delayed,
+		Buried:    info.Buried,
+		Consumers: info.Consumers,
+	}
+}
+
+// handlerTopics lists topics visible to the principal with their depth and consumers
+func (h *HTTP) handlerTopics(rw http.ResponseWriter, req *http.Request) {
+	type response struct {
+		Topics []topicInfo `json:"topics"`
+	}
+
+	topics := h.app.Topics(req.Context())
+	principal := auth.Principal(req.Context())
+
+	resp := response{Topics: make([]topicInfo, 0, len(topics))}
+	for _, topic := range topics {
+		if !h.acl.Visible(principal, topic) {
+			continue
+		}
+		info, err := h.app.Describe(req.Context(), topic)
+		if err != nil {
+			// the topic was deleted after it was listed
+			continue
+		}
+		resp.Topics = append(resp.Topics, newTopicInfo(info))
+	}
+
+	sendResponse(rw, http.StatusOK, resp)
+}
+
+func (h *HTTP) handlerDescribeTopic(rw http.ResponseWriter, req *http.Request) {
+	if !h.allow(rw, req, config.ActionGet, req.PathValue("topic")) {
+		return
+	}
+
+	info, err := h.app.Describe(req.Context(), req.PathValue("topic"))
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	sendResponse(rw, http.StatusOK, newTopicInfo(info))
+}
+
+// handlerCreateTopic responds 201 for a new topic and 200 if it already exists
+func (h *HTTP) handlerCreateTopic(rw http.ResponseWriter, req *http.Request) {
+	topic := req.PathValue("topic")
+	if !h.allow(rw, req, config.ActionAdmin, topic) {
+		return
+	}
+
+	created, err := h.app.CreateTopic(req.Context(), topic)
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	info, errDescribe := h.app.Describe(req.Context(), topic)
+	if errDescribe != nil {
+		sendError(rw, errDescribe)
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	sendResponse(rw, status, newTopicInfo(info))
+}
+
+// handlerPurgeTopic removes all messages of the topic, including reserved, delayed and buried ones
+func (h *HTTP) handlerPurgeTopic(rw http.ResponseWriter, req *http.Request) {
+	type response struct {
+		Purged int `json:"purged"`
+	}
+
+	if !h.allow(rw, req, config.ActionAdmin, req.PathValue("topic")) {
+		return
+	}
+
+	purged, err := h.app.PurgeTopic(req.Context(), req.PathValue("topic"))
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	sendResponse(rw, http.StatusOK, response{Purged: purged})
+}
+
+// handlerDeleteTopic removes the topic, consumers waiting on it get 410
+func (h *HTTP) handlerDeleteTopic(rw http.ResponseWriter, req *http.Request) {
+	if !h.allow(rw, req, config.ActionAdmin, req.PathValue("topic")) {
+		return
+	}
+
+	err := h.app.DeleteTopic(req.Context(), req.PathValue("topic"))
+	if err != nil {
+		sendError(rw, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,423 @@
+package mqtt
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/front"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+const (
+	protocolName  = "MQTT"
+	protocolLevel = 4
+
+	connackAccepted           = 0x00
+	connackBadProtocolVersion = 0x01
+	connackIdentifierRejected = 0x02
+	connackBadCredentials     = 0x04
+
+	subackFailure = 0x80
+
+	connectTimeout = time.Second * 10
+	writeDeadline  = time.Second * 10
+	// delivered messages are leased until they are written to the connection
+	leaseTimeout = time.Minute
+)
+
+var errProtocolViolation = errors.New("protocol violation")
+
+type will struct {
+	topic   string
+	payload []byte
+}
+
+type conn struct {
+	app       backend
+	tokens    *auth.Tokens
+	acl       *auth.ACL
+	nc        net.Conn
+	r         *bufio.Reader
+	wMu       sync.Mutex
+	w         *bufio.Writer
+	clientID  string
+	principal string
+	keepAlive time.Duration
+	will      *will
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	wg   sync.WaitGroup
+}
+
+func newConn(app backend, tokens *auth.Tokens, acl *auth.ACL, nc net.Conn) *conn {
+	return &conn{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+		nc:     nc,
+		r:      bufio.NewReader(nc),
+		w:      bufio.NewWriter(nc),
+		subs:   make(map[string]context.CancelFunc),
+	}
+}
+
+// maxPacketSize returns the packet size limit, a publish packet carries the topic name besides the message
+func (c *conn) maxPacketSize() int64 {
+	if limit := front.MaxRequestSize(c.app); limit > 0 {
+		return min(limit, maxPacketSize)
+	}
+
+	return maxPacketSize
+}
+
+// recoverPanic logs a panic of a connection goroutine and closes the connection instead of crashing the server
+func (c *conn) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	slog.Error("panic in mqtt connection", slog.String("client", c.clientID), slog.String("remote", c.nc.RemoteAddr().String()),
+		slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+	_ = c.nc.Close()
+}
+
+func (c *conn) serve(ctx context.Context) {
+	defer c.recoverPanic()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		_ = c.nc.Close()
+		c.wg.Wait()
+	}()
+
+	// ctx is replaced by the one with the principal later, the channel is taken before
+	done := ctx.Done()
+	go func() {
+		<-done
+		_ = c.nc.Close()
+	}()
+
+	_ = c.nc.SetReadDeadline(time.Now().Add(connectTimeout))
+	p, errRead := readPacket(c.r, c.maxPacketSize())
+	if errRead != nil {
+		return
+	}
+	if p.typ != packetConnect {
+		return
+	}
+	if !c.handleConnect(p) {
+		return
+	}
+	ctx = auth.WithPrincipal(ctx, c.principal)
+
+	for {
+		// the client must send a packet within one and a half keep alive periods
+		if c.keepAlive > 0 {
+			_ = c.nc.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+		} else {
+			_ = c.nc.SetReadDeadline(time.Time{})
+		}
+
+		p, errRead = readPacket(c.r, c.maxPacketSize())
+		if errRead != nil {
+			if !errors.Is(errRead, io.EOF) && !errors.Is(errRead, net.ErrClosed) {
+				slog.Debug("error read mqtt packet", slog.String("client", c.clientID), slog.String("error", errRead.Error()))
+			}
+			c.publishWill(ctx)
+			return
+		}
+
+		if p.typ == packetDisconnect {
+			return
+		}
+
+		errHandle := c.handle(ctx, p)
+		if errHandle != nil {
+			if !errors.Is(errHandle, errProtocolViolation) && !errors.Is(errHandle, errMalformedPacket) {
+				slog.Error("error handle mqtt packet", slog.String("client", c.clientID), slog.String("error", errHandle.Error()))
+			}
+			c.publishWill(ctx)
+			return
+		}
+	}
+}
+
+func (c *conn) handle(ctx context.Context, p *packet) error {
+	switch p.typ {
+	case packetPublish:
+		return c.handlePublish(ctx, p)
+	case packetPuback:
+		// subscribers get QoS 0 only, nothing to acknowledge
+		return nil
+	case packetSubscribe:
+		return c.handleSubscribe(ctx, p)
+	case packetUnsubscribe:
+		return c.handleUnsubscribe(p)
+	case packetPingreq:
+		return c.write(packetPingresp, 0, nil)
+	default:
+		return errProtocolViolation
+	}
+}
+
+func (c *conn) handleConnect(p *packet) bool {
+	d := &decoder{buf: p.body}
+	name := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	if d.err != nil || name != protocolName || flags&0x01 != 0 {
+		return false
+	}
+	if level != protocolLevel {
+		_ = c.write(packetConnack, 0, []byte{0, connackBadProtocolVersion})
+		return false
+	}
+
+	c.clientID = d.string()
+	if flags&0x04 != 0 {
+		c.will = &will{topic: d.string(), payload: d.bytes()}
+	}
+	// the will is published when the connection is lost, its topic is checked now
+	if c.will != nil && !application.ValidTopic(c.will.topic) {
+		return false
+	}
+	if flags&0x80 != 0 {
+		_ = d.string()
+	}
+	var password []byte
+	if flags&0x40 != 0 {
+		password = d.bytes()
+	}
+	if d.err != nil {
+		return false
+	}
+
+	// the password is the token, clients with a certificate of mutual TLS need none
+	principal, ok := c.tokens.AuthenticateConn(c.nc, string(password))
+	if !ok {
+		slog.Warn("mqtt connection not authenticated", slog.String("client", c.clientID), slog.String("remote", c.nc.RemoteAddr().String()))
+		_ = c.write(packetConnack, 0, []byte{0, connackBadCredentials})
+		return false
+	}
+	c.principal = principal
+
+	// an empty client identifier is allowed with clean session only
+	if c.clientID == "" && flags&0x02 == 0 {
+		_ = c.write(packetConnack, 0, []byte{0, connackIdentifierRejected})
+		return false
+	}
+
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+
+	return c.write(packetConnack, 0, []byte{0, connackAccepted}) == nil
+}
+
+func (c *conn) handlePublish(ctx context.Context, p *packet) error {
+	qos := (p.flags >> 1) & 0x03
+	if qos > 1 {
+		return errProtocolViolation
+	}
+
+	d := &decoder{buf: p.body}
+	topic := d.string()
+	var packetID uint16
+	if qos == 1 {
+		packetID = d.uint16()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	// wildcards are not valid in topic names
+	if !application.ValidTopic(topic) {
+		return errProtocolViolation
+	}
+	if !c.allow(config.ActionSend, topic) {
+		return errProtocolViolation
+	}
+
+	_, errSend := c.app.Send(ctx, topic, &messages.InputMessage{Name: c.clientID, Data: string(d.buf), Persistent: true})
+	if errSend != nil {
+		// MQTT has no way to reject a message but to close the connection
+		if errors.Is(errSend, application.ErrNotReady) || errors.Is(errSend, application.ErrTopicNotFound) || errors.Is(errSend, application.ErrTopicFull) ||
+			errors.Is(errSend, application.ErrMessageTooLarge) || errors.Is(errSend, application.ErrQuotaExceeded) ||
+			errors.Is(errSend, application.ErrThrottled) {
+			return errProtocolViolation
+		}
+		return errSend
+	}
+
+	if qos == 1 {
+		return c.write(packetPuback, 0, binary.BigEndian.AppendUint16(nil, packetID))
+	}
+
+	return nil
+}
+
+// allow checks the action on the topic against the ACL for the principal of the connection
+func (c *conn) allow(action string, topic string) bool {
+	if c.acl.Allowed(c.principal, action, topic) {
+		return true
+	}
+
+	slog.Warn("mqtt packet denied", slog.String("client", c.clientID), slog.String("principal", c.principal), slog.String("action", action), slog.String("topic", topic))
+
+	return false
+}
+
+func (c *conn) handleSubscribe(ctx context.Context, p *packet) error {
+	if p.flags != 0x02 {
+		return errProtocolViolation
+	}
+
+	d := &decoder{buf: p.body}
+	packetID := d.uint16()
+
+	codes := binary.BigEndian.AppendUint16(nil, packetID)
+	for len(d.buf) > 0 && d.err == nil {
+		filter := d.string()
+		_ = d.byte()
+		if d.err != nil {
+			break
+		}
+		// wildcard filters are not supported, a filter is one topic
+		if !application.ValidTopic(filter) || !c.allow(config.ActionGet, filter) {
+			codes = append(codes, subackFailure)
+			continue
+		}
+		c.subscribe(ctx, filter)
+		codes = append(codes, 0x00)
+	}
+	if d.err != nil || len(codes) == 2 {
+		return errMalformedPacket
+	}
+
+	return c.write(packetSuback, 0, codes)
+}
+
+func (c *conn) handleUnsubscribe(p *packet) error {
+	if p.flags != 0x02 {
+		return errProtocolViolation
+	}
+
+	d := &decoder{buf: p.body}
+	packetID := d.uint16()
+	for len(d.buf) > 0 && d.err == nil {
+		filter := d.string()
+		if d.err != nil {
+			break
+		}
+		c.mu.Lock()
+		if cancel, ok := c.subs[filter]; ok {
+			cancel()
+			delete(c.subs, filter)
+		}
+		c.mu.Unlock()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	return c.write(packetUnsuback, 0, binary.BigEndian.AppendUint16(nil, packetID))
+}
+
+// subscribe starts a consumer loop for the topic, a repeated subscription keeps the running one
+func (c *conn) subscribe(ctx context.Context, topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subs[topic]; ok {
+		return
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	c.subs[topic] = cancel
+
+	c.wg.Add(1)
+	go c.consume(subCtx, topic)
+}
+
+func (c *conn) consume(ctx context.Context, topic string) {
+	defer c.wg.Done()
+	defer c.recoverPanic()
+
+	for {
+		om, receipt, err := c.app.Reserve(ctx, topic, leaseTimeout)
+		// MQTT topics exist while they are used, a deleted one is created again by the next Reserve
+		if errors.Is(err, application.ErrTopicDeleted) {
+			continue
+		}
+		// the subscription waits out the rate limit and takes the next message afterwards
+		if wait, ok := application.Throttled(err); ok {
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, application.ErrNotReady) && !errors.Is(err, application.ErrTopicNotFound) &&
+				!errors.Is(err, application.ErrQuotaExceeded) {
+				slog.Error("error reserve message", slog.String("topic", topic), slog.String("error", err.Error()))
+			}
+			return
+		}
+		if om == nil {
+			return
+		}
+
+		// the message is acknowledged once it is written, the connection may be gone by then
+		body := appendString(nil, topic)
+		body = append(body, om.Data...)
+		if c.write(packetPublish, 0, body) != nil {
+			errRelease := c.app.Release(context.WithoutCancel(ctx), topic, receipt, 0)
+			if errRelease != nil && !errors.Is(errRelease, application.ErrNoReceipt) {
+				slog.Error("error release message", slog.String("topic", topic), slog.String("error", errRelease.Error()))
+			}
+			return
+		}
+		errAck := c.app.Ack(context.WithoutCancel(ctx), topic, receipt)
+		if errAck != nil && !errors.Is(errAck, application.ErrNoReceipt) {
+			slog.Error("error ack message", slog.String("topic", topic), slog.String("error", errAck.Error()))
+		}
+	}
+}
+
+func (c *conn) publishWill(ctx context.Context) {
+	if c.will == nil || ctx.Err() != nil || !c.allow(config.ActionSend, c.will.topic) {
+		return
+	}
+
+	_, errSend := c.app.Send(ctx, c.will.topic, &messages.InputMessage{Name: c.clientID, Data: string(c.will.payload), Persistent: true})
+	if errSend != nil {
+		slog.Error("error send will message", slog.String("client", c.clientID), slog.String("error", errSend.Error()))
+	}
+}
+
+func (c *conn) write(typ byte, flags byte, body []byte) error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeDeadline))
+	err := writePacket(c.w, typ, flags, body)
+	if err != nil {
+		_ = c.nc.Close()
+	}
+
+	return err
+}
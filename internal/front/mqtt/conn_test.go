@@ -0,0 +1,149 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application/apptest"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func connectBody(willTopic string) []byte {
+	flags := byte(0x02)
+	if willTopic != "" {
+		flags |= 0x04
+	}
+	b := appendString(nil, protocolName)
+	b = append(b, protocolLevel, flags, 0, 0)
+	b = appendString(b, "client")
+	if willTopic != "" {
+		b = appendString(b, willTopic)
+		b = appendString(b, "gone")
+	}
+	return b
+}
+
+func publishBody(topic string, data string) []byte {
+	return append(appendString(nil, topic), data...)
+}
+
+func subscribeBody(packetID byte, filter string) []byte {
+	return append(appendString([]byte{0, packetID}, filter), 0)
+}
+
+func TestSession(t *testing.T) {
+	type reply struct {
+		typ  byte
+		body []byte
+	}
+	type step struct {
+		typ   byte
+		flags byte
+		body  []byte
+		// want are the replies in any order, the delivery of a subscription races with the acknowledgment of the packet
+		want []reply
+		// closed expects the server to close the connection instead of a reply
+		closed bool
+	}
+
+	connack := reply{typ: packetConnack, body: []byte{0, connackAccepted}}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "publish and subscribe",
+			steps: []step{
+				{typ: packetConnect, body: connectBody(""), want: []reply{connack}},
+				{typ: packetPublish, flags: 0x02, body: append(appendString(nil, "orders"), 0, 1, 'a'), want: []reply{{typ: packetPuback, body: []byte{0, 1}}}},
+				{typ: packetPublish, body: publishBody("orders", "b")},
+				{typ: packetSubscribe, flags: 0x02, body: subscribeBody(2, "orders"), want: []reply{
+					{typ: packetSuback, body: []byte{0, 2, 0}},
+					{typ: packetPublish, body: publishBody("orders", "a")},
+					{typ: packetPublish, body: publishBody("orders", "b")},
+				}},
+				{typ: packetPingreq, want: []reply{{typ: packetPingresp, body: []byte{}}}},
+			},
+		},
+		{
+			name: "wildcard and invalid filters",
+			steps: []step{
+				{typ: packetConnect, body: connectBody(""), want: []reply{connack}},
+				{typ: packetSubscribe, flags: 0x02, body: subscribeBody(1, "orders/#"), want: []reply{{typ: packetSuback, body: []byte{0, 1, subackFailure}}}},
+				{typ: packetSubscribe, flags: 0x02, body: subscribeBody(2, "a\"b"), want: []reply{{typ: packetSuback, body: []byte{0, 2, subackFailure}}}},
+			},
+		},
+		{
+			name: "invalid publish topic",
+			steps: []step{
+				{typ: packetConnect, body: connectBody(""), want: []reply{connack}},
+				{typ: packetPublish, body: publishBody("a\"b", "x"), closed: true},
+			},
+		},
+		{
+			name: "invalid will topic",
+			steps: []step{
+				{typ: packetConnect, body: connectBody("a\nb"), closed: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := apptest.Run(t, &config.Config{MaxMessageSize: 64, DedupWindow: time.Minute})
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newConn(app, auth.NewTokens(), auth.NewACL(nil), server).serve(context.Background())
+			}()
+			defer func() {
+				_ = client.Close()
+				<-done
+			}()
+
+			r := bufio.NewReader(client)
+			w := bufio.NewWriter(client)
+			for i, s := range tt.steps {
+				_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+				errWrite := writePacket(w, s.typ, s.flags, s.body)
+				if errWrite != nil {
+					t.Fatalf("step %d: %v", i, errWrite)
+				}
+
+				if s.closed {
+					_, errRead := readPacket(r, maxPacketSize)
+					if !errors.Is(errRead, io.EOF) {
+						t.Errorf("step %d: read %v, want closed connection", i, errRead)
+					}
+					continue
+				}
+
+				want := slices.Clone(s.want)
+				for range s.want {
+					p, errRead := readPacket(r, maxPacketSize)
+					if errRead != nil {
+						t.Fatalf("step %d: %v", i, errRead)
+					}
+					idx := slices.IndexFunc(want, func(w reply) bool {
+						return w.typ == p.typ && bytes.Equal(w.body, p.body)
+					})
+					if idx < 0 {
+						t.Fatalf("step %d: unexpected packet %d %q", i, p.typ, p.body)
+					}
+					want = slices.Delete(want, idx, idx+1)
+				}
+			}
+		})
+	}
+}
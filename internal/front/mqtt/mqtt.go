@@ -0,0 +1,77 @@
+package mqtt
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/front"
+)
+
+const (
+	acceptRetryDelay = time.Millisecond * 100
+)
+
+type backend interface {
+	front.LeaseApplication
+	front.LimitApplication
+}
+
+// MQTT serves the subset of MQTT 3.1.1, published messages are sent to the topic with the same name.
+// Wildcard subscriptions and QoS 2 are not supported, subscribers always get QoS 0.
+type MQTT struct {
+	app    backend
+	tokens *auth.Tokens
+	acl    *auth.ACL
+}
+
+func New(app backend, tokens *auth.Tokens, acl *auth.ACL) *MQTT {
+	return &MQTT{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+	}
+}
+
+func (m *MQTT) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
+	defer wg.Done()
+
+	var connWg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		slog.Info("shutting down mqtt server")
+		errClose := ln.Close()
+		if errClose != nil && !errors.Is(errClose, net.ErrClosed) {
+			slog.Error("error shutdown mqtt server", slog.String("error", errClose.Error()))
+		}
+	}()
+
+	slog.Info("start mqtt server", slog.String("addr", ln.Addr().String()))
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Error("error accept mqtt connection", slog.String("error", err.Error()))
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		connWg.Add(1)
+		go func() {
+			defer connWg.Done()
+			newConn(m.app, m.tokens, m.acl, nc).serve(ctx)
+		}()
+	}
+
+	connWg.Wait()
+}
@@ -0,0 +1,136 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+
+	// maxPacketSize bounds packets when messages are unlimited
+	maxPacketSize = 8 * 1024 * 1024
+)
+
+var (
+	errMalformedPacket = errors.New("malformed packet")
+	errPacketTooLarge  = errors.New("packet too large")
+)
+
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+// readPacket reads the next packet, its remaining length must not be larger than maxSize bytes
+func readPacket(r *bufio.Reader, maxSize int64) (*packet, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	// remaining length is a variable byte integer of up to four bytes
+	length := 0
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, errMalformedPacket
+		}
+		d, errRead := r.ReadByte()
+		if errRead != nil {
+			return nil, errRead
+		}
+		length |= int(d&0x7f) << (7 * i)
+		if d&0x80 == 0 {
+			break
+		}
+	}
+	if int64(length) > maxSize {
+		return nil, errPacketTooLarge
+	}
+
+	p := &packet{typ: b >> 4, flags: b & 0x0f, body: make([]byte, length)}
+	if _, err = io.ReadFull(r, p.body); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func writePacket(w *bufio.Writer, typ byte, flags byte, body []byte) error {
+	w.WriteByte(typ<<4 | flags)
+
+	length := len(body)
+	for {
+		d := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			d |= 0x80
+		}
+		w.WriteByte(d)
+		if length == 0 {
+			break
+		}
+	}
+	w.Write(body)
+
+	return w.Flush()
+}
+
+// decoder reads fields of the variable header and payload
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = errMalformedPacket
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.buf) < 2 {
+		d.err = errMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.buf) < n {
+		d.err = errMalformedPacket
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
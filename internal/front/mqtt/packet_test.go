@@ -0,0 +1,122 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   []byte
+		maxSize int64
+		typ     byte
+		flags   byte
+		body    []byte
+		err     error
+	}{
+		{name: "pingreq", input: []byte{0xc0, 0x00}, maxSize: 10, typ: packetPingreq, body: []byte{}},
+		{name: "publish with flags", input: []byte{0x32, 0x03, 'a', 'b', 'c'}, maxSize: 10, typ: packetPublish, flags: 0x02, body: []byte("abc")},
+		{
+			name:    "two byte length",
+			input:   append([]byte{0x30, 0x80, 0x01}, bytes.Repeat([]byte{'x'}, 128)...),
+			maxSize: 128,
+			typ:     packetPublish,
+			body:    bytes.Repeat([]byte{'x'}, 128),
+		},
+		{name: "over the limit", input: append([]byte{0x30, 0x80, 0x01}, bytes.Repeat([]byte{'x'}, 128)...), maxSize: 127, err: errPacketTooLarge},
+		{name: "five byte length", input: []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, maxSize: maxPacketSize, err: errMalformedPacket},
+		{name: "huge length is refused before reading", input: []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, maxSize: maxPacketSize, err: errPacketTooLarge},
+		{name: "truncated body", input: []byte{0x30, 0x05, 'a'}, maxSize: 10, err: io.ErrUnexpectedEOF},
+		{name: "truncated length", input: []byte{0x30, 0x80}, maxSize: 10, err: io.EOF},
+		{name: "empty", input: nil, maxSize: 10, err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readPacket(bufio.NewReader(bytes.NewReader(tt.input)), tt.maxSize)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.typ != tt.typ || p.flags != tt.flags || !bytes.Equal(p.body, tt.body) {
+				t.Errorf("packet %d %x %q, want %d %x %q", p.typ, p.flags, p.body, tt.typ, tt.flags, tt.body)
+			}
+		})
+	}
+}
+
+func TestWritePacketRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, 127, 128, 16383, 16384, 2097152} {
+		body := bytes.Repeat([]byte{'x'}, size)
+
+		var buf bytes.Buffer
+		errWrite := writePacket(bufio.NewWriter(&buf), packetPublish, 0x01, body)
+		if errWrite != nil {
+			t.Fatal(errWrite)
+		}
+
+		p, errRead := readPacket(bufio.NewReader(&buf), maxPacketSize)
+		if errRead != nil {
+			t.Fatalf("size %d: %v", size, errRead)
+		}
+		if p.typ != packetPublish || p.flags != 0x01 || len(p.body) != size {
+			t.Errorf("size %d: read packet %d %x of %d bytes", size, p.typ, p.flags, len(p.body))
+		}
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	tests := []struct {
+		name  string
+		buf   []byte
+		read  func(d *decoder) string
+		want  string
+		valid bool
+	}{
+		{name: "string", buf: appendString(nil, "topic"), read: (*decoder).string, want: "topic", valid: true},
+		{name: "empty string", buf: appendString(nil, ""), read: (*decoder).string, want: "", valid: true},
+		{name: "short string", buf: []byte{0x00, 0x05, 'a'}, read: (*decoder).string, valid: false},
+		{name: "no length", buf: []byte{0x00}, read: (*decoder).string, valid: false},
+		{
+			name: "fields in order",
+			buf:  append([]byte{0x04}, appendString([]byte{0x00, 0x2a}, "a/b")...),
+			read: func(d *decoder) string {
+				return strings.Join([]string{string(d.byte()), string(rune(d.uint16())), d.string()}, ",")
+			},
+			want:  "\x04,*,a/b",
+			valid: true,
+		},
+		{
+			name: "error sticks",
+			buf:  []byte{0x01},
+			read: func(d *decoder) string {
+				d.uint16()
+				return string(d.byte())
+			},
+			valid: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &decoder{buf: tt.buf}
+			got := tt.read(d)
+			if (d.err == nil) != tt.valid {
+				t.Fatalf("error %v, want valid %v", d.err, tt.valid)
+			}
+			if tt.valid && got != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
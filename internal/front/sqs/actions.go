@@ -0,0 +1,443 @@
+package sqs
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+const (
+	defaultVisibilityTimeout = 30
+	maxVisibilityTimeout     = 12 * 60 * 60
+	maxWaitTimeSeconds       = 20
+	maxNumberOfMessages      = 10
+	maxDelaySeconds          = 15 * 60
+)
+
+type message struct {
+	MessageID              string            `json:"MessageId" xml:"MessageId"`
+	ReceiptHandle          string            `json:"ReceiptHandle" xml:"ReceiptHandle"`
+	MD5OfBody              string            `json:"MD5OfBody" xml:"MD5OfBody"`
+	Body                   string            `json:"Body" xml:"Body"`
+	Attributes             attributes        `json:"Attributes,omitempty" xml:"Attribute"`
+	MD5OfMessageAttributes string            `json:"MD5OfMessageAttributes,omitempty" xml:"MD5OfMessageAttributes,omitempty"`
+	MessageAttributes      messageAttributes `json:"MessageAttributes,omitempty" xml:"MessageAttribute"`
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func appError(err error) error {
+	switch {
+	case errors.Is(err, application.ErrNotReady):
+		return errUnavailable
+	case errors.Is(err, application.ErrNoReceipt):
+		return errInvalidReceipt
+	case errors.Is(err, application.ErrTopicNotFound), errors.Is(err, application.ErrTopicDeleted):
+		return errNoQueue
+	case errors.Is(err, application.ErrTopicFull):
+		return errOverLimit
+	case errors.Is(err, application.ErrQuotaExceeded):
+		return errOverQuota
+	case errors.Is(err, application.ErrMessageTooLarge):
+		return errInvalidParameter("message is too large")
+	case errors.Is(err, application.ErrInvalidHeaders):
+		return errInvalidParameter("too many message attributes or they are too large")
+	case errors.Is(err, application.ErrThrottled):
+		return errThrottled
+	case errors.Is(err, application.ErrInvalidTopic):
+		return errInvalidParameter("invalid queue name")
+	}
+	return err
+}
+
+func visibility(v *int) (time.Duration, error) {
+	if v == nil {
+		return defaultVisibilityTimeout * time.Second, nil
+	}
+	if *v < 0 || *v > maxVisibilityTimeout {
+		return 0, errInvalidParameter("VisibilityTimeout must be between 0 and " + strconv.Itoa(maxVisibilityTimeout))
+	}
+	return time.Duration(*v) * time.Second, nil
+}
+
+func (s *SQS) sendMessage(req *http.Request, r *request) (any, error) {
+	type result struct {
+		MD5OfMessageBody       string `json:"MD5OfMessageBody" xml:"MD5OfMessageBody"`
+		MD5OfMessageAttributes string `json:"MD5OfMessageAttributes,omitempty" xml:"MD5OfMessageAttributes,omitempty"`
+		MessageID              string `json:"MessageId" xml:"MessageId"`
+	}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionSend, topic)
+	if err != nil {
+		return nil, err
+	}
+	if r.MessageBody == "" {
+		return nil, errMissingParameter("MessageBody")
+	}
+	if r.DelaySeconds < 0 || r.DelaySeconds > maxDelaySeconds {
+		return nil, errInvalidParameter("DelaySeconds must be between 0 and " + strconv.Itoa(maxDelaySeconds))
+	}
+
+	im := &messages.InputMessage{
+		Data:           r.MessageBody,
+		Persistent:     true,
+		Delay:          time.Duration(r.DelaySeconds) * time.Second,
+		IdempotencyKey: r.MessageDeduplicationID,
+		Group:          r.MessageGroupID,
+	}
+
+	// message attributes are stored as message headers, so only string values are accepted
+	for name, v := range r.MessageAttributes {
+		if !strings.HasPrefix(v.DataType, "String") && !strings.HasPrefix(v.DataType, "Number") {
+			return nil, errInvalidParameter("message attribute " + name + " has unsupported data type " + v.DataType)
+		}
+		if im.Headers == nil {
+			im.Headers = make(map[string]string, len(r.MessageAttributes))
+		}
+		im.Headers[name] = v.StringValue
+	}
+
+	// a deduplicated message is reported as sent, like SQS FIFO queues do
+	id, errSend := s.app.Send(req.Context(), topic, im)
+	if errSend != nil && !errors.Is(errSend, application.ErrDuplicate) {
+		return nil, appError(errSend)
+	}
+
+	return result{MD5OfMessageBody: md5Hex(r.MessageBody), MD5OfMessageAttributes: r.MessageAttributes.md5(), MessageID: id}, nil
+}
+
+func (s *SQS) receiveMessage(req *http.Request, r *request) (any, error) {
+	type result struct {
+		Messages []message `json:"Messages,omitempty" xml:"Message"`
+	}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionGet, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	maxNumber := r.MaxNumberOfMessages
+	if maxNumber == 0 {
+		maxNumber = 1
+	}
+	if maxNumber < 1 || maxNumber > maxNumberOfMessages {
+		return nil, errInvalidParameter("MaxNumberOfMessages must be between 1 and " + strconv.Itoa(maxNumberOfMessages))
+	}
+
+	wait := 0
+	if r.WaitTimeSeconds != nil {
+		wait = *r.WaitTimeSeconds
+	}
+	if wait < 0 || wait > maxWaitTimeSeconds {
+		return nil, errInvalidParameter("WaitTimeSeconds must be between 0 and " + strconv.Itoa(maxWaitTimeSeconds))
+	}
+
+	vis, err := visibility(r.VisibilityTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first message is awaited up to WaitTimeSeconds, the rest are taken only if they are already available
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(wait)*time.Second)
+	defer cancel()
+
+	res := result{}
+	for len(res.Messages) < maxNumber {
+		om, receipt, errReserve := s.app.Reserve(ctx, topic, vis)
+		// the messages already reserved are returned when the rate limit is reached in the middle
+		if errors.Is(errReserve, application.ErrThrottled) && len(res.Messages) > 0 {
+			break
+		}
+		if errReserve != nil {
+			return nil, appError(errReserve)
+		}
+		if om == nil {
+			break
+		}
+
+		attrs := selectMessageAttributes(om, r.MessageAttributeNames)
+		res.Messages = append(res.Messages, message{
+			MessageID:              om.ID,
+			ReceiptHandle:          receipt,
+			MD5OfBody:              md5Hex(om.Data),
+			Body:                   om.Data,
+			Attributes:             systemAttributes(om, r.AttributeNames),
+			MD5OfMessageAttributes: attrs.md5(),
+			MessageAttributes:      attrs,
+		})
+
+		cancel()
+	}
+
+	return res, nil
+}
+
+func systemAttributes(om *messages.OutputMessage, names []string) attributes {
+	if len(names) == 0 {
+		return nil
+	}
+
+	all := attributes{}
+	if om.Name != "" {
+		all["SenderId"] = om.Name
+	}
+	if om.Group != "" {
+		all["MessageGroupId"] = om.Group
+	}
+
+	attrs := attributes{}
+	for _, name := range names {
+		if name == "All" {
+			return all
+		}
+		if v, ok := all[name]; ok {
+			attrs[name] = v
+		}
+	}
+
+	return attrs
+}
+
+// selectMessageAttributes returns headers requested by name, All, .* or prefix.* patterns
+func selectMessageAttributes(om *messages.OutputMessage, names []string) messageAttributes {
+	if len(names) == 0 || len(om.Headers) == 0 {
+		return nil
+	}
+
+	var attrs messageAttributes
+	for k, v := range om.Headers {
+		for _, name := range names {
+			prefix, wildcard := strings.CutSuffix(name, ".*")
+			if name == "All" || k == name || wildcard && strings.HasPrefix(k, prefix) {
+				if attrs == nil {
+					attrs = messageAttributes{}
+				}
+				attrs[k] = messageAttributeValue{DataType: "String", StringValue: v}
+				break
+			}
+		}
+	}
+
+	return attrs
+}
+
+func (s *SQS) deleteMessage(req *http.Request, r *request) (any, error) {
+	type result struct{}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionGet, topic)
+	if err != nil {
+		return nil, err
+	}
+	if r.ReceiptHandle == "" {
+		return nil, errMissingParameter("ReceiptHandle")
+	}
+
+	errAck := s.app.Ack(req.Context(), topic, r.ReceiptHandle)
+	if errAck != nil {
+		return nil, appError(errAck)
+	}
+
+	return result{}, nil
+}
+
+func (s *SQS) changeMessageVisibility(req *http.Request, r *request) (any, error) {
+	type result struct{}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionGet, topic)
+	if err != nil {
+		return nil, err
+	}
+	if r.ReceiptHandle == "" {
+		return nil, errMissingParameter("ReceiptHandle")
+	}
+	if r.VisibilityTimeout == nil {
+		return nil, errMissingParameter("VisibilityTimeout")
+	}
+
+	vis, err := visibility(r.VisibilityTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// zero visibility makes the message available right away
+	if vis == 0 {
+		err = s.app.Release(req.Context(), topic, r.ReceiptHandle, 0)
+	} else {
+		err = s.app.Touch(req.Context(), topic, r.ReceiptHandle, vis)
+	}
+	if err != nil {
+		return nil, appError(err)
+	}
+
+	return result{}, nil
+}
+
+func (s *SQS) getQueueAttributes(req *http.Request, r *request) (any, error) {
+	type result struct {
+		Attributes attributes `json:"Attributes" xml:"Attribute"`
+	}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionGet, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	info, errDescribe := s.app.Describe(req.Context(), topic)
+	if errDescribe != nil {
+		return nil, appError(errDescribe)
+	}
+
+	all := attributes{
+		"ApproximateNumberOfMessages":           strconv.Itoa(info.Messages),
+		"ApproximateNumberOfMessagesNotVisible": strconv.Itoa(info.InFlight),
+		"ApproximateNumberOfMessagesDelayed":    strconv.Itoa(info.Delayed),
+		"VisibilityTimeout":                     strconv.Itoa(defaultVisibilityTimeout),
+		"DelaySeconds":                          "0",
+		"ReceiveMessageWaitTimeSeconds":         "0",
+		"QueueArn":                              "arn:aws:sqs:local:000000000000:" + topic,
+	}
+
+	res := result{Attributes: attributes{}}
+	for _, name := range r.AttributeNames {
+		if name == "All" {
+			res.Attributes = all
+			break
+		}
+		if v, ok := all[name]; ok {
+			res.Attributes[name] = v
+		}
+	}
+
+	return res, nil
+}
+
+type queueURLResult struct {
+	QueueURL string `json:"QueueUrl" xml:"QueueUrl"`
+}
+
+func (s *SQS) createQueue(req *http.Request, r *request) (any, error) {
+	if r.QueueName == "" {
+		return nil, errMissingParameter("QueueName")
+	}
+	if strings.ContainsRune(r.QueueName, '/') {
+		return nil, errInvalidParameter("invalid queue name")
+	}
+	errAllow := s.allow(req, config.ActionAdmin, r.QueueName)
+	if errAllow != nil {
+		return nil, errAllow
+	}
+
+	_, err := s.app.CreateTopic(req.Context(), r.QueueName)
+	if err != nil {
+		return nil, appError(err)
+	}
+
+	return queueURLResult{QueueURL: queueURL(req, r.QueueName)}, nil
+}
+
+// getQueueURL only builds the url, topics are created on first use, so unknown ones are not an error.
+// The url is given to principals with any action on the queue, like ListQueues shows it.
+func (s *SQS) getQueueURL(req *http.Request, r *request) (any, error) {
+	if r.QueueName == "" {
+		return nil, errMissingParameter("QueueName")
+	}
+	if strings.ContainsRune(r.QueueName, '/') {
+		return nil, errInvalidParameter("invalid queue name")
+	}
+	if principal := auth.Principal(req.Context()); !s.acl.Visible(principal, r.QueueName) {
+		slog.Warn("sqs request denied", slog.String("principal", principal), slog.String("action", "GetQueueUrl"), slog.String("topic", r.QueueName))
+		return nil, errAccessDenied
+	}
+
+	return queueURLResult{QueueURL: queueURL(req, r.QueueName)}, nil
+}
+
+func (s *SQS) purgeQueue(req *http.Request, r *request) (any, error) {
+	type result struct{}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionAdmin, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	_, errPurge := s.app.PurgeTopic(req.Context(), topic)
+	if errPurge != nil {
+		return nil, appError(errPurge)
+	}
+
+	return result{}, nil
+}
+
+func (s *SQS) deleteQueue(req *http.Request, r *request) (any, error) {
+	type result struct{}
+
+	topic, err := topicFromURL(r.QueueURL)
+	if err != nil {
+		return nil, err
+	}
+	err = s.allow(req, config.ActionAdmin, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	errDelete := s.app.DeleteTopic(req.Context(), topic)
+	if errDelete != nil {
+		return nil, appError(errDelete)
+	}
+
+	return result{}, nil
+}
+
+func (s *SQS) listQueues(req *http.Request, r *request) (any, error) {
+	type result struct {
+		QueueURLs []string `json:"QueueUrls,omitempty" xml:"QueueUrl"`
+	}
+
+	res := result{}
+	for _, topic := range s.app.Topics(req.Context()) {
+		if !strings.HasPrefix(topic, r.QueueNamePrefix) || !s.acl.Visible(auth.Principal(req.Context()), topic) {
+			continue
+		}
+		res.QueueURLs = append(res.QueueURLs, queueURL(req, topic))
+	}
+
+	return res, nil
+}
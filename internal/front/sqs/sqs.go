@@ -0,0 +1,566 @@
+package sqs
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/front"
+)
+
+const (
+	xmlNamespace = "http://queue.amazonaws.com/doc/2012-11-05/"
+	targetPrefix = "AmazonSQS."
+	queuePath    = "/queue/"
+)
+
+type backend interface {
+	front.LeaseApplication
+	front.TopicApplication
+	front.LimitApplication
+}
+
+// SQS emulates the subset of Amazon SQS API, both JSON (X-Amz-Target) and query (Action=) protocols are supported
+type SQS struct {
+	app    backend
+	tokens *auth.Tokens
+	acl    *auth.ACL
+}
+
+func New(app backend, tokens *auth.Tokens, acl *auth.ACL) *SQS {
+	return &SQS{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+	}
+}
+
+type apiError struct {
+	status  int
+	code    string
+	jsonTyp string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func errInvalidParameter(message string) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: "InvalidParameterValue", jsonTyp: "InvalidParameterValue", message: message}
+}
+
+func errMissingParameter(name string) *apiError {
+	return &apiError{status: http.StatusBadRequest, code: "MissingParameter", jsonTyp: "MissingParameter", message: "the request must contain the parameter " + name}
+}
+
+var (
+	errInvalidAction  = &apiError{status: http.StatusBadRequest, code: "InvalidAction", jsonTyp: "InvalidAction", message: "the action is not supported"}
+	errInvalidReceipt = &apiError{status: http.StatusBadRequest, code: "ReceiptHandleIsInvalid", jsonTyp: "ReceiptHandleIsInvalid", message: "the receipt handle is invalid or expired"}
+	errInvalidRequest = &apiError{status: http.StatusBadRequest, code: "MalformedQueryString", jsonTyp: "InvalidParameterValue", message: "malformed request"}
+	errUnavailable    = &apiError{status: http.StatusServiceUnavailable, code: "ServiceUnavailable", jsonTyp: "ServiceUnavailable", message: "service unavailable"}
+	errNoQueue        = &apiError{status: http.StatusBadRequest, code: "AWS.SimpleQueueService.NonExistentQueue", jsonTyp: "QueueDoesNotExist", message: "the specified queue does not exist"}
+	errOverLimit      = &apiError{status: http.StatusForbidden, code: "OverLimit", jsonTyp: "OverLimit", message: "the queue has the maximum number of messages"}
+	errOverQuota      = &apiError{status: http.StatusForbidden, code: "OverLimit", jsonTyp: "OverLimit", message: "tenant quota exceeded"}
+	errAccessDenied   = &apiError{status: http.StatusForbidden, code: "AccessDenied", jsonTyp: "AccessDeniedException", message: "access to the queue is denied"}
+	errUnauthorized   = &apiError{status: http.StatusForbidden, code: "InvalidClientTokenId", jsonTyp: "UnrecognizedClientException", message: "the security token included in the request is invalid"}
+	errThrottled      = &apiError{status: http.StatusBadRequest, code: "RequestThrottled", jsonTyp: "ThrottlingException", message: "rate exceeded"}
+	errTooLarge       = &apiError{status: http.StatusRequestEntityTooLarge, code: "RequestEntityTooLarge", jsonTyp: "RequestEntityTooLarge", message: "the request is too large"}
+	errInternal       = &apiError{status: http.StatusInternalServerError, code: "InternalFailure", jsonTyp: "InternalFailure", message: "internal error"}
+)
+
+func (s *SQS) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
+	defer wg.Done()
+
+	server := &http.Server{Handler: http.HandlerFunc(s.handler)}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		slog.Info("shutting down sqs server")
+		errShutdown := server.Shutdown(context.Background())
+		if errShutdown != nil {
+			if errors.Is(errShutdown, context.Canceled) {
+				return
+			}
+			slog.Error("error shutdown sqs server", slog.String("error", errShutdown.Error()))
+		}
+	}()
+
+	slog.Info("start sqs server", slog.String("addr", ln.Addr().String()))
+	err := server.Serve(ln)
+	if err != nil {
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("error serve sqs server", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// authenticate returns the principal of the client certificate or of the token.
+// The token is passed as Authorization: Bearer or as the access key ID of the AWS signature, the signature itself
+// is not verified, as only hashes of tokens are known, so the token must be protected by TLS.
+func (s *SQS) authenticate(req *http.Request) (string, bool) {
+	if principal, ok := auth.CertificatePrincipal(req.TLS); ok {
+		return principal, true
+	}
+	if !s.tokens.Enabled() {
+		return "", true
+	}
+
+	header := req.Header.Get("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		_, credential, _ := strings.Cut(header, "Credential=")
+		token, _, _ = strings.Cut(credential, "/")
+	}
+	if token == "" {
+		return "", false
+	}
+
+	return s.tokens.Authenticate(token)
+}
+
+// allow checks the action on the topic against the ACL for the principal of the request
+func (s *SQS) allow(req *http.Request, action string, topic string) error {
+	principal := auth.Principal(req.Context())
+	if s.acl.Allowed(principal, action, topic) {
+		return nil
+	}
+
+	slog.Warn("sqs request denied", slog.String("principal", principal), slog.String("action", action), slog.String("topic", topic))
+
+	return errAccessDenied
+}
+
+func (s *SQS) handler(rw http.ResponseWriter, req *http.Request) {
+	requestID := rand.Text()
+
+	principal, authenticated := s.authenticate(req)
+	if !authenticated {
+		slog.Warn("sqs request not authenticated", slog.String("remote", req.RemoteAddr))
+		if req.Header.Get("X-Amz-Target") != "" {
+			sendJSONError(rw, requestID, errUnauthorized)
+		} else {
+			sendXMLError(rw, requestID, errUnauthorized)
+		}
+		return
+	}
+	req = req.WithContext(auth.WithPrincipal(req.Context(), principal))
+
+	if limit := front.MaxRequestSize(s.app); limit > 0 {
+		req.Body = http.MaxBytesReader(rw, req.Body, limit)
+	}
+
+	if target := req.Header.Get("X-Amz-Target"); target != "" {
+		action := strings.TrimPrefix(target, targetPrefix)
+
+		r := request{}
+		errDecode := json.NewDecoder(req.Body).Decode(&r)
+		if errDecode != nil {
+			sendJSONError(rw, requestID, bodyError(errDecode))
+			return
+		}
+
+		result, err := s.call(req, action, &r)
+		if err != nil {
+			sendJSONError(rw, requestID, toAPIError(err))
+			return
+		}
+
+		sendJSON(rw, requestID, result)
+		return
+	}
+
+	errParse := req.ParseForm()
+	if errParse != nil {
+		sendXMLError(rw, requestID, bodyError(errParse))
+		return
+	}
+
+	action := req.Form.Get("Action")
+	r, errRequest := requestFromForm(req.Form)
+	if errRequest != nil {
+		sendXMLError(rw, requestID, toAPIError(errRequest))
+		return
+	}
+
+	result, err := s.call(req, action, r)
+	if err != nil {
+		sendXMLError(rw, requestID, toAPIError(err))
+		return
+	}
+
+	sendXML(rw, requestID, action, result)
+}
+
+func (s *SQS) call(req *http.Request, action string, r *request) (any, error) {
+	switch action {
+	case "SendMessage":
+		return s.sendMessage(req, r)
+	case "ReceiveMessage":
+		return s.receiveMessage(req, r)
+	case "DeleteMessage":
+		return s.deleteMessage(req, r)
+	case "ChangeMessageVisibility":
+		return s.changeMessageVisibility(req, r)
+	case "GetQueueAttributes":
+		return s.getQueueAttributes(req, r)
+	case "CreateQueue":
+		return s.createQueue(req, r)
+	case "GetQueueUrl":
+		return s.getQueueURL(req, r)
+	case "ListQueues":
+		return s.listQueues(req, r)
+	case "PurgeQueue":
+		return s.purgeQueue(req, r)
+	case "DeleteQueue":
+		return s.deleteQueue(req, r)
+	default:
+		return nil, errInvalidAction
+	}
+}
+
+// bodyError returns errTooLarge if the body is over the size limit and errInvalidRequest for other read errors
+func bodyError(err error) *apiError {
+	var errMaxBytes *http.MaxBytesError
+	if errors.As(err, &errMaxBytes) {
+		metrics.GetOrCreateCounter("ssqueue_requests_too_large").Inc()
+		return errTooLarge
+	}
+
+	return errInvalidRequest
+}
+
+func toAPIError(err error) *apiError {
+	var e *apiError
+	if errors.As(err, &e) {
+		return e
+	}
+	slog.Error("error process sqs request", slog.String("error", err.Error()))
+	return errInternal
+}
+
+// queueURL builds the queue url from the host the client used to reach the server
+func queueURL(req *http.Request, topic string) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + queuePath + topic
+}
+
+// topicFromURL accepts both our own urls and AWS style ones with account id, the last path element is the topic
+func topicFromURL(queueURL string) (string, error) {
+	if queueURL == "" {
+		return "", errMissingParameter("QueueUrl")
+	}
+	queueURL = strings.TrimRight(queueURL, "/")
+	idx := strings.LastIndexByte(queueURL, '/')
+	topic := queueURL[idx+1:]
+	if topic == "" {
+		return "", errInvalidParameter("invalid queue url")
+	}
+	return topic, nil
+}
+
+func sendJSON(rw http.ResponseWriter, requestID string, v any) {
+	data, errEncode := json.Marshal(v)
+	if errEncode != nil {
+		slog.Error("error encode sqs response", slog.String("error", errEncode.Error()))
+		sendJSONError(rw, requestID, errInternal)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	rw.Header().Set("X-Amzn-Requestid", requestID)
+	rw.WriteHeader(http.StatusOK)
+	_, errWrite := rw.Write(data)
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}
+
+func sendJSONError(rw http.ResponseWriter, requestID string, e *apiError) {
+	type response struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+
+	data, _ := json.Marshal(response{Type: "com.amazonaws.sqs#" + e.jsonTyp, Message: e.message})
+
+	rw.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	rw.Header().Set("X-Amzn-Requestid", requestID)
+	rw.Header().Set("X-Amzn-Query-Error", e.code+";Sender")
+	rw.WriteHeader(e.status)
+	_, errWrite := rw.Write(data)
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}
+
+func sendXML(rw http.ResponseWriter, requestID string, action string, v any) {
+	type metadata struct {
+		RequestID string `xml:"RequestId"`
+	}
+
+	var buf strings.Builder
+	enc := xml.NewEncoder(&buf)
+
+	start := xml.StartElement{Name: xml.Name{Local: action + "Response"}, Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: xmlNamespace}}}
+	errEncode := enc.EncodeToken(start)
+	if errEncode == nil {
+		errEncode = enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: action + "Result"}})
+	}
+	if errEncode == nil {
+		errEncode = enc.EncodeElement(metadata{RequestID: requestID}, xml.StartElement{Name: xml.Name{Local: "ResponseMetadata"}})
+	}
+	if errEncode == nil {
+		errEncode = enc.EncodeToken(start.End())
+	}
+	if errEncode == nil {
+		errEncode = enc.Flush()
+	}
+	if errEncode != nil {
+		slog.Error("error encode sqs response", slog.String("error", errEncode.Error()))
+		sendXMLError(rw, requestID, errInternal)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "text/xml")
+	rw.WriteHeader(http.StatusOK)
+	_, errWrite := rw.Write([]byte(xml.Header + buf.String()))
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}
+
+func sendXMLError(rw http.ResponseWriter, requestID string, e *apiError) {
+	type errorBody struct {
+		Type    string `xml:"Type"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	type response struct {
+		XMLName   xml.Name  `xml:"ErrorResponse"`
+		Error     errorBody `xml:"Error"`
+		RequestID string    `xml:"RequestId"`
+	}
+
+	data, _ := xml.Marshal(response{Error: errorBody{Type: "Sender", Code: e.code, Message: e.message}, RequestID: requestID})
+
+	rw.Header().Set("Content-Type", "text/xml")
+	rw.WriteHeader(e.status)
+	_, errWrite := rw.Write(append([]byte(xml.Header), data...))
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}
+
+// attributes are encoded as a JSON object and as a list of Attribute elements in XML
+type attributes map[string]string
+
+func (a attributes) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	type attribute struct {
+		Name  string `xml:"Name"`
+		Value string `xml:"Value"`
+	}
+
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := enc.EncodeElement(attribute{Name: name, Value: a[name]}, start)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type messageAttributeValue struct {
+	DataType    string `json:"DataType" xml:"DataType"`
+	StringValue string `json:"StringValue,omitempty" xml:"StringValue,omitempty"`
+	BinaryValue []byte `json:"BinaryValue,omitempty" xml:"-"`
+}
+
+// messageAttributes are encoded as a JSON object and as a list of MessageAttribute elements in XML
+type messageAttributes map[string]messageAttributeValue
+
+func (a messageAttributes) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	type attribute struct {
+		Name  string                `xml:"Name"`
+		Value messageAttributeValue `xml:"Value"`
+	}
+
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		err := enc.EncodeElement(attribute{Name: name, Value: a[name]}, start)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// md5 follows the algorithm of AWS SDKs, which verify the digest of attributes
+func (a messageAttributes) md5() string {
+	if len(a) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := md5.New()
+	appendValue := func(b []byte) {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(b)))
+		h.Write(b)
+	}
+	for _, name := range names {
+		v := a[name]
+		appendValue([]byte(name))
+		appendValue([]byte(v.DataType))
+		// transport type 1 is string, it is used for String and Number data types
+		h.Write([]byte{1})
+		appendValue([]byte(v.StringValue))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// request is the union of the parameters of supported actions
+type request struct {
+	QueueName           string   `json:"QueueName"`
+	QueueNamePrefix     string   `json:"QueueNamePrefix"`
+	QueueURL            string   `json:"QueueUrl"`
+	MessageBody         string   `json:"MessageBody"`
+	DelaySeconds        int      `json:"DelaySeconds"`
+	MaxNumberOfMessages int      `json:"MaxNumberOfMessages"`
+	VisibilityTimeout   *int     `json:"VisibilityTimeout"`
+	WaitTimeSeconds     *int     `json:"WaitTimeSeconds"`
+	ReceiptHandle       string   `json:"ReceiptHandle"`
+	AttributeNames      []string `json:"AttributeNames"`
+
+	MessageDeduplicationID string `json:"MessageDeduplicationId"`
+	MessageGroupID         string `json:"MessageGroupId"`
+
+	MessageAttributes     messageAttributes `json:"MessageAttributes"`
+	MessageAttributeNames []string          `json:"MessageAttributeNames"`
+}
+
+func requestFromForm(form map[string][]string) (*request, error) {
+	get := func(name string) string {
+		if v := form[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	getInt := func(name string) (*int, error) {
+		v := get(name)
+		if v == "" {
+			return nil, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, errInvalidParameter("invalid value for the parameter " + name)
+		}
+		return &n, nil
+	}
+
+	r := &request{
+		QueueName:       get("QueueName"),
+		QueueNamePrefix: get("QueueNamePrefix"),
+		QueueURL:        get("QueueUrl"),
+		MessageBody:     get("MessageBody"),
+		ReceiptHandle:   get("ReceiptHandle"),
+
+		MessageDeduplicationID: get("MessageDeduplicationId"),
+		MessageGroupID:         get("MessageGroupId"),
+	}
+
+	var err error
+	if r.VisibilityTimeout, err = getInt("VisibilityTimeout"); err != nil {
+		return nil, err
+	}
+	if r.WaitTimeSeconds, err = getInt("WaitTimeSeconds"); err != nil {
+		return nil, err
+	}
+	delay, err := getInt("DelaySeconds")
+	if err != nil {
+		return nil, err
+	}
+	if delay != nil {
+		r.DelaySeconds = *delay
+	}
+	maxNumber, err := getInt("MaxNumberOfMessages")
+	if err != nil {
+		return nil, err
+	}
+	if maxNumber != nil {
+		r.MaxNumberOfMessages = *maxNumber
+	}
+
+	for i := 1; ; i++ {
+		name := get("AttributeName." + strconv.Itoa(i))
+		if name == "" {
+			break
+		}
+		r.AttributeNames = append(r.AttributeNames, name)
+	}
+
+	for i := 1; ; i++ {
+		name := get("MessageAttributeName." + strconv.Itoa(i))
+		if name == "" {
+			break
+		}
+		r.MessageAttributeNames = append(r.MessageAttributeNames, name)
+	}
+
+	for i := 1; ; i++ {
+		prefix := "MessageAttribute." + strconv.Itoa(i)
+		name := get(prefix + ".Name")
+		if name == "" {
+			break
+		}
+		if r.MessageAttributes == nil {
+			r.MessageAttributes = messageAttributes{}
+		}
+		r.MessageAttributes[name] = messageAttributeValue{
+			DataType:    get(prefix + ".Value.DataType"),
+			StringValue: get(prefix + ".Value.StringValue"),
+			BinaryValue: []byte(get(prefix + ".Value.BinaryValue")),
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,271 @@
+package sqs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application/apptest"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func TestRequestFromForm(t *testing.T) {
+	tests := []struct {
+		name string
+		form url.Values
+		want *request
+		err  string
+	}{
+		{
+			name: "send message",
+			form: url.Values{
+				"QueueUrl":       {"http://localhost/queue/orders"},
+				"MessageBody":    {"hello"},
+				"DelaySeconds":   {"5"},
+				"MessageGroupId": {"customer-1"},
+
+				"MessageAttribute.1.Name":              {"color"},
+				"MessageAttribute.1.Value.DataType":    {"String"},
+				"MessageAttribute.1.Value.StringValue": {"red"},
+			},
+			want: &request{
+				QueueURL:       "http://localhost/queue/orders",
+				MessageBody:    "hello",
+				DelaySeconds:   5,
+				MessageGroupID: "customer-1",
+				MessageAttributes: messageAttributes{
+					"color": {DataType: "String", StringValue: "red", BinaryValue: []byte{}},
+				},
+			},
+		},
+		{
+			name: "receive message",
+			form: url.Values{
+				"QueueUrl":               {"q"},
+				"MaxNumberOfMessages":    {"10"},
+				"VisibilityTimeout":      {"0"},
+				"WaitTimeSeconds":        {"20"},
+				"AttributeName.1":        {"All"},
+				"AttributeName.2":        {"ApproximateReceiveCount"},
+				"MessageAttributeName.1": {"color"},
+				// numbering must be continuous, the gap ends the list
+				"AttributeName.4": {"SentTimestamp"},
+			},
+			want: &request{
+				QueueURL:              "q",
+				MaxNumberOfMessages:   10,
+				VisibilityTimeout:     intPtr(0),
+				WaitTimeSeconds:       intPtr(20),
+				AttributeNames:        []string{"All", "ApproximateReceiveCount"},
+				MessageAttributeNames: []string{"color"},
+			},
+		},
+		{name: "empty", form: url.Values{}, want: &request{}},
+		{name: "bad visibility", form: url.Values{"VisibilityTimeout": {"soon"}}, err: "VisibilityTimeout"},
+		{name: "bad wait", form: url.Values{"WaitTimeSeconds": {"1.5"}}, err: "WaitTimeSeconds"},
+		{name: "bad delay", form: url.Values{"DelaySeconds": {"x"}}, err: "DelaySeconds"},
+		{name: "bad max number", form: url.Values{"MaxNumberOfMessages": {"-"}}, err: "MaxNumberOfMessages"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := requestFromForm(tt.form)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want one about %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r, tt.want) {
+				t.Errorf("request %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopicFromURL(t *testing.T) {
+	tests := []struct {
+		url   string
+		topic string
+		valid bool
+	}{
+		{url: "http://localhost:9324/queue/orders", topic: "orders", valid: true},
+		{url: "https://sqs.eu-west-1.amazonaws.com/123456789012/orders", topic: "orders", valid: true},
+		{url: "http://localhost/queue/orders/", topic: "orders", valid: true},
+		{url: "orders", topic: "orders", valid: true},
+		{url: "", valid: false},
+		{url: "http://localhost/queue/", topic: "queue", valid: true},
+		{url: "/", valid: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			topic, err := topicFromURL(tt.url)
+			if (err == nil) != tt.valid || topic != tt.topic {
+				t.Errorf("topic %q error %v, want %q valid %v", topic, err, tt.topic, tt.valid)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	tokens := auth.NewTokens()
+	tokens.Set([]config.Token{{Name: "bob", SHA256: hex.EncodeToString(sum[:])}})
+
+	tests := []struct {
+		name      string
+		tokens    *auth.Tokens
+		header    string
+		principal string
+		ok        bool
+	}{
+		{name: "open without tokens", tokens: auth.NewTokens(), header: "", principal: "", ok: true},
+		{name: "bearer", tokens: tokens, header: "Bearer secret", principal: "bob", ok: true},
+		{
+			name:      "signature credential",
+			tokens:    tokens,
+			header:    "AWS4-HMAC-SHA256 Credential=secret/20260101/us-east-1/sqs/aws4_request, SignedHeaders=host, Signature=abc",
+			principal: "bob",
+			ok:        true,
+		},
+		{name: "wrong token", tokens: tokens, header: "Bearer other", ok: false},
+		{name: "empty credential", tokens: tokens, header: "AWS4-HMAC-SHA256 Credential=/20260101", ok: false},
+		{name: "no header", tokens: tokens, header: "", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(nil, tt.tokens, auth.NewACL(nil))
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			principal, ok := s.authenticate(req)
+			if principal != tt.principal || ok != tt.ok {
+				t.Errorf("principal %q ok %v, want %q %v", principal, ok, tt.principal, tt.ok)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	type call struct {
+		target string
+		form   url.Values
+		body   string
+		status int
+		// contains is a part of the expected response
+		contains string
+	}
+
+	tests := []struct {
+		name   string
+		rules  []config.ACLRule
+		limits []config.RateLimit
+		// topics are created before the calls
+		topics []string
+		calls  []call
+	}{
+		{
+			name: "query protocol",
+			calls: []call{
+				{form: url.Values{"Action": {"CreateQueue"}, "QueueName": {"orders"}}, status: http.StatusOK, contains: "<QueueUrl>http://sqs.test/queue/orders</QueueUrl>"},
+				{form: url.Values{"Action": {"SendMessage"}, "QueueUrl": {"/queue/orders"}, "MessageBody": {"hello"}}, status: http.StatusOK, contains: "<MD5OfMessageBody>5d41402abc4b2a76b9719d911017c592</MD5OfMessageBody>"},
+				{form: url.Values{"Action": {"ReceiveMessage"}, "QueueUrl": {"/queue/orders"}}, status: http.StatusOK, contains: "<Body>hello</Body>"},
+				{form: url.Values{"Action": {"ListQueues"}}, status: http.StatusOK, contains: "/queue/orders</QueueUrl>"},
+			},
+		},
+		{
+			name: "json protocol",
+			calls: []call{
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"hello"}`, status: http.StatusOK, contains: `"MD5OfMessageBody":"5d41402abc4b2a76b9719d911017c592"`},
+				{target: "ReceiveMessage", body: `{"QueueUrl":"/queue/orders","VisibilityTimeout":60}`, status: http.StatusOK, contains: `"Body":"hello"`},
+				{target: "ReceiveMessage", body: `{"QueueUrl":"/queue/orders"}`, status: http.StatusOK, contains: `{}`},
+			},
+		},
+		{
+			name: "errors",
+			calls: []call{
+				{form: url.Values{"Action": {"Unknown"}}, status: http.StatusBadRequest, contains: "<Code>InvalidAction</Code>"},
+				{form: url.Values{"Action": {"SendMessage"}, "QueueUrl": {"/queue/orders"}}, status: http.StatusBadRequest, contains: "MissingParameter"},
+				{target: "SendMessage", body: `{"QueueUrl":`, status: http.StatusBadRequest, contains: "InvalidParameterValue"},
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"` + strings.Repeat("x", 65) + `"}`, status: http.StatusBadRequest, contains: "message is too large"},
+				{target: "ReceiveMessage", body: `{"QueueUrl":"/queue/orders","MaxNumberOfMessages":11}`, status: http.StatusBadRequest, contains: "MaxNumberOfMessages"},
+				{target: "DeleteMessage", body: `{"QueueUrl":"/queue/orders","ReceiptHandle":"nope"}`, status: http.StatusBadRequest, contains: "ReceiptHandleIsInvalid"},
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/a\"b","MessageBody":"hello"}`, status: http.StatusBadRequest, contains: "invalid queue name"},
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"` + strings.Repeat("x", 70*1024) + `"}`, status: http.StatusRequestEntityTooLarge, contains: "RequestEntityTooLarge"},
+			},
+		},
+		{
+			name:   "acl",
+			rules:  []config.ACLRule{{Principal: "*", Topics: []string{"orders"}, Actions: []string{config.ActionSend}}},
+			topics: []string{"payments"},
+			calls: []call{
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"hello"}`, status: http.StatusOK, contains: "MessageId"},
+				{target: "ReceiveMessage", body: `{"QueueUrl":"/queue/orders"}`, status: http.StatusForbidden, contains: "AccessDeniedException"},
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/payments","MessageBody":"hello"}`, status: http.StatusForbidden, contains: "AccessDeniedException"},
+				{target: "CreateQueue", body: `{"QueueName":"orders"}`, status: http.StatusForbidden, contains: "AccessDeniedException"},
+				{target: "GetQueueUrl", body: `{"QueueName":"orders"}`, status: http.StatusOK, contains: "/queue/orders"},
+				{target: "GetQueueUrl", body: `{"QueueName":"payments"}`, status: http.StatusForbidden, contains: "AccessDeniedException"},
+				{target: "ListQueues", body: `{}`, status: http.StatusOK, contains: `{"QueueUrls":["http://sqs.test/queue/orders"]}`},
+			},
+		},
+		{
+			name:   "rate limits",
+			limits: []config.RateLimit{{Topic: "orders", Action: config.ActionSend, Rate: 1}},
+			calls: []call{
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"hello"}`, status: http.StatusOK, contains: "MessageId"},
+				{target: "SendMessage", body: `{"QueueUrl":"/queue/orders","MessageBody":"hello"}`, status: http.StatusBadRequest, contains: "ThrottlingException"},
+				{target: "ReceiveMessage", body: `{"QueueUrl":"/queue/orders"}`, status: http.StatusOK, contains: `"Body":"hello"`},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := apptest.Run(t, &config.Config{MaxMessageSize: 64, DedupWindow: time.Minute}, tt.limits...)
+			acl := auth.NewACL(nil)
+			acl.Set(tt.rules)
+			s := New(app, auth.NewTokens(), acl)
+			for _, topic := range tt.topics {
+				if _, errCreate := app.CreateTopic(context.Background(), topic); errCreate != nil {
+					t.Fatal(errCreate)
+				}
+			}
+
+			for i, c := range tt.calls {
+				var req *http.Request
+				if c.target != "" {
+					req = httptest.NewRequest(http.MethodPost, "http://sqs.test/", strings.NewReader(c.body))
+					req.Header.Set("X-Amz-Target", targetPrefix+c.target)
+				} else {
+					req = httptest.NewRequest(http.MethodPost, "http://sqs.test/", strings.NewReader(c.form.Encode()))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+				}
+				rw := httptest.NewRecorder()
+				s.handler(rw, req)
+
+				if rw.Code != c.status || !strings.Contains(rw.Body.String(), c.contains) {
+					t.Errorf("call %d: %d %s, want %d with %s", i, rw.Code, rw.Body.String(), c.status, c.contains)
+				}
+			}
+		})
+	}
+}
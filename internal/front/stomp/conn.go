@@ -0,0 +1,570 @@
+package stomp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+const (
+	protocolVersion = "1.2"
+
+	ackAuto             = "auto"
+	ackClient           = "client"
+	ackClientIndividual = "client-individual"
+
+	// messages delivered in client ack modes stay leased while the connection is alive
+	leaseTimeout  = time.Minute
+	leaseRenewal  = time.Second * 20
+	maxPrefetch   = 1024
+	writeDeadline = time.Second * 10
+)
+
+var protocolHeaders = map[string]struct{}{
+	"destination":     {},
+	"receipt":         {},
+	"content-length":  {},
+	"content-type":    {},
+	"transaction":     {},
+	"persistent":      {},
+	"idempotency-key": {},
+	"reply-to":        {},
+	"correlation-id":  {},
+	"subscription":    {},
+	"message-id":      {},
+	"ack":             {},
+}
+
+type subscription struct {
+	id          string
+	destination string
+	topic       string
+	ack         string
+	cancel      context.CancelFunc
+	done        chan struct{}
+	// slots limit the number of unacknowledged messages
+	slots chan struct{}
+	// pending receipts in delivery order
+	pending []string
+}
+
+type conn struct {
+	app       backend
+	tokens    *auth.Tokens
+	acl       *auth.ACL
+	nc        net.Conn
+	r         *bufio.Reader
+	wMu       sync.Mutex
+	w         *bufio.Writer
+	connected bool
+	login     string
+	principal string
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+	acks map[string]*subscription
+}
+
+func newConn(app backend, tokens *auth.Tokens, acl *auth.ACL, nc net.Conn) *conn {
+	return &conn{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+		nc:     nc,
+		r:      bufio.NewReader(nc),
+		w:      bufio.NewWriter(nc),
+		subs:   make(map[string]*subscription),
+		acks:   make(map[string]*subscription),
+	}
+}
+
+// protocolError is sent to the client as ERROR frame and closes the connection
+type protocolError struct {
+	message string
+}
+
+func (e *protocolError) Error() string {
+	return e.message
+}
+
+func errProtocol(message string) error {
+	return &protocolError{message: message}
+}
+
+// recoverPanic logs a panic of a connection goroutine and closes the connection instead of crashing the server
+func (c *conn) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	slog.Error("panic in stomp connection", slog.String("remote", c.nc.RemoteAddr().String()), slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+	_ = c.nc.Close()
+}
+
+func (c *conn) serve(ctx context.Context) {
+	defer c.recoverPanic()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		cancel()
+		c.unsubscribeAll()
+		_ = c.nc.Close()
+	}()
+
+	go func() {
+		<-ctx.Done()
+		_ = c.nc.Close()
+	}()
+
+	go c.renewLeases(ctx)
+
+	for {
+		maxBody := maxBodySize
+		if largest := c.app.LargestMessageSize(); largest > 0 {
+			maxBody = min(maxBody, largest)
+		}
+		f, errRead := readFrame(c.r, maxBody)
+		if errRead != nil {
+			if errors.Is(errRead, errFrameTooLarge) || errors.Is(errRead, errInvalidFrame) {
+				c.sendError(errRead.Error())
+				return
+			}
+			if !errors.Is(errRead, io.EOF) && !errors.Is(errRead, net.ErrClosed) {
+				slog.Debug("error read stomp frame", slog.String("error", errRead.Error()))
+			}
+			return
+		}
+
+		closeConn, errHandle := c.handle(ctx, f)
+		if errHandle != nil {
+			var pe *protocolError
+			if !errors.As(errHandle, &pe) {
+				slog.Error("error handle stomp frame", slog.String("command", f.command), slog.String("error", errHandle.Error()))
+			}
+			c.sendError(errHandle.Error())
+			return
+		}
+
+		if receipt := f.header("receipt"); receipt != "" && f.command != "CONNECT" && f.command != "STOMP" {
+			if c.write(newFrame("RECEIPT", "receipt-id", receipt)) != nil {
+				return
+			}
+		}
+
+		if closeConn {
+			return
+		}
+	}
+}
+
+func (c *conn) handle(ctx context.Context, f *frame) (bool, error) {
+	if !c.connected && f.command != "CONNECT" && f.command != "STOMP" {
+		return false, errProtocol("not connected")
+	}
+	ctx = auth.WithPrincipal(ctx, c.principal)
+
+	switch f.command {
+	case "CONNECT", "STOMP":
+		return false, c.handleConnect(f)
+	case "SEND":
+		return false, c.handleSend(ctx, f)
+	case "SUBSCRIBE":
+		return false, c.handleSubscribe(ctx, f)
+	case "UNSUBSCRIBE":
+		return false, c.handleUnsubscribe(f)
+	case "ACK":
+		return false, c.handleAck(f, true)
+	case "NACK":
+		return false, c.handleAck(f, false)
+	case "DISCONNECT":
+		return true, nil
+	case "BEGIN", "COMMIT", "ABORT":
+		return false, errProtocol("transactions are not supported")
+	default:
+		return false, errProtocol("unknown command " + f.command)
+	}
+}
+
+func (c *conn) handleConnect(f *frame) error {
+	if c.connected {
+		return errProtocol("already connected")
+	}
+
+	versions := strings.Split(f.header("accept-version"), ",")
+	if !slices.Contains(versions, protocolVersion) {
+		return errProtocol("supported protocol versions are " + protocolVersion)
+	}
+
+	// the passcode is the token, clients with a certificate of mutual TLS need none
+	principal, ok := c.tokens.AuthenticateConn(c.nc, f.header("passcode"))
+	if !ok {
+		slog.Warn("stomp connection not authenticated", slog.String("remote", c.nc.RemoteAddr().String()))
+		return errProtocol("authentication failed")
+	}
+
+	c.connected = true
+	c.login = f.header("login")
+	c.principal = principal
+
+	return c.write(newFrame("CONNECTED", "version", protocolVersion, "heart-beat", "0,0", "server", "ssqueue"))
+}
+
+// topicFromDestination strips broker style prefixes, /queue/jobs and jobs are the same topic
+func topicFromDestination(destination string) string {
+	for _, prefix := range []string{"/queue/", "/topic/"} {
+		if strings.HasPrefix(destination, prefix) {
+			return strings.TrimPrefix(destination, prefix)
+		}
+	}
+	return destination
+}
+
+// allow checks the action on the topic against the ACL for the principal of the connection
+func (c *conn) allow(action string, topic string) error {
+	if c.acl.Allowed(c.principal, action, topic) {
+		return nil
+	}
+
+	slog.Warn("stomp frame denied", slog.String("principal", c.principal), slog.String("action", action), slog.String("topic", topic))
+
+	return errProtocol("access denied to " + topic)
+}
+
+func (c *conn) handleSend(ctx context.Context, f *frame) error {
+	destination := f.header("destination")
+	if destination == "" {
+		return errProtocol("destination header is required")
+	}
+	topic := topicFromDestination(destination)
+	errAllow := c.allow(config.ActionSend, topic)
+	if errAllow != nil {
+		return errAllow
+	}
+
+	im := &messages.InputMessage{
+		Name:           c.login,
+		Data:           string(f.body),
+		Persistent:     f.header("persistent") == "true",
+		ContentType:    f.header("content-type"),
+		IdempotencyKey: f.header("idempotency-key"),
+		ReplyTo:        f.header("reply-to"),
+		CorrelationID:  f.header("correlation-id"),
+	}
+
+	// headers not defined by the protocol are kept with the message
+	for _, h := range f.headers {
+		if _, ok := protocolHeaders[h[0]]; ok {
+			continue
+		}
+		if im.Headers == nil {
+			im.Headers = make(map[string]string)
+		}
+		if _, ok := im.Headers[h[0]]; !ok {
+			im.Headers[h[0]] = h[1]
+		}
+	}
+
+	_, errSend := c.app.Send(ctx, topic, im)
+	if errSend != nil && !errors.Is(errSend, application.ErrDuplicate) {
+		if errors.Is(errSend, application.ErrNoConsumers) || errors.Is(errSend, application.ErrNotReady) || errors.Is(errSend, application.ErrInvalidHeaders) ||
+			errors.Is(errSend, application.ErrTopicNotFound) || errors.Is(errSend, application.ErrTopicFull) ||
+			errors.Is(errSend, application.ErrMessageTooLarge) || errors.Is(errSend, application.ErrQuotaExceeded) ||
+			errors.Is(errSend, application.ErrThrottled) || errors.Is(errSend, application.ErrInvalidTopic) {
+			return errProtocol(errSend.Error())
+		}
+		return errSend
+	}
+
+	return nil
+}
+
+func (c *conn) handleSubscribe(ctx context.Context, f *frame) error {
+	id := f.header("id")
+	if id == "" {
+		return errProtocol("id header is required")
+	}
+	destination := f.header("destination")
+	if destination == "" {
+		return errProtocol("destination header is required")
+	}
+	// the subscription gets messages later, an invalid destination is rejected right away
+	if !application.ValidTopic(topicFromDestination(destination)) {
+		return errProtocol("invalid destination " + destination)
+	}
+	errAllow := c.allow(config.ActionGet, topicFromDestination(destination))
+	if errAllow != nil {
+		return errAllow
+	}
+
+	ack := f.header("ack")
+	if ack == "" {
+		ack = ackAuto
+	}
+	if ack != ackAuto && ack != ackClient && ack != ackClientIndividual {
+		return errProtocol("unknown ack mode " + ack)
+	}
+
+	prefetch := 1
+	if v := f.header("prefetch-count"); v != "" {
+		var err error
+		prefetch, err = strconv.Atoi(v)
+		if err != nil || prefetch < 1 || prefetch > maxPrefetch {
+			return errProtocol("invalid prefetch-count")
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.subs[id]; ok {
+		return errProtocol("subscription " + id + " already exists")
+	}
+
+	subCtx, cancel := context.WithCancel(ctx)
+	sub := &subscription{
+		id:          id,
+		destination: destination,
+		topic:       topicFromDestination(destination),
+		ack:         ack,
+		cancel:      cancel,
+		done:        make(chan struct{}),
+		slots:       make(chan struct{}, prefetch),
+	}
+	c.subs[id] = sub
+
+	go c.consume(subCtx, sub)
+
+	return nil
+}
+
+func (c *conn) handleUnsubscribe(f *frame) error {
+	id := f.header("id")
+
+	c.mu.Lock()
+	sub, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+
+	if !ok {
+		return errProtocol("subscription " + id + " not found")
+	}
+
+	c.stop(sub)
+
+	return nil
+}
+
+func (c *conn) unsubscribeAll() {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[string]*subscription)
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		c.stop(sub)
+	}
+}
+
+// stop waits for the consumer loop and returns unacknowledged messages to the queue
+func (c *conn) stop(sub *subscription) {
+	sub.cancel()
+	<-sub.done
+
+	c.mu.Lock()
+	pending := sub.pending
+	sub.pending = nil
+	for _, receipt := range pending {
+		delete(c.acks, receipt)
+	}
+	c.mu.Unlock()
+
+	for _, receipt := range pending {
+		errRelease := c.app.Release(context.Background(), sub.topic, receipt, 0)
+		if errRelease != nil && !errors.Is(errRelease, application.ErrNoReceipt) {
+			slog.Error("error release message", slog.String("topic", sub.topic), slog.String("error", errRelease.Error()))
+		}
+	}
+}
+
+func (c *conn) handleAck(f *frame, ack bool) error {
+	id := f.header("id")
+	if id == "" {
+		return errProtocol("id header is required")
+	}
+
+	c.mu.Lock()
+	sub, ok := c.acks[id]
+	if !ok {
+		c.mu.Unlock()
+		return errProtocol("unknown ack id " + id)
+	}
+
+	idx := slices.Index(sub.pending, id)
+	var receipts []string
+	if sub.ack == ackClient {
+		// client mode acknowledges the message and all the messages delivered before it
+		receipts = slices.Clone(sub.pending[:idx+1])
+		sub.pending = slices.Delete(sub.pending, 0, idx+1)
+	} else {
+		receipts = []string{id}
+		sub.pending = slices.Delete(sub.pending, idx, idx+1)
+	}
+	for _, receipt := range receipts {
+		delete(c.acks, receipt)
+	}
+	c.mu.Unlock()
+
+	for _, receipt := range receipts {
+		var err error
+		if ack {
+			err = c.app.Ack(context.Background(), sub.topic, receipt)
+		} else {
+			err = c.app.Release(context.Background(), sub.topic, receipt, 0)
+		}
+		if err != nil && !errors.Is(err, application.ErrNoReceipt) {
+			return err
+		}
+		<-sub.slots
+	}
+
+	return nil
+}
+
+func (c *conn) consume(ctx context.Context, sub *subscription) {
+	defer close(sub.done)
+	defer c.recoverPanic()
+
+	for {
+		if sub.ack != ackAuto {
+			select {
+			case sub.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		var om *messages.OutputMessage
+		var receipt string
+		var err error
+
+		if sub.ack == ackAuto {
+			om, err = c.app.Get(ctx, sub.topic, nil)
+		} else {
+			om, receipt, err = c.app.Reserve(ctx, sub.topic, leaseTimeout)
+		}
+		if errors.Is(err, application.ErrTopicDeleted) || errors.Is(err, application.ErrTopicNotFound) ||
+			errors.Is(err, application.ErrQuotaExceeded) {
+			c.sendError("destination " + sub.destination + ": " + err.Error())
+			_ = c.nc.Close()
+			return
+		}
+		// the subscription waits out the rate limit and takes the next message afterwards
+		if wait, ok := application.Throttled(err); ok {
+			if sub.ack != ackAuto {
+				<-sub.slots
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err != nil {
+			if !errors.Is(err, application.ErrNotReady) {
+				slog.Error("error get message", slog.String("topic", sub.topic), slog.String("error", err.Error()))
+			}
+			return
+		}
+		if om == nil {
+			return
+		}
+
+		msg := newFrame("MESSAGE", "subscription", sub.id, "message-id", om.ID, "destination", sub.destination)
+		if receipt != "" {
+			msg.set("ack", receipt)
+
+			c.mu.Lock()
+			sub.pending = append(sub.pending, receipt)
+			c.acks[receipt] = sub
+			c.mu.Unlock()
+		}
+		if om.ContentType != "" {
+			msg.set("content-type", om.ContentType)
+		}
+		if om.ReplyTo != "" {
+			msg.set("reply-to", om.ReplyTo)
+		}
+		if om.CorrelationID != "" {
+			msg.set("correlation-id", om.CorrelationID)
+		}
+		for k, v := range om.Headers {
+			if _, ok := protocolHeaders[k]; !ok {
+				msg.set(k, v)
+			}
+		}
+		msg.body = []byte(om.Data)
+
+		if c.write(msg) != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) renewLeases(ctx context.Context) {
+	defer c.recoverPanic()
+
+	ticker := time.NewTicker(leaseRenewal)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		leases := make(map[string]string, len(c.acks))
+		for receipt, sub := range c.acks {
+			leases[receipt] = sub.topic
+		}
+		c.mu.Unlock()
+
+		for receipt, topic := range leases {
+			_ = c.app.Touch(ctx, topic, receipt, leaseTimeout)
+		}
+	}
+}
+
+func (c *conn) write(f *frame) error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+
+	_ = c.nc.SetWriteDeadline(time.Now().Add(writeDeadline))
+	err := writeFrame(c.w, f)
+	if err != nil {
+		_ = c.nc.Close()
+	}
+
+	return err
+}
+
+func (c *conn) sendError(message string) {
+	_ = c.write(newFrame("ERROR", "message", message))
+}
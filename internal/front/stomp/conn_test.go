@@ -0,0 +1,134 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/application/apptest"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func TestSession(t *testing.T) {
+	const connect = "CONNECT\naccept-version:1.2\nhost:q\n\n\x00"
+
+	type step struct {
+		// send is the frame, $ack is replaced by the ack header of the last message
+		send string
+		// want is a regular expression matching the whole reply as it is written, no reply is read when it is empty
+		want string
+	}
+
+	tests := []struct {
+		name  string
+		rules []config.ACLRule
+		steps []step
+	}{
+		{
+			name: "send and subscribe",
+			steps: []step{
+				{send: connect, want: "CONNECTED\nversion:1.2\n(?s:.*)"},
+				{send: "SEND\ndestination:/queue/orders\npersistent:true\nreceipt:1\n\nhello\x00", want: "RECEIPT\nreceipt-id:1\ncontent-length:0\n\n\x00"},
+				{send: "SUBSCRIBE\nid:0\ndestination:/queue/orders\n\n\x00", want: "MESSAGE\nsubscription:0\nmessage-id:[^\n]+\ndestination:/queue/orders\n(?s:.*)\n\nhello\x00"},
+				{send: "DISCONNECT\nreceipt:2\n\n\x00", want: "RECEIPT\nreceipt-id:2\ncontent-length:0\n\n\x00"},
+			},
+		},
+		{
+			name: "client ack",
+			steps: []step{
+				{send: connect, want: "CONNECTED\n(?s:.*)"},
+				{send: "SEND\ndestination:orders\npersistent:true\n\nhello\x00"},
+				{send: "SUBSCRIBE\nid:0\ndestination:orders\nack:client-individual\n\n\x00", want: "MESSAGE\n(?s:.*)ack:[^\n]+\n(?s:.*)\n\nhello\x00"},
+				{send: "ACK\nid:$ack\nreceipt:1\n\n\x00", want: "RECEIPT\nreceipt-id:1\ncontent-length:0\n\n\x00"},
+				{send: "ACK\nid:$ack\n\n\x00", want: "ERROR\nmessage:[^\n]+\ncontent-length:0\n\n\x00"},
+			},
+		},
+		{
+			name: "not connected",
+			steps: []step{
+				{send: "SEND\ndestination:orders\npersistent:true\n\nhello\x00", want: "ERROR\nmessage:not connected\ncontent-length:0\n\n\x00"},
+			},
+		},
+		{
+			name: "invalid send destination",
+			steps: []step{
+				{send: connect, want: "CONNECTED\n(?s:.*)"},
+				{send: "SEND\ndestination:/queue/a\"b\n\nhello\x00", want: "ERROR\nmessage:invalid topic\ncontent-length:0\n\n\x00"},
+			},
+		},
+		{
+			name: "invalid subscribe destination",
+			steps: []step{
+				{send: connect, want: "CONNECTED\n(?s:.*)"},
+				{send: "SUBSCRIBE\nid:0\ndestination:/queue/a\\nb\n\n\x00", want: "ERROR\nmessage:invalid destination /queue/a\\\\nb\ncontent-length:0\n\n\x00"},
+			},
+		},
+		{
+			name:  "acl",
+			rules: []config.ACLRule{{Principal: "*", Topics: []string{"orders"}, Actions: []string{config.ActionSend}}},
+			steps: []step{
+				{send: connect, want: "CONNECTED\n(?s:.*)"},
+				{send: "SEND\ndestination:orders\npersistent:true\nreceipt:1\n\nhello\x00", want: "RECEIPT\nreceipt-id:1\ncontent-length:0\n\n\x00"},
+				{send: "SUBSCRIBE\nid:0\ndestination:orders\n\n\x00", want: "ERROR\nmessage:access denied to orders\ncontent-length:0\n\n\x00"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := apptest.Run(t, &config.Config{MaxMessageSize: 64, DedupWindow: time.Minute})
+			acl := auth.NewACL(nil)
+			acl.Set(tt.rules)
+
+			client, server := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				newConn(app, auth.NewTokens(), acl, server).serve(context.Background())
+			}()
+			defer func() {
+				_ = client.Close()
+				<-done
+			}()
+
+			r := bufio.NewReader(client)
+			ackHeader := regexp.MustCompile("\nack:([^\n]+)\n")
+			var ack string
+			for i, s := range tt.steps {
+				_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+				_, errWrite := client.Write([]byte(strings.ReplaceAll(s.send, "$ack", ack)))
+				if errWrite != nil {
+					t.Fatalf("step %d: %v", i, errWrite)
+				}
+				if s.want == "" {
+					continue
+				}
+
+				f, errRead := readFrame(r, 1024)
+				if errRead != nil {
+					t.Fatalf("step %d: %v", i, errRead)
+				}
+				var buf bytes.Buffer
+				w := bufio.NewWriter(&buf)
+				if errFrame := writeFrame(w, f); errFrame != nil {
+					t.Fatalf("step %d: %v", i, errFrame)
+				}
+				_ = w.Flush()
+
+				reply := buf.String()
+				if !regexp.MustCompile(`^` + s.want + `$`).MatchString(reply) {
+					t.Errorf("step %d: reply %q, want %q", i, reply, s.want)
+				}
+				if m := ackHeader.FindStringSubmatch(reply); m != nil {
+					ack = m[1]
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxHeaderLine = 64 * 1024
+	maxHeaders    = 128
+	// maxBodySize bounds bodies when messages are unlimited
+	maxBodySize = 8 * 1024 * 1024
+)
+
+var (
+	errFrameTooLarge = errors.New("frame too large")
+	errInvalidFrame  = errors.New("invalid frame")
+)
+
+type frame struct {
+	command string
+	headers [][2]string
+	body    []byte
+}
+
+func newFrame(command string, headers ...string) *frame {
+	f := &frame{command: command}
+	for i := 0; i+1 < len(headers); i += 2 {
+		f.headers = append(f.headers, [2]string{headers[i], headers[i+1]})
+	}
+	return f
+}
+
+// header returns the first occurrence of the header, as STOMP 1.2 requires for repeated ones
+func (f *frame) header(name string) string {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+func (f *frame) set(name, value string) {
+	f.headers = append(f.headers, [2]string{name, value})
+}
+
+// readLine reads a line without the trailing EOL, which is either LF or CRLF
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxHeaderLine {
+			return "", errFrameTooLarge
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// readFrame reads the next frame, its body must not be larger than maxBody bytes
+func readFrame(r *bufio.Reader, maxBody int) (*frame, error) {
+	var command string
+	// empty lines between frames are heart-beats
+	for command == "" {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		command = line
+	}
+
+	f := &frame{command: command}
+	escaped := command != "CONNECT" && command != "CONNECTED"
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		if len(f.headers) >= maxHeaders {
+			return nil, errFrameTooLarge
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errInvalidFrame
+		}
+		if escaped {
+			if name, err = unescape(name); err != nil {
+				return nil, err
+			}
+			if value, err = unescape(value); err != nil {
+				return nil, err
+			}
+		}
+		f.headers = append(f.headers, [2]string{name, value})
+	}
+
+	if cl := f.header("content-length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, errInvalidFrame
+		}
+		if n > maxBody {
+			return nil, errFrameTooLarge
+		}
+		f.body = make([]byte, n)
+		if _, err = io.ReadFull(r, f.body); err != nil {
+			return nil, err
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0 {
+			return nil, errInvalidFrame
+		}
+		return f, nil
+	}
+
+	for {
+		chunk, err := r.ReadSlice(0)
+		if len(f.body)+len(chunk) > maxBody+1 {
+			return nil, errFrameTooLarge
+		}
+		f.body = append(f.body, chunk...)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+	f.body = f.body[:len(f.body)-1]
+
+	return f, nil
+}
+
+func writeFrame(w *bufio.Writer, f *frame) error {
+	escaped := f.command != "CONNECTED"
+
+	w.WriteString(f.command)
+	w.WriteByte('\n')
+	for _, h := range f.headers {
+		if escaped {
+			w.WriteString(escape(h[0]))
+			w.WriteByte(':')
+			w.WriteString(escape(h[1]))
+		} else {
+			w.WriteString(h[0])
+			w.WriteByte(':')
+			w.WriteString(h[1])
+		}
+		w.WriteByte('\n')
+	}
+	if f.body != nil {
+		w.WriteString("content-length:")
+		w.WriteString(strconv.Itoa(len(f.body)))
+		w.WriteByte('\n')
+	}
+	w.WriteByte('\n')
+	w.Write(f.body)
+	w.WriteByte(0)
+
+	return w.Flush()
+}
+
+var escaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errInvalidFrame
+		}
+		switch s[i] {
+		case 'r':
+			buf.WriteByte('\r')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'c':
+			buf.WriteByte(':')
+		case '\\':
+			buf.WriteByte('\\')
+		default:
+			return "", errInvalidFrame
+		}
+	}
+
+	return buf.String(), nil
+}
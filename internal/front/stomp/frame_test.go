@@ -0,0 +1,131 @@
+package stomp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		maxBody int
+		command string
+		headers [][2]string
+		body    string
+		err     error
+	}{
+		{
+			name:    "connect",
+			input:   "CONNECT\naccept-version:1.2\nhost:q\n\n\x00",
+			maxBody: 10,
+			command: "CONNECT",
+			headers: [][2]string{{"accept-version", "1.2"}, {"host", "q"}},
+		},
+		{
+			name:    "crlf and heart-beats",
+			input:   "\n\r\nSEND\r\ndestination:/queue/a\r\n\r\nhello\x00",
+			maxBody: 10,
+			command: "SEND",
+			headers: [][2]string{{"destination", "/queue/a"}},
+			body:    "hello",
+		},
+		{
+			name:    "content length with nul in the body",
+			input:   "SEND\ncontent-length:3\n\na\x00b\x00",
+			maxBody: 10,
+			command: "SEND",
+			headers: [][2]string{{"content-length", "3"}},
+			body:    "a\x00b",
+		},
+		{
+			name:    "escaped header",
+			input:   "SEND\nkey\\cname:a\\nb\\\\c\n\n\x00",
+			maxBody: 10,
+			command: "SEND",
+			headers: [][2]string{{"key:name", "a\nb\\c"}},
+		},
+		{
+			name:    "connect is not unescaped",
+			input:   "CONNECT\nlogin:a\\b\n\n\x00",
+			maxBody: 10,
+			command: "CONNECT",
+			headers: [][2]string{{"login", "a\\b"}},
+		},
+		{
+			name:    "repeated header keeps both",
+			input:   "SEND\nx:1\nx:2\n\n\x00",
+			maxBody: 10,
+			command: "SEND",
+			headers: [][2]string{{"x", "1"}, {"x", "2"}},
+		},
+		{name: "body over the limit", input: "SEND\n\n0123456789a\x00", maxBody: 10, err: errFrameTooLarge},
+		{name: "body at the limit", input: "SEND\n\n0123456789\x00", maxBody: 10, command: "SEND", body: "0123456789"},
+		{name: "content length over the limit", input: "SEND\ncontent-length:11\n\n0123456789a\x00", maxBody: 10, err: errFrameTooLarge},
+		{name: "negative content length", input: "SEND\ncontent-length:-1\n\n\x00", maxBody: 10, err: errInvalidFrame},
+		{name: "no nul after content", input: "SEND\ncontent-length:1\n\nab", maxBody: 10, err: errInvalidFrame},
+		{name: "header without colon", input: "SEND\nheader\n\n\x00", maxBody: 10, err: errInvalidFrame},
+		{name: "bad escape", input: "SEND\nkey:\\t\n\n\x00", maxBody: 10, err: errInvalidFrame},
+		{name: "too many headers", input: "SEND\n" + strings.Repeat("h:v\n", maxHeaders+1) + "\n\x00", maxBody: 10, err: errFrameTooLarge},
+		{name: "long header line", input: "SEND\nh:" + strings.Repeat("v", maxHeaderLine) + "\n\n\x00", maxBody: 10, err: errFrameTooLarge},
+		{name: "truncated", input: "SEND\nh:v\n", maxBody: 10, err: io.EOF},
+		{name: "unterminated body", input: "SEND\n\nabc", maxBody: 10, err: io.EOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := readFrame(bufio.NewReader(strings.NewReader(tt.input)), tt.maxBody)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("error %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.command != tt.command || !slices.Equal(f.headers, tt.headers) || string(f.body) != tt.body {
+				t.Errorf("frame %q %q %q, want %q %q %q", f.command, f.headers, f.body, tt.command, tt.headers, tt.body)
+			}
+		})
+	}
+}
+
+func TestWriteFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *frame
+	}{
+		{name: "without body", frame: newFrame("RECEIPT", "receipt-id", "1")},
+		{name: "escaped headers", frame: newFrame("MESSAGE", "key:name", "a\nb\\c\rd")},
+		{name: "binary body", frame: &frame{command: "MESSAGE", headers: [][2]string{{"x", "y"}}, body: []byte("a\x00b")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			errWrite := writeFrame(bufio.NewWriter(&buf), tt.frame)
+			if errWrite != nil {
+				t.Fatal(errWrite)
+			}
+
+			f, errRead := readFrame(bufio.NewReader(&buf), 10)
+			if errRead != nil {
+				t.Fatal(errRead)
+			}
+			if f.command != tt.frame.command || string(f.body) != string(tt.frame.body) {
+				t.Errorf("read %q %q, want %q %q", f.command, f.body, tt.frame.command, tt.frame.body)
+			}
+			for _, h := range tt.frame.headers {
+				if f.header(h[0]) != h[1] {
+					t.Errorf("header %q is %q, want %q", h[0], f.header(h[0]), h[1])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package stomp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/front"
+)
+
+const (
+	acceptRetryDelay = time.Millisecond * 100
+)
+
+type backend interface {
+	front.LeaseApplication
+	front.LimitApplication
+}
+
+// STOMP serves STOMP 1.2 clients, SEND is mapped to Send and SUBSCRIBE starts a consumer loop on the topic
+type STOMP struct {
+	app    backend
+	tokens *auth.Tokens
+	acl    *auth.ACL
+}
+
+func New(app backend, tokens *auth.Tokens, acl *auth.ACL) *STOMP {
+	return &STOMP{
+		app:    app,
+		tokens: tokens,
+		acl:    acl,
+	}
+}
+
+func (s *STOMP) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
+	defer wg.Done()
+
+	var connWg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		<-ctx.Done()
+		slog.Info("shutting down stomp server")
+		errClose := ln.Close()
+		if errClose != nil && !errors.Is(errClose, net.ErrClosed) {
+			slog.Error("error shutdown stomp server", slog.String("error", errClose.Error()))
+		}
+	}()
+
+	slog.Info("start stomp server", slog.String("addr", ln.Addr().String()))
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			slog.Error("error accept stomp connection", slog.String("error", err.Error()))
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		connWg.Add(1)
+		go func() {
+			defer connWg.Done()
+			newConn(s.app, s.tokens, s.acl, nc).serve(ctx)
+		}()
+	}
+
+	connWg.Wait()
+}
@@ -0,0 +1,14 @@
+package messages
+
+// Filter selects messages by headers, a message matches when it has all the headers with the same values
+type Filter map[string]string
+
+func (f Filter) Match(headers map[string]string) bool {
+	for k, v := range f {
+		if hv, ok := headers[k]; !ok || hv != v {
+			return false
+		}
+	}
+
+	return true
+}
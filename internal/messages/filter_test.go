@@ -0,0 +1,34 @@
+package messages
+
+import (
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	headers := map[string]string{"color": "red", "size": "xl", "empty": ""}
+
+	tests := []struct {
+		name    string
+		filter  Filter
+		headers map[string]string
+		want    bool
+	}{
+		{name: "nil filter", filter: nil, headers: headers, want: true},
+		{name: "nil headers", filter: nil, headers: nil, want: true},
+		{name: "one header", filter: Filter{"color": "red"}, headers: headers, want: true},
+		{name: "all headers", filter: Filter{"color": "red", "size": "xl"}, headers: headers, want: true},
+		{name: "other value", filter: Filter{"color": "blue"}, headers: headers, want: false},
+		{name: "one of two differs", filter: Filter{"color": "red", "size": "s"}, headers: headers, want: false},
+		{name: "missing header", filter: Filter{"shape": ""}, headers: headers, want: false},
+		{name: "empty value", filter: Filter{"empty": ""}, headers: headers, want: true},
+		{name: "no headers", filter: Filter{"color": "red"}, headers: nil, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.headers); got != tt.want {
+				t.Errorf("match %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
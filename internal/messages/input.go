@@ -1,7 +1,23 @@
 package messages
 
+import (
+	"time"
+)
+
 type InputMessage struct {
 	Name       string
 	Data       string
 	Persistent bool
+	// ContentType describes Data, which may hold arbitrary bytes
+	ContentType string
+	Headers     map[string]string
+	// IdempotencyKey makes repeated sends within the dedup window return the ID of the first message
+	IdempotencyKey string
+	// Group keeps messages of the same group in order, only one of them is reserved at a time
+	Group string
+	// ReplyTo names the topic for the reply, which is sent with the same CorrelationID
+	ReplyTo       string
+	CorrelationID string
+	// Delay postpones the delivery, delayed messages are always persistent
+	Delay time.Duration
 }
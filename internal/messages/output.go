@@ -1,7 +1,12 @@
 package messages
 
 type OutputMessage struct {
-	Name string
-	ID   string
-	Data string
+	Name          string
+	ID            string
+	Data          string
+	ContentType   string
+	Headers       map[string]string
+	Group         string
+	ReplyTo       string
+	CorrelationID string
 }
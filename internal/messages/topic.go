@@ -0,0 +1,34 @@
+package messages
+
+import (
+	"time"
+)
+
+type TopicInfo struct {
+	Name      string
+	Messages  int
+	InFlight  int
+	Delayed   int
+	Buried    int
+	Consumers int
+}
+
+// MessageInfo describes a message without its data, State is one of the queue.State constants
+type MessageInfo struct {
+	ID    string
+	Name  string
+	Age   time.Duration
+	Size  int
+	State string
+}
+
+// TenantUsage is the current usage of tenant quotas, zero limits are unlimited
+type TenantUsage struct {
+	Name         string
+	Topics       int
+	Bytes        int64
+	Consumers    int
+	MaxTopics    int
+	MaxBytes     int64
+	MaxConsumers int
+}
@@ -0,0 +1,96 @@
+package queue
+
+import (
+	"sync/atomic"
+)
+
+// Account sums usage of the queues assigned to it and limits their bytes and consumers, it is shared by topics of a tenant.
+// Bytes are counted for all items held by the queues, pending, leased, delayed, buried and dead ones.
+type Account struct {
+	topics       int64
+	bytes        int64
+	consumers    int64
+	maxBytes     int64
+	maxConsumers int64
+}
+
+func NewAccount() *Account {
+	return &Account{}
+}
+
+// SetLimits replaces the limits, zero is unlimited. They are checked for new items and consumers only.
+func (a *Account) SetLimits(maxBytes int64, maxConsumers int) {
+	atomic.StoreInt64(&a.maxBytes, maxBytes)
+	atomic.StoreInt64(&a.maxConsumers, int64(maxConsumers))
+}
+
+func (a *Account) Topics() int {
+	return int(atomic.LoadInt64(&a.topics))
+}
+
+func (a *Account) Bytes() int64 {
+	return atomic.LoadInt64(&a.bytes)
+}
+
+func (a *Account) Consumers() int {
+	return int(atomic.LoadInt64(&a.consumers))
+}
+
+// reserve adds n to the counter unless it would go over the limit, concurrent callers never overshoot it together
+func reserve(counter *int64, n int64, limit *int64) bool {
+	for {
+		current := atomic.LoadInt64(counter)
+		if maxValue := atomic.LoadInt64(limit); maxValue > 0 && current+n > maxValue {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(counter, current, current+n) {
+			return true
+		}
+	}
+}
+
+// SetAccount moves the usage of the queue from its account to the given one, nil removes it from any
+func (q *Queue) SetAccount(a *Account) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.account == a {
+		return
+	}
+
+	consumers := atomic.LoadInt64(&q.consumersCount)
+	if old := q.account; old != nil {
+		atomic.AddInt64(&old.topics, -1)
+		atomic.AddInt64(&old.bytes, -q.stored)
+		atomic.AddInt64(&old.consumers, -consumers)
+	}
+	if a != nil {
+		atomic.AddInt64(&a.topics, 1)
+		atomic.AddInt64(&a.bytes, q.stored)
+		atomic.AddInt64(&a.consumers, consumers)
+	}
+	q.account = a
+}
+
+// charge counts the size of items added to the queue, it fails if the account has not enough bytes left
+// unless force is set. q.mu must be locked.
+func (q *Queue) charge(size int64, force bool) bool {
+	if q.account != nil {
+		if force {
+			atomic.AddInt64(&q.account.bytes, size)
+		} else if !reserve(&q.account.bytes, size, &q.account.maxBytes) {
+			return false
+		}
+	}
+	q.stored += size
+
+	return true
+}
+
+// credit uncounts the size of items which left the queue for good, q.mu must be locked
+func (q *Queue) credit(size int64) {
+	if q.account != nil {
+		atomic.AddInt64(&q.account.bytes, -size)
+	}
+	q.stored -= size
+}
@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAccountBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		sizes    []int
+		want     []error
+		bytes    int64
+	}{
+		{name: "unlimited", maxBytes: 0, sizes: []int{50, 50, 50}, want: []error{nil, nil, nil}, bytes: 150},
+		{name: "up to the limit", maxBytes: 100, sizes: []int{50, 50}, want: []error{nil, nil}, bytes: 100},
+		{name: "over the limit", maxBytes: 100, sizes: []int{60, 50, 40}, want: []error{nil, ErrQuotaExceeded, nil}, bytes: 100},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAccount()
+			a.SetLimits(tt.maxBytes, 0)
+			q := New("test")
+			q.SetAccount(a)
+
+			for i, size := range tt.sizes {
+				errPush := q.Push(&Item{Data: string(make([]byte, size))}, true)
+				if !errors.Is(errPush, tt.want[i]) {
+					t.Errorf("push %d: %v, want %v", i, errPush, tt.want[i])
+				}
+			}
+			if a.Bytes() != tt.bytes {
+				t.Errorf("bytes %d, want %d", a.Bytes(), tt.bytes)
+			}
+		})
+	}
+}
+
+// TestAccountBytesLifecycle checks that bytes are counted while items are held by the queue in any state
+func TestAccountBytesLifecycle(t *testing.T) {
+	a := NewAccount()
+	q := New("test")
+	q.SetAccount(a)
+
+	push(t, q, &Item{ID: "1", Data: "1234"}, &Item{ID: "2", Data: "56"}, &Item{ID: "3", Data: "7"})
+	errDelayed := q.PushDelayed(&Item{ID: "4", Data: "890"}, time.Minute)
+	if errDelayed != nil {
+		t.Fatal(errDelayed)
+	}
+
+	steps := []struct {
+		name  string
+		do    func()
+		bytes int64
+	}{
+		{name: "pushed", do: func() {}, bytes: 10},
+		{name: "reserved", do: func() { q.TryReserve(time.Minute) }, bytes: 10},
+		{name: "popped", do: func() { popAll(q, nil, 0) }, bytes: 7},
+		{name: "buried", do: func() {
+			// the reserved and the delayed item return to the queue
+			q.Requeue(time.Now().Add(2 * time.Minute))
+			_, receipt := q.TryReserve(time.Minute)
+			q.Bury(receipt)
+		}, bytes: 7},
+		{name: "purged", do: func() { q.Purge() }, bytes: 0},
+	}
+
+	for _, step := range steps {
+		step.do()
+		if a.Bytes() != step.bytes {
+			t.Errorf("%s: bytes %d, want %d", step.name, a.Bytes(), step.bytes)
+		}
+	}
+}
+
+func TestAccountMoves(t *testing.T) {
+	a, b := NewAccount(), NewAccount()
+	q := New("test")
+	q.SetAccount(a)
+	push(t, q, &Item{Data: "1234"})
+	q.Inc()
+
+	q.SetAccount(b)
+	if a.Topics() != 0 || a.Bytes() != 0 || a.Consumers() != 0 {
+		t.Errorf("old account keeps topics %d bytes %d consumers %d", a.Topics(), a.Bytes(), a.Consumers())
+	}
+	if b.Topics() != 1 || b.Bytes() != 4 || b.Consumers() != 1 {
+		t.Errorf("new account has topics %d bytes %d consumers %d, want 1 4 1", b.Topics(), b.Bytes(), b.Consumers())
+	}
+
+	q.SetAccount(nil)
+	if b.Topics() != 0 || b.Bytes() != 0 || b.Consumers() != 0 {
+		t.Errorf("removed account keeps topics %d bytes %d consumers %d", b.Topics(), b.Bytes(), b.Consumers())
+	}
+}
+
+func TestAccountConsumers(t *testing.T) {
+	a := NewAccount()
+	a.SetLimits(0, 2)
+	q1, q2 := New("one"), New("two")
+	q1.SetAccount(a)
+	q2.SetAccount(a)
+
+	results := []error{q1.TryInc(), q2.TryInc(), q1.TryInc()}
+	want := []error{nil, nil, ErrQuotaExceeded}
+	for i := range results {
+		if !errors.Is(results[i], want[i]) {
+			t.Errorf("inc %d: %v, want %v", i, results[i], want[i])
+		}
+	}
+
+	q2.Dec()
+	if errInc := q1.TryInc(); errInc != nil {
+		t.Errorf("inc after dec: %v", errInc)
+	}
+	if a.Consumers() != 2 || q1.ConsumersCount() != 2 {
+		t.Errorf("consumers %d and %d in the queue, want 2", a.Consumers(), q1.ConsumersCount())
+	}
+}
+
+func TestAccountConcurrentPushes(t *testing.T) {
+	a := NewAccount()
+	a.SetLimits(100, 0)
+	queues := []*Queue{New("one"), New("two")}
+	for _, q := range queues {
+		q.SetAccount(a)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for i := range 40 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if queues[i%2].Push(&Item{Data: "0123456789"}, true) == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if accepted != 10 || a.Bytes() != 100 {
+		t.Errorf("accepted %d pushes with %d bytes, want 10 with 100", accepted, a.Bytes())
+	}
+}
@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"time"
+)
+
+type dedupEntry struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+// Dedup remembers the item ID for the idempotency key during the window.
+// If the key is already known, the ID of the original item is returned with true.
+func (q *Queue) Dedup(key string, id string, window time.Duration) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+
+	entry, ok := q.dedup[key]
+	if ok && entry.Expires.After(now) {
+		return entry.ID, true
+	}
+
+	q.dedup[key] = dedupEntry{ID: id, Expires: now.Add(window)}
+
+	return id, false
+}
+
+// Forget removes the key remembered for the item which was not added to the queue
+func (q *Queue) Forget(key string, id string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if entry, ok := q.dedup[key]; ok && entry.ID == id {
+		delete(q.dedup, key)
+	}
+}
+
+// ForgetExpired removes idempotency keys with passed windows
+func (q *Queue) ForgetExpired(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for key, entry := range q.dedup {
+		if !entry.Expires.After(now) {
+			delete(q.dedup, key)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	tests := []struct {
+		name string
+		// prepare runs after the first key is remembered
+		prepare  func(q *Queue)
+		wantID   string
+		wantSeen bool
+	}{
+		{name: "repeated key", prepare: func(*Queue) {}, wantID: "first", wantSeen: true},
+		{name: "forgotten key", prepare: func(q *Queue) { q.Forget("key", "first") }, wantID: "second", wantSeen: false},
+		{name: "forget of another item", prepare: func(q *Queue) { q.Forget("key", "other") }, wantID: "first", wantSeen: true},
+		{name: "expired key", prepare: func(q *Queue) { q.ForgetExpired(time.Now().Add(time.Hour)) }, wantID: "second", wantSeen: false},
+		{name: "key in the window", prepare: func(q *Queue) { q.ForgetExpired(time.Now()) }, wantID: "first", wantSeen: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New("test")
+			if id, seen := q.Dedup("key", "first", time.Minute); id != "first" || seen {
+				t.Fatalf("first dedup returned %s %v", id, seen)
+			}
+			tt.prepare(q)
+
+			id, seen := q.Dedup("key", "second", time.Minute)
+			if id != tt.wantID || seen != tt.wantSeen {
+				t.Errorf("dedup returned %s %v, want %s %v", id, seen, tt.wantID, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestDedupSnapshot(t *testing.T) {
+	q := New("test")
+	q.Dedup("key", "first", time.Minute)
+
+	data, errSnapshot := q.ToSnapshot()
+	if errSnapshot != nil {
+		t.Fatal(errSnapshot)
+	}
+	restored := New("test")
+	errRestore := restored.FromSnapshot(data)
+	if errRestore != nil {
+		t.Fatal(errRestore)
+	}
+
+	if id, seen := restored.Dedup("key", "second", time.Minute); id != "first" || !seen {
+		t.Errorf("restored dedup returned %s %v, want first true", id, seen)
+	}
+}
@@ -0,0 +1,101 @@
+package queue
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// enqueue adds pending items to the tail of the queue, or to the head if head is set
+func (q *Queue) enqueue(head bool, items ...*Item) {
+	if head {
+		q.items = append(slices.Clone(items), q.items...)
+	} else {
+		q.items = append(q.items, items...)
+	}
+	var size int64
+	for _, item := range items {
+		if item.ID != "" {
+			q.index[item.ID] = item
+		}
+		size += int64(len(item.Data))
+	}
+	atomic.AddInt64(&q.count, int64(len(items)))
+	atomic.AddInt64(&q.size, size)
+}
+
+// delay indexes the delayed item by its ID
+func (q *Queue) delay(item *Item, receipt string) {
+	if item.ID != "" {
+		q.delayed[item.ID] = receipt
+	}
+}
+
+// deleteDelayed removes the delayed item with the ID, a released item frees its group and the next item of it is returned
+func (q *Queue) deleteDelayed(id string) (bool, *Item) {
+	receipt, ok := q.delayed[id]
+	if !ok {
+		return false, nil
+	}
+	l := q.leases[receipt]
+	delete(q.delayed, id)
+	delete(q.leases, receipt)
+	q.credit(int64(len(l.item.Data)))
+	if !l.released {
+		return true, nil
+	}
+
+	return true, q.unblock(l.item)
+}
+
+// Delete removes the pending or delayed item with the ID.
+// The pending item is found by the index and only marked as removed, it is dropped from the queue when consumers pass it
+// or when removed items take more than half of the queue.
+func (q *Queue) Delete(id string) bool {
+	q.mu.Lock()
+	item, ok := q.index[id]
+	if !ok {
+		deleted, next := q.deleteDelayed(id)
+		q.mu.Unlock()
+		if next != nil {
+			q.signal(next)
+		}
+		return deleted
+	}
+	delete(q.index, id)
+	item.removed = true
+	q.removed++
+	atomic.AddInt64(&q.count, -1)
+	atomic.AddInt64(&q.size, -int64(len(item.Data)))
+	q.credit(int64(len(item.Data)))
+
+	if q.removed > len(q.items)/2 {
+		q.compact()
+	}
+	q.mu.Unlock()
+
+	return true
+}
+
+// compact drops removed items from the queue
+func (q *Queue) compact() {
+	q.items = slices.DeleteFunc(q.items, func(item *Item) bool {
+		return item.removed
+	})
+	q.removed = 0
+}
+
+// pending returns the pending items without the removed ones, the result must not be changed
+func (q *Queue) pending() []*Item {
+	if q.removed == 0 {
+		return q.items
+	}
+
+	items := make([]*Item, 0, len(q.items)-q.removed)
+	for _, item := range q.items {
+		if !item.removed {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNoConsumers = errors.New("no consumers")
+	ErrFull        = errors.New("queue is full")
+	// ErrQuotaExceeded is returned when the account of the queue has not enough bytes or consumers left
+	ErrQuotaExceeded = errors.New("tenant quota exceeded")
+)
+
+// Limits of the queue, zero values are unlimited
+type Limits struct {
+	// MaxMessages limits the number of pending items
+	MaxMessages int
+	// MaxReceives is how many times an item is reserved before it is dead, see TakeDead
+	MaxReceives int
+}
+
+func (q *Queue) SetLimits(limits Limits) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.limits = limits
+}
+
+// full reports whether no more items may be pushed, q.mu must be locked
+func (q *Queue) full() bool {
+	return q.limits.MaxMessages > 0 && int(atomic.LoadInt64(&q.count)) >= q.limits.MaxMessages
+}
+
+// isDead reports whether the item returning from a lease has used all its receives, q.mu must be locked
+func (q *Queue) isDead(item *Item) bool {
+	return q.limits.MaxReceives > 0 && item.Receives >= q.limits.MaxReceives
+}
+
+// TakeDead returns items which were reserved MaxReceives times and not acknowledged, they are removed from the queue
+func (q *Queue) TakeDead() []*Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead := q.dead
+	q.dead = nil
+	for _, item := range dead {
+		q.credit(int64(len(item.Data)))
+	}
+
+	return dead
+}
+
+// Expire drops pending items created before the time and returns their number
+func (q *Queue) Expire(before time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := 0
+	var size int64
+	for _, item := range q.items {
+		if item.removed || item.Created.IsZero() || !item.Created.Before(before) {
+			continue
+		}
+		delete(q.index, item.ID)
+		item.removed = true
+		q.removed++
+		n++
+		size += int64(len(item.Data))
+	}
+	if n == 0 {
+		return 0
+	}
+	atomic.AddInt64(&q.count, -int64(n))
+	atomic.AddInt64(&q.size, -size)
+	q.credit(size)
+
+	if q.removed > len(q.items)/2 {
+		q.compact()
+	}
+
+	return n
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"slices"
+)
+
+// states of items returned by Browse
+const (
+	StatePending  = "pending"
+	StateReserved = "reserved"
+	StateDelayed  = "delayed"
+	StateBuried   = "buried"
+)
+
+// ItemView is a copy of an item taken by Peek or Browse, later changes of the queue do not affect it
+type ItemView struct {
+	Item
+	State string
+}
+
+// Peek returns up to limit pending items starting at offset, in the order of delivery
+func (q *Queue) Peek(offset int, limit int) []ItemView {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return view(q.pending(), StatePending, offset, limit)
+}
+
+// Browse is Peek over all items: pending ones first, then reserved, delayed and buried ones
+func (q *Queue) Browse(offset int, limit int) []ItemView {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var reserved, delayed []*lease
+	for _, l := range q.leases {
+		if l.delayed {
+			delayed = append(delayed, l)
+		} else {
+			reserved = append(reserved, l)
+		}
+	}
+	byDeadline := func(a, b *lease) int {
+		return a.deadline.Compare(b.deadline)
+	}
+	slices.SortFunc(reserved, byDeadline)
+	slices.SortFunc(delayed, byDeadline)
+
+	pending := q.pending()
+	items := make([]*Item, 0, len(pending)+len(q.leases)+len(q.buried))
+	items = append(items, pending...)
+	for _, l := range reserved {
+		items = append(items, l.item)
+	}
+	for _, l := range delayed {
+		items = append(items, l.item)
+	}
+	items = append(items, q.buried...)
+
+	views := view(items, "", offset, limit)
+	for i := range views {
+		switch n := offset + i; {
+		case n < len(pending):
+			views[i].State = StatePending
+		case n < len(pending)+len(reserved):
+			views[i].State = StateReserved
+		case n < len(pending)+len(reserved)+len(delayed):
+			views[i].State = StateDelayed
+		default:
+			views[i].State = StateBuried
+		}
+	}
+
+	return views
+}
+
+func view(items []*Item, state string, offset int, limit int) []ItemView {
+	if offset < 0 || offset >= len(items) || limit <= 0 {
+		return nil
+	}
+	items = items[offset:min(offset+limit, len(items))]
+
+	views := make([]ItemView, len(items))
+	for i, item := range items {
+		views[i] = ItemView{Item: *item, State: state}
+	}
+
+	return views
+}
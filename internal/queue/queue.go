@@ -2,9 +2,13 @@ package queue
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/json"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 var itemsPool = sync.Pool{}
@@ -22,49 +26,210 @@ func ReleaseItem(item *Item) {
 }
 
 type Item struct {
-	ID   string `json:"id,omitempty"`
-	Data string `json:"data,omitempty"`
-	Name string `json:"name,omitempty"`
+	ID          string            `json:"id,omitempty"`
+	Data        string            `json:"data,omitempty"`
+	Name        string            `json:"name,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Group orders items, only one item of a group is leased at a time
+	Group string `json:"group,omitempty"`
+	// ReplyTo is the topic the reply is expected in, the reply carries the same CorrelationID
+	ReplyTo       string `json:"reply_to,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Created is zero for items restored from snapshots of older versions
+	Created time.Time `json:"created,omitzero"`
+	// Receives counts reservations of the item
+	Receives int `json:"receives,omitempty"`
+
+	removed bool
 }
 
 func (i *Item) reset() {
 	i.ID = ""
 	i.Data = ""
+	i.Name = ""
+	i.ContentType = ""
+	i.Headers = nil
+	i.Group = ""
+	i.ReplyTo = ""
+	i.CorrelationID = ""
+	i.Created = time.Time{}
+	i.Receives = 0
+	i.removed = false
+}
+
+type jsonItem Item
+
+// MarshalJSON keeps binary data intact, JSON strings can hold valid UTF-8 only, so other data is base64 encoded
+func (i *Item) MarshalJSON() ([]byte, error) {
+	if utf8.ValidString(i.Data) {
+		return json.Marshal((*jsonItem)(i))
+	}
+
+	return json.Marshal(struct {
+		*jsonItem
+		Data       string `json:"data,omitempty"`
+		DataBase64 []byte `json:"data_base64"`
+	}{
+		jsonItem:   (*jsonItem)(i),
+		DataBase64: []byte(i.Data),
+	})
+}
+
+func (i *Item) UnmarshalJSON(src []byte) error {
+	v := struct {
+		*jsonItem
+		DataBase64 []byte `json:"data_base64"`
+	}{
+		jsonItem: (*jsonItem)(i),
+	}
+
+	errDecode := json.Unmarshal(src, &v)
+	if errDecode != nil {
+		return errDecode
+	}
+	if v.DataBase64 != nil {
+		i.Data = string(v.DataBase64)
+	}
+
+	return nil
+}
+
+// lease holds an item taken by a consumer until it is acknowledged, released or the deadline passes.
+// Delayed items are kept as leases too, they go to the tail of the queue instead of the head.
+// Items released with a delay are delayed leases which go to the head, their group is busy until then.
+type lease struct {
+	item     *Item
+	deadline time.Time
+	delayed  bool
+	released bool
+}
+
+// waiter is a consumer waiting for an item matching its filter, it is woken up by matching items only
+type waiter struct {
+	match func(*Item) bool
+	ch    chan struct{}
 }
 
 type Queue struct {
 	topic          string
 	mu             sync.RWMutex
 	items          []*Item
+	index          map[string]*Item
+	removed        int
+	leases         map[string]*lease
+	buried         []*Item
+	dead           []*Item
+	limits         Limits
 	notify         chan struct{}
+	closed         chan struct{}
+	waiters        map[*waiter]struct{}
+	dedup          map[string]dedupEntry
+	busy           map[string]struct{}
 	consumersCount int64
 	count          int64
+	size           int64
+	used           int64
+	// stored is the size of all items held by the queue, it is counted in the account
+	stored  int64
+	account *Account
+	// holds are deadlines of groups kept busy by popped items, they have no lease to end
+	holds map[string]time.Time
+	// delayed maps IDs of delayed items to receipts of their leases, so Delete finds them like pending ones
+	delayed map[string]string
 }
 
 func New(topic string) *Queue {
 	return &Queue{
-		topic:  topic,
-		items:  make([]*Item, 0, 256),
-		notify: make(chan struct{}),
+		topic:   topic,
+		items:   make([]*Item, 0, 256),
+		index:   make(map[string]*Item),
+		leases:  make(map[string]*lease),
+		notify:  make(chan struct{}),
+		closed:  make(chan struct{}),
+		waiters: make(map[*waiter]struct{}),
+		dedup:   make(map[string]dedupEntry),
+		busy:    make(map[string]struct{}),
+		holds:   make(map[string]time.Time),
+		delayed: make(map[string]string),
+		used:    time.Now().UnixNano(),
 	}
 }
 
+type snapshot struct {
+	Items []*Item               `json:"items,omitempty"`
+	Dedup map[string]dedupEntry `json:"dedup,omitempty"`
+	// Holds keep groups of popped items busy after a restart, groups of leased items need none,
+	// their items are stored first and are delivered first again
+	Holds map[string]time.Time `json:"holds,omitempty"`
+}
+
+// FromSnapshot accepts both the snapshot object and the plain list of items written by older versions
 func (q *Queue) FromSnapshot(src []byte) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	return json.Unmarshal(src, &q.items)
+	var snap snapshot
+	var errDecode error
+	if len(src) > 0 && src[0] == '[' {
+		errDecode = json.Unmarshal(src, &snap.Items)
+	} else {
+		errDecode = json.Unmarshal(src, &snap)
+	}
+	if errDecode != nil {
+		return errDecode
+	}
+
+	q.enqueue(false, snap.Items...)
+	var size int64
+	for _, item := range snap.Items {
+		size += int64(len(item.Data))
+	}
+	// restored items are kept even over the quota, like items pushed before it was lowered
+	q.charge(size, true)
+	for key, entry := range snap.Dedup {
+		q.dedup[key] = entry
+	}
+	// expired holds end with the next Requeue
+	for group, deadline := range snap.Holds {
+		q.busy[group] = struct{}{}
+		q.holds[group] = deadline
+	}
+
+	return nil
 }
 
+// ToSnapshot stores leased, pending and buried items as pending ones, leases and delays are not kept between restarts.
+// Leased items are stored first, so items of a group keep their order. Holds of groups are kept.
 func (q *Queue) ToSnapshot() ([]byte, error) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
-	if len(q.items) == 0 {
+	if len(q.items) == q.removed && len(q.leases) == 0 && len(q.buried) == 0 && len(q.dead) == 0 && len(q.dedup) == 0 &&
+		len(q.holds) == 0 {
 		return nil, nil
 	}
 
-	return json.Marshal(q.items)
+	snap := snapshot{
+		Items: make([]*Item, 0, len(q.leases)+len(q.items)+len(q.buried)),
+		Dedup: q.dedup,
+		Holds: q.holds,
+	}
+	for _, l := range q.leases {
+		if !l.delayed || l.released {
+			snap.Items = append(snap.Items, l.item)
+		}
+	}
+	snap.Items = append(snap.Items, q.pending()...)
+	for _, l := range q.leases {
+		if l.delayed && !l.released {
+			snap.Items = append(snap.Items, l.item)
+		}
+	}
+	snap.Items = append(snap.Items, q.buried...)
+	snap.Items = append(snap.Items, q.dead...)
+
+	return json.Marshal(snap)
 }
 
 func (q *Queue) ConsumersCount() int {
@@ -75,52 +240,530 @@ func (q *Queue) Count() int {
 	return int(atomic.LoadInt64(&q.count))
 }
 
+// Size returns the total data size of pending items in bytes
+func (q *Queue) Size() int64 {
+	return atomic.LoadInt64(&q.size)
+}
+
+// LeasesCount returns the number of reserved and delayed items
+func (q *Queue) LeasesCount() (reserved int, delayed int) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, l := range q.leases {
+		if l.delayed {
+			delayed++
+		} else {
+			reserved++
+		}
+	}
+
+	return reserved, delayed
+}
+
+func (q *Queue) BuriedCount() int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return len(q.buried)
+}
+
+// IsEmpty reports whether the queue has no pending, leased, delayed or buried items, no idempotency keys and no held groups
+func (q *Queue) IsEmpty() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return len(q.items) == q.removed && len(q.leases) == 0 && len(q.buried) == 0 && len(q.dead) == 0 && len(q.dedup) == 0 &&
+		len(q.holds) == 0
+}
+
+// UsedAt returns the last time an item was pushed or a consumer came or left
+func (q *Queue) UsedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&q.used))
+}
+
+// Use marks the queue as used now, it is not removed as idle while it is used
+func (q *Queue) Use() {
+	atomic.StoreInt64(&q.used, time.Now().UnixNano())
+}
+
+// Close wakes up all waiting consumers, they get nothing and must check Closed to tell it from a timeout
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	select {
+	case <-q.closed:
+		return
+	default:
+	}
+	close(q.closed)
+
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+func (q *Queue) Closed() bool {
+	select {
+	case <-q.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// Purge removes all items, including leased, delayed and buried ones, and returns their number
+func (q *Queue) Purge() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := len(q.items) - q.removed + len(q.leases) + len(q.buried) + len(q.dead)
+
+	q.items = make([]*Item, 0, 256)
+	q.index = make(map[string]*Item)
+	q.removed = 0
+	q.leases = make(map[string]*lease)
+	q.buried = nil
+	q.dead = nil
+	q.busy = make(map[string]struct{})
+	q.holds = make(map[string]time.Time)
+	q.delayed = make(map[string]string)
+	atomic.StoreInt64(&q.count, 0)
+	atomic.StoreInt64(&q.size, 0)
+	q.credit(q.stored)
+
+	return n
+}
+
 func (q *Queue) Inc() {
+	q.Use()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	atomic.AddInt64(&q.consumersCount, 1)
+	if q.account != nil {
+		atomic.AddInt64(&q.account.consumers, 1)
+	}
+}
+
+// TryInc is Inc which returns ErrQuotaExceeded and counts nothing if the account of the queue has all its consumers
+func (q *Queue) TryInc() error {
+	q.Use()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.account != nil && !reserve(&q.account.consumers, 1, &q.account.maxConsumers) {
+		return ErrQuotaExceeded
+	}
 	atomic.AddInt64(&q.consumersCount, 1)
+
+	return nil
 }
 
 func (q *Queue) Dec() {
+	q.Use()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
 	atomic.AddInt64(&q.consumersCount, -1)
+	if q.account != nil {
+		atomic.AddInt64(&q.account.consumers, -1)
+	}
 }
 
-func (q *Queue) Push(item *Item, isPersistent bool) bool {
+// Push adds the item to the tail, a non-persistent item is added only if the queue has consumers.
+// ErrQuotaExceeded is returned if the account of the queue has not enough bytes left for the item.
+func (q *Queue) Push(item *Item, isPersistent bool) error {
 	if !isPersistent && q.ConsumersCount() == 0 {
-		return false
+		return ErrNoConsumers
 	}
 
+	q.Use()
 	q.mu.Lock()
-	q.items = append(q.items, item)
-	atomic.AddInt64(&q.count, 1)
+	if q.full() {
+		q.mu.Unlock()
+		return ErrFull
+	}
+	if !q.charge(int64(len(item.Data)), false) {
+		q.mu.Unlock()
+		return ErrQuotaExceeded
+	}
+	q.enqueue(false, item)
 	q.mu.Unlock()
-	q.signal()
+	q.signal(item)
 
-	return true
+	return nil
 }
 
-func (q *Queue) Pop(ctx context.Context) *Item {
+// PushDelayed adds the item to the tail of the queue after the delay, the limit is checked at the time of the call
+func (q *Queue) PushDelayed(item *Item, delay time.Duration) error {
+	q.Use()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.full() {
+		return ErrFull
+	}
+	if !q.charge(int64(len(item.Data)), false) {
+		return ErrQuotaExceeded
+	}
+	receipt := rand.Text()
+	q.leases[receipt] = &lease{item: item, deadline: time.Now().Add(delay), delayed: true}
+	q.delay(item, receipt)
+
+	return nil
+}
+
+// Notify returns a channel which is closed when items are added to the queue
+func (q *Queue) Notify() <-chan struct{} {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.notify
+}
+
+// Pop takes the first item, or the first item accepted by match if it is not nil.
+// Items skipped by match stay in place for other consumers. Items of busy groups are skipped too,
+// the group of the taken item stays busy for the hold period, or is not held at all if hold is zero.
+func (q *Queue) Pop(ctx context.Context, match func(*Item) bool, hold time.Duration) *Item {
+	if match == nil {
+		return q.pop(ctx, hold)
+	}
+
 	for {
 		q.mu.Lock()
-		if len(q.items) > 0 {
-			v := q.items[0]
-			q.items = q.items[1:]
-			atomic.AddInt64(&q.count, -1)
+		if i := q.next(match); i >= 0 {
+			item := q.take(i)
+			q.credit(int64(len(item.Data)))
+			q.hold(item, hold)
 			q.mu.Unlock()
-			return v
+			return item
 		}
+		w := &waiter{match: match, ch: make(chan struct{})}
+		q.waiters[w] = struct{}{}
 		q.mu.Unlock()
 
 		select {
 		case <-ctx.Done():
+			q.mu.Lock()
+			delete(q.waiters, w)
+			q.mu.Unlock()
 			return nil
-		case <-q.notify:
+		case <-q.closed:
+			q.mu.Lock()
+			delete(q.waiters, w)
+			q.mu.Unlock()
+			return nil
+		case <-w.ch:
 		}
 	}
 }
 
-func (q *Queue) signal() {
+func (q *Queue) pop(ctx context.Context, hold time.Duration) *Item {
+	for {
+		q.mu.Lock()
+		if i := q.next(nil); i >= 0 {
+			item := q.take(i)
+			q.credit(int64(len(item.Data)))
+			q.hold(item, hold)
+			q.mu.Unlock()
+			return item
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.closed:
+			return nil
+		case <-notify:
+		}
+	}
+}
+
+// Reserve pops an item and keeps it leased for the visibility period.
+// The item returns to the queue unless it is acknowledged with the returned receipt before the lease expires.
+func (q *Queue) Reserve(ctx context.Context, visibility time.Duration) (*Item, string) {
+	for {
+		notify := q.Notify()
+
+		item, receipt := q.TryReserve(visibility)
+		if item != nil {
+			return item, receipt
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ""
+		case <-q.closed:
+			return nil, ""
+		case <-notify:
+		}
+	}
+}
+
+// TryReserve is the non-blocking Reserve, it returns nil if the queue has no available items.
+// The group of the reserved item is busy until the lease ends.
+func (q *Queue) TryReserve(visibility time.Duration) (*Item, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	i := q.next(nil)
+	if i < 0 {
+		return nil, ""
+	}
+	item := q.take(i)
+	item.Receives++
+	if item.Group != "" {
+		q.busy[item.Group] = struct{}{}
+	}
+
+	receipt := rand.Text()
+	q.leases[receipt] = &lease{item: item, deadline: time.Now().Add(visibility)}
+
+	return item, receipt
+}
+
+// next returns the index of the first item accepted by match whose group is not busy, or -1.
+// Removed items at the head are dropped on the way.
+func (q *Queue) next(match func(*Item) bool) int {
+	for len(q.items) > 0 && q.items[0].removed {
+		q.items = q.items[1:]
+		q.removed--
+	}
+
+	for i, item := range q.items {
+		if item.removed {
+			continue
+		}
+		if item.Group != "" {
+			if _, ok := q.busy[item.Group]; ok {
+				continue
+			}
+		}
+		if match == nil || match(item) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// take removes the item at the index, the head is cut off without copying
+func (q *Queue) take(i int) *Item {
+	item := q.items[i]
+	if i == 0 {
+		q.items = q.items[1:]
+	} else {
+		q.items = slices.Delete(q.items, i, i+1)
+	}
+	delete(q.index, item.ID)
+	atomic.AddInt64(&q.count, -1)
+	atomic.AddInt64(&q.size, -int64(len(item.Data)))
+
+	return item
+}
+
+// hold keeps the group of the popped item busy until the period ends
+func (q *Queue) hold(item *Item, period time.Duration) {
+	if item.Group == "" || period <= 0 {
+		return
+	}
+	q.busy[item.Group] = struct{}{}
+	q.holds[item.Group] = time.Now().Add(period)
+}
+
+// unblock frees the group of the item and returns the next pending item of the group to signal about
+func (q *Queue) unblock(item *Item) *Item {
+	return q.unblockGroup(item.Group)
+}
+
+func (q *Queue) unblockGroup(group string) *Item {
+	if group == "" {
+		return nil
+	}
+	// the group of a popped item stays busy until Requeue ends its hold
+	if _, ok := q.holds[group]; ok {
+		return nil
+	}
+	delete(q.busy, group)
+
+	for _, v := range q.items {
+		if v.Group == group && !v.removed {
+			return v
+		}
+	}
+
+	return nil
+}
+
+// Ack removes the leased item for good
+func (q *Queue) Ack(receipt string) bool {
+	q.mu.Lock()
+	l, ok := q.leases[receipt]
+	if !ok || l.delayed {
+		q.mu.Unlock()
+		return false
+	}
+	delete(q.leases, receipt)
+	q.credit(int64(len(l.item.Data)))
+	next := q.unblock(l.item)
+	q.mu.Unlock()
+	if next != nil {
+		q.signal(next)
+	}
+
+	return true
+}
+
+// Release returns the leased item to the head of the queue after the delay, or makes it dead if it used all its receives.
+// The delayed item cannot be acknowledged or touched anymore, its group stays busy until it returns.
+func (q *Queue) Release(receipt string, delay time.Duration) bool {
+	q.mu.Lock()
+	l, ok := q.leases[receipt]
+	if !ok || l.delayed {
+		q.mu.Unlock()
+		return false
+	}
+	if delay > 0 && !q.isDead(l.item) {
+		l.delayed = true
+		l.released = true
+		l.deadline = time.Now().Add(delay)
+		q.delay(l.item, receipt)
+		q.mu.Unlock()
+		return true
+	}
+	delete(q.leases, receipt)
+	next := q.unblock(l.item)
+	if q.isDead(l.item) {
+		q.dead = append(q.dead, l.item)
+	} else {
+		q.enqueue(true, l.item)
+		next = l.item
+	}
+	q.mu.Unlock()
+	if next != nil {
+		q.signal(next)
+	}
+
+	return true
+}
+
+// Touch moves the lease deadline to visibility from now
+func (q *Queue) Touch(receipt string, visibility time.Duration) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.leases[receipt]
+	if !ok || l.delayed {
+		return false
+	}
+	l.deadline = time.Now().Add(visibility)
+
+	return true
+}
+
+// Bury moves the leased item aside, it is not delivered until kicked, and lets the next item of its group go
+func (q *Queue) Bury(receipt string) bool {
+	q.mu.Lock()
+	l, ok := q.leases[receipt]
+	if !ok || l.delayed {
+		q.mu.Unlock()
+		return false
+	}
+	delete(q.leases, receipt)
+	q.buried = append(q.buried, l.item)
+	next := q.unblock(l.item)
+	q.mu.Unlock()
+	if next != nil {
+		q.signal(next)
+	}
+
+	return true
+}
+
+// Kick moves up to bound buried items to the tail of the queue
+func (q *Queue) Kick(bound int) int {
+	q.mu.Lock()
+	n := min(bound, len(q.buried))
+	if n <= 0 {
+		q.mu.Unlock()
+		return 0
+	}
+	kicked := q.buried[:n]
+	q.enqueue(false, kicked...)
+	q.buried = q.buried[n:]
+	q.mu.Unlock()
+	q.signal(kicked...)
+
+	return n
+}
+
+// Requeue returns items with expired leases and released delayed items to the head of the queue and other delayed
+// items to the tail.
+// Items with expired leases which used all their receives become dead instead. Groups with expired holds are freed.
+func (q *Queue) Requeue(now time.Time) int {
+	q.mu.Lock()
+	var expired, delayed, unblocked []*Item
+	for group, deadline := range q.holds {
+		if deadline.After(now) {
+			continue
+		}
+		delete(q.holds, group)
+		if next := q.unblockGroup(group); next != nil {
+			unblocked = append(unblocked, next)
+		}
+	}
+	for receipt, l := range q.leases {
+		if l.deadline.After(now) {
+			continue
+		}
+		delete(q.leases, receipt)
+		if l.delayed {
+			delete(q.delayed, l.item.ID)
+		}
+		switch {
+		case l.released:
+			q.unblock(l.item)
+			expired = append(expired, l.item)
+		case l.delayed:
+			delayed = append(delayed, l.item)
+		case q.isDead(l.item):
+			if next := q.unblock(l.item); next != nil {
+				unblocked = append(unblocked, next)
+			}
+			q.dead = append(q.dead, l.item)
+		default:
+			q.unblock(l.item)
+			expired = append(expired, l.item)
+		}
+	}
+	n := len(expired) + len(delayed)
+	if n == 0 && len(unblocked) == 0 {
+		q.mu.Unlock()
+		return 0
+	}
+	q.enqueue(true, expired...)
+	q.enqueue(false, delayed...)
+	q.mu.Unlock()
+	q.signal(slices.Concat(expired, delayed, unblocked)...)
+
+	return n
+}
+
+// signal wakes up all consumers without a filter and the waiters matching any of the added items
+func (q *Queue) signal(items ...*Item) {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
 	close(q.notify)
 	q.notify = make(chan struct{})
+
+	for w := range q.waiters {
+		if slices.ContainsFunc(items, w.match) {
+			close(w.ch)
+			delete(q.waiters, w)
+		}
+	}
 }
@@ -0,0 +1,402 @@
+package queue
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func item(id string, group string, headers map[string]string) *Item {
+	return &Item{ID: id, Data: "data-" + id, Group: group, Headers: headers}
+}
+
+func push(t *testing.T, q *Queue, items ...*Item) {
+	t.Helper()
+
+	for _, it := range items {
+		errPush := q.Push(it, true)
+		if errPush != nil {
+			t.Fatalf("push %s: %v", it.ID, errPush)
+		}
+	}
+}
+
+func ids(items []*Item) []string {
+	result := make([]string, 0, len(items))
+	for _, it := range items {
+		result = append(result, it.ID)
+	}
+
+	return result
+}
+
+// popAll takes items until the queue has none available
+func popAll(q *Queue, match func(*Item) bool, hold time.Duration) []*Item {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var items []*Item
+	for {
+		// the cancelled context still takes an available item, the queue is checked before waiting
+		it := q.Pop(ctx, match, hold)
+		if it == nil {
+			return items
+		}
+		items = append(items, it)
+	}
+}
+
+func TestPopFilter(t *testing.T) {
+	red := map[string]string{"color": "red"}
+	blue := map[string]string{"color": "blue"}
+
+	tests := []struct {
+		name   string
+		filter map[string]string
+		want   []string
+		rest   []string
+	}{
+		{name: "no filter", filter: nil, want: []string{"1", "2", "3"}, rest: nil},
+		{name: "red", filter: red, want: []string{"1", "3"}, rest: []string{"2"}},
+		{name: "blue", filter: blue, want: []string{"2"}, rest: []string{"1", "3"}},
+		{name: "unknown", filter: map[string]string{"size": "xl"}, want: nil, rest: []string{"1", "2", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New("test")
+			push(t, q, item("1", "", red), item("2", "", blue), item("3", "", red))
+
+			var match func(*Item) bool
+			if tt.filter != nil {
+				match = func(it *Item) bool {
+					for k, v := range tt.filter {
+						if it.Headers[k] != v {
+							return false
+						}
+					}
+					return true
+				}
+			}
+
+			got := ids(popAll(q, match, 0))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("popped %v, want %v", got, tt.want)
+			}
+			rest := ids(popAll(q, nil, 0))
+			if !slices.Equal(rest, tt.rest) {
+				t.Errorf("left %v, want %v", rest, tt.rest)
+			}
+		})
+	}
+}
+
+func TestPopWakesMatchingWaiter(t *testing.T) {
+	q := New("test")
+
+	got := make(chan *Item, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		got <- q.Pop(ctx, func(it *Item) bool { return it.Headers["k"] == "v" }, 0)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	push(t, q, item("1", "", nil), item("2", "", map[string]string{"k": "v"}))
+
+	it := <-got
+	if it == nil || it.ID != "2" {
+		t.Fatalf("popped %v, want 2", it)
+	}
+	if q.Count() != 1 {
+		t.Errorf("count %d, want 1", q.Count())
+	}
+}
+
+func TestReserveGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		// ack acknowledges the first reserved item before the second round of reserves
+		ack    bool
+		first  []string
+		second []string
+	}{
+		{name: "one item per group", ack: false, first: []string{"a1", "b1", "n1", "n2"}, second: nil},
+		{name: "ack frees the group", ack: true, first: []string{"a1", "b1", "n1", "n2"}, second: []string{"a2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New("test")
+			push(t, q, item("a1", "a", nil), item("a2", "a", nil), item("b1", "b", nil), item("n1", "", nil), item("n2", "", nil))
+
+			reserveAll := func() ([]string, []string) {
+				var got, receipts []string
+				for {
+					it, receipt := q.TryReserve(time.Minute)
+					if it == nil {
+						return got, receipts
+					}
+					got = append(got, it.ID)
+					receipts = append(receipts, receipt)
+				}
+			}
+
+			got, receipts := reserveAll()
+			if !slices.Equal(got, tt.first) {
+				t.Fatalf("reserved %v, want %v", got, tt.first)
+			}
+			if tt.ack && !q.Ack(receipts[0]) {
+				t.Fatal("ack failed")
+			}
+			got, _ = reserveAll()
+			if !slices.Equal(got, tt.second) {
+				t.Errorf("reserved %v after the first round, want %v", got, tt.second)
+			}
+		})
+	}
+}
+
+func TestGroupReleaseKeepsOrder(t *testing.T) {
+	q := New("test")
+	push(t, q, item("a1", "a", nil), item("a2", "a", nil))
+
+	it, receipt := q.TryReserve(time.Minute)
+	if it == nil || it.ID != "a1" {
+		t.Fatalf("reserved %v, want a1", it)
+	}
+	if !q.Release(receipt, 0) {
+		t.Fatal("release failed")
+	}
+
+	it, _ = q.TryReserve(time.Minute)
+	if it == nil || it.ID != "a1" {
+		t.Fatalf("reserved %v after release, want a1 again", it)
+	}
+	if it.Receives != 2 {
+		t.Errorf("receives %d, want 2", it.Receives)
+	}
+}
+
+func TestPopHoldsGroup(t *testing.T) {
+	tests := []struct {
+		name  string
+		hold  time.Duration
+		first []string
+		after []string
+	}{
+		{name: "no hold", hold: 0, first: []string{"a1", "a2", "b1"}, after: nil},
+		{name: "hold", hold: time.Minute, first: []string{"a1", "b1"}, after: []string{"a2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New("test")
+			push(t, q, item("a1", "a", nil), item("a2", "a", nil), item("b1", "b", nil))
+
+			got := ids(popAll(q, nil, tt.hold))
+			if !slices.Equal(got, tt.first) {
+				t.Fatalf("popped %v, want %v", got, tt.first)
+			}
+			if _, receipt := q.TryReserve(time.Minute); tt.hold > 0 && receipt != "" {
+				t.Error("reserved an item of the held group")
+			}
+
+			q.Requeue(time.Now().Add(tt.hold + time.Second))
+			got = ids(popAll(q, nil, tt.hold))
+			if !slices.Equal(got, tt.after) {
+				t.Errorf("popped %v after the hold, want %v", got, tt.after)
+			}
+		})
+	}
+}
+
+func TestGroupHoldSnapshot(t *testing.T) {
+	q := New("test")
+	push(t, q, item("a1", "a", nil), item("a2", "a", nil), item("b1", "b", nil))
+	if got := ids(popAll(q, func(it *Item) bool { return it.Group == "a" }, time.Minute)); !slices.Equal(got, []string{"a1"}) {
+		t.Fatalf("popped %v, want [a1]", got)
+	}
+	// nothing else of the group can free it before the hold ends
+	q.mu.Lock()
+	q.unblockGroup("a")
+	q.mu.Unlock()
+
+	data, errSnapshot := q.ToSnapshot()
+	if errSnapshot != nil {
+		t.Fatal(errSnapshot)
+	}
+	restored := New("test")
+	errRestore := restored.FromSnapshot(data)
+	if errRestore != nil {
+		t.Fatal(errRestore)
+	}
+
+	for name, q := range map[string]*Queue{"queue": q, "restored": restored} {
+		if _, receipt := q.TryReserve(time.Minute); !q.Ack(receipt) {
+			t.Fatalf("%s: b1 not reserved", name)
+		}
+		if it, _ := q.TryReserve(time.Minute); it != nil {
+			t.Errorf("%s: reserved %s of the held group", name, it.ID)
+		}
+		q.Requeue(time.Now().Add(time.Minute + time.Second))
+		if it, _ := q.TryReserve(time.Minute); it == nil || it.ID != "a2" {
+			t.Errorf("%s: reserved %v after the hold, want a2", name, it)
+		}
+	}
+}
+
+func TestReleaseDelay(t *testing.T) {
+	q := New("test")
+	push(t, q, item("a1", "a", nil), item("a2", "a", nil), item("n1", "", nil))
+
+	it, receipt := q.TryReserve(time.Minute)
+	if it.ID != "a1" {
+		t.Fatalf("reserved %s, want a1", it.ID)
+	}
+	if !q.Release(receipt, time.Minute) {
+		t.Fatal("release failed")
+	}
+	if q.Ack(receipt) || q.Touch(receipt, time.Minute) {
+		t.Error("released item is still leased")
+	}
+	if reserved, delayed := q.LeasesCount(); reserved != 0 || delayed != 1 {
+		t.Errorf("leases reserved %d delayed %d, want 0 and 1", reserved, delayed)
+	}
+
+	// the group waits for the delayed item
+	it, receipt = q.TryReserve(time.Minute)
+	if it == nil || it.ID != "n1" {
+		t.Fatalf("reserved %v, want n1", it)
+	}
+	q.Ack(receipt)
+	if it, _ = q.TryReserve(time.Minute); it != nil {
+		t.Fatalf("reserved %s while the group is delayed", it.ID)
+	}
+
+	q.Requeue(time.Now().Add(2 * time.Minute))
+	it, _ = q.TryReserve(time.Minute)
+	if it == nil || it.ID != "a1" {
+		t.Fatalf("reserved %v after the delay, want a1", it)
+	}
+	if it.Receives != 2 {
+		t.Errorf("receives %d, want 2", it.Receives)
+	}
+}
+
+func TestDeleteDelayed(t *testing.T) {
+	q := New("test")
+	push(t, q, item("a1", "a", nil), item("a2", "a", nil))
+	if errPush := q.PushDelayed(item("d1", "", nil), time.Minute); errPush != nil {
+		t.Fatal(errPush)
+	}
+	_, receipt := q.TryReserve(time.Minute)
+	if !q.Release(receipt, time.Minute) {
+		t.Fatal("release failed")
+	}
+
+	for _, id := range []string{"d1", "a1"} {
+		if !q.Delete(id) {
+			t.Errorf("delayed %s not deleted", id)
+		}
+	}
+	if reserved, delayed := q.LeasesCount(); reserved != 0 || delayed != 0 {
+		t.Errorf("leases reserved %d delayed %d, want none", reserved, delayed)
+	}
+
+	// the group of the deleted released item is free again
+	it, _ := q.TryReserve(time.Minute)
+	if it == nil || it.ID != "a2" {
+		t.Fatalf("reserved %v, want a2", it)
+	}
+	q.Requeue(time.Now().Add(2 * time.Minute))
+	if got := ids(popAll(q, nil, 0)); !slices.Equal(got, []string{"a2"}) {
+		t.Errorf("popped %v after the delays, want [a2]", got)
+	}
+}
+
+func TestPeekAndDelete(t *testing.T) {
+	tests := []struct {
+		name   string
+		delete []string
+		offset int
+		limit  int
+		want   []string
+		count  int
+	}{
+		{name: "all", offset: 0, limit: 10, want: []string{"1", "2", "3", "4"}, count: 4},
+		{name: "page", offset: 1, limit: 2, want: []string{"2", "3"}, count: 4},
+		{name: "offset past the end", offset: 4, limit: 2, want: nil, count: 4},
+		{name: "zero limit", offset: 0, limit: 0, want: nil, count: 4},
+		{name: "deleted are skipped", delete: []string{"2"}, offset: 0, limit: 10, want: []string{"1", "3", "4"}, count: 3},
+		{name: "deleted shift pages", delete: []string{"1", "2"}, offset: 1, limit: 10, want: []string{"4"}, count: 2},
+		{name: "unknown is not deleted", delete: []string{"x"}, offset: 0, limit: 10, want: []string{"1", "2", "3", "4"}, count: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := New("test")
+			push(t, q, item("1", "", nil), item("2", "", nil), item("3", "", nil), item("4", "", nil))
+
+			for _, id := range tt.delete {
+				if q.Delete(id) != (id != "x") {
+					t.Fatalf("delete %s", id)
+				}
+			}
+
+			var got []string
+			for _, v := range q.Peek(tt.offset, tt.limit) {
+				got = append(got, v.ID)
+				if v.State != StatePending {
+					t.Errorf("state %s, want %s", v.State, StatePending)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("peeked %v, want %v", got, tt.want)
+			}
+			if q.Count() != tt.count {
+				t.Errorf("count %d, want %d", q.Count(), tt.count)
+			}
+		})
+	}
+}
+
+func TestDeletedItemIsNotDelivered(t *testing.T) {
+	q := New("test")
+	push(t, q, item("1", "", nil), item("2", "", nil))
+
+	if !q.Delete("1") {
+		t.Fatal("delete failed")
+	}
+	if q.Delete("1") {
+		t.Error("deleted twice")
+	}
+
+	got := ids(popAll(q, nil, 0))
+	if !slices.Equal(got, []string{"2"}) {
+		t.Errorf("popped %v, want [2]", got)
+	}
+	if q.Count() != 0 || q.Size() != 0 {
+		t.Errorf("count %d size %d, want 0", q.Count(), q.Size())
+	}
+}
+
+func TestBrowseStates(t *testing.T) {
+	q := New("test")
+	push(t, q, item("1", "", nil), item("2", "", nil), item("3", "", nil))
+	_, receipt := q.TryReserve(time.Minute)
+	q.TryReserve(time.Minute)
+	if !q.Bury(receipt) {
+		t.Fatal("bury failed")
+	}
+
+	var got []string
+	for _, v := range q.Browse(0, 10) {
+		got = append(got, v.ID+":"+v.State)
+	}
+	want := []string{"3:" + StatePending, "2:" + StateReserved, "1:" + StateBuried}
+	if !slices.Equal(got, want) {
+		t.Errorf("browsed %v, want %v", got, want)
+	}
+}
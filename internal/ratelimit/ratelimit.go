@@ -0,0 +1,169 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+// anySubject in a rule gives every principal or topic its own bucket
+const anySubject = "*"
+
+// pruneInterval is how often full buckets are removed, a missing bucket is the same as a full one
+const pruneInterval = time.Minute
+
+// bucket holds tokens refilled at the rate of its rule up to the burst
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// Limiter applies token bucket rate limits to actions of principals and on topics, it can be replaced while in use
+type Limiter struct {
+	mu      sync.Mutex
+	rules   []config.RateLimit
+	buckets map[key]*bucket
+}
+
+// key is the bucket of the rule for one principal or topic, the rule itself is the key, so reloads keep buckets of unchanged rules
+type key struct {
+	rule    config.RateLimit
+	subject string
+}
+
+func New() *Limiter {
+	return &Limiter{buckets: make(map[key]*bucket)}
+}
+
+// Set replaces the rules and reports whether they differ from the previous ones.
+// Buckets of unchanged rules are kept, buckets of new rules start full.
+// Rules must be validated by config.File.Validate.
+func (l *Limiter) Set(rules []config.RateLimit) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	changed := !reflect.DeepEqual(l.rules, rules) && len(l.rules)+len(rules) > 0
+	l.rules = slices.Clone(rules)
+	for k := range l.buckets {
+		if !slices.Contains(l.rules, k.rule) {
+			delete(l.buckets, k)
+		}
+	}
+
+	return changed
+}
+
+// Run removes buckets which are full again until the context is done, so idle principals and topics are not kept
+func (l *Limiter) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.prune(time.Now())
+		}
+	}
+}
+
+func (l *Limiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*k.rule.Rate >= burst(&k.rule) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// Allow takes a token from every bucket matching the action of the principal on the topic.
+// If any of them is empty, nothing is taken and the time until all of them have a token is returned.
+func (l *Limiter) Allow(principal string, topic string, action string) (time.Duration, bool) {
+	return l.AllowAny(principal, []string{topic}, action)
+}
+
+// AllowAny is Allow for one request on any of the topics, like a reserve from several watched ones.
+// A token is taken from buckets of the principal once and from buckets of each of the topics.
+func (l *Limiter) AllowAny(principal string, topics []string, action string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.rules) == 0 {
+		return 0, true
+	}
+
+	now := time.Now()
+
+	var wait time.Duration
+	var matched []*bucket
+	for _, rule := range l.rules {
+		if rule.Action != action {
+			continue
+		}
+
+		subjects := []string{principal}
+		pattern := rule.Principal
+		if rule.Topic != "" {
+			subjects = topics
+			pattern = rule.Topic
+		}
+		for _, subject := range subjects {
+			if pattern != anySubject && pattern != subject {
+				continue
+			}
+
+			b := l.bucket(key{rule: rule, subject: subject}, now)
+			// identical rules share the bucket, a token is taken from it once
+			if slices.Contains(matched, b) {
+				continue
+			}
+			if b.tokens < 1 {
+				wait = max(wait, time.Duration((1-b.tokens)/rule.Rate*float64(time.Second)))
+			}
+			matched = append(matched, b)
+		}
+	}
+
+	if wait > 0 {
+		return wait, false
+	}
+	for _, b := range matched {
+		b.tokens--
+	}
+
+	return 0, true
+}
+
+// burst is the capacity of buckets of the rule
+func burst(rule *config.RateLimit) float64 {
+	if rule.Burst == 0 {
+		return math.Max(1, math.Ceil(rule.Rate))
+	}
+
+	return float64(rule.Burst)
+}
+
+// bucket returns the bucket refilled up to now, a new bucket is full
+func (l *Limiter) bucket(k key, now time.Time) *bucket {
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &bucket{tokens: burst(&k.rule), updated: now}
+		l.buckets[k] = b
+		return b
+	}
+
+	b.tokens = math.Min(burst(&k.rule), b.tokens+now.Sub(b.updated).Seconds()*k.rule.Rate)
+	b.updated = now
+
+	return b
+}
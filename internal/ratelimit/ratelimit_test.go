@@ -0,0 +1,176 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ssqueue/ssqueue/internal/config"
+)
+
+func TestAllow(t *testing.T) {
+	byPrincipal := config.RateLimit{Principal: "bob", Action: config.ActionSend, Rate: 1, Burst: 2}
+	byAnyTopic := config.RateLimit{Topic: "*", Action: config.ActionSend, Rate: 1, Burst: 1}
+
+	type call struct {
+		principal string
+		topic     string
+		action    string
+		want      bool
+	}
+
+	tests := []struct {
+		name  string
+		rules []config.RateLimit
+		calls []call
+	}{
+		{
+			name:  "no rules",
+			rules: nil,
+			calls: []call{{"bob", "a", config.ActionSend, true}, {"bob", "a", config.ActionSend, true}},
+		},
+		{
+			name:  "burst of the principal",
+			rules: []config.RateLimit{byPrincipal},
+			calls: []call{
+				{"bob", "a", config.ActionSend, true},
+				{"bob", "b", config.ActionSend, true},
+				{"bob", "c", config.ActionSend, false},
+				{"alice", "a", config.ActionSend, true},
+				{"bob", "a", config.ActionGet, true},
+			},
+		},
+		{
+			name:  "bucket per topic",
+			rules: []config.RateLimit{byAnyTopic},
+			calls: []call{
+				{"bob", "a", config.ActionSend, true},
+				{"alice", "a", config.ActionSend, false},
+				{"alice", "b", config.ActionSend, true},
+			},
+		},
+		{
+			name:  "all rules must allow",
+			rules: []config.RateLimit{byPrincipal, byAnyTopic},
+			calls: []call{
+				{"bob", "a", config.ActionSend, true},
+				// the principal has a token left, but the topic has none, so nothing is taken
+				{"bob", "a", config.ActionSend, false},
+				{"bob", "b", config.ActionSend, true},
+				{"bob", "c", config.ActionSend, false},
+			},
+		},
+		{
+			name:  "identical rules share the bucket",
+			rules: []config.RateLimit{byPrincipal, byPrincipal},
+			calls: []call{
+				{"bob", "a", config.ActionSend, true},
+				{"bob", "a", config.ActionSend, true},
+				{"bob", "a", config.ActionSend, false},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New()
+			l.Set(tt.rules)
+
+			for i, c := range tt.calls {
+				wait, ok := l.Allow(c.principal, c.topic, c.action)
+				if ok != c.want {
+					t.Errorf("call %d: allowed %v, want %v", i, ok, c.want)
+				}
+				if !ok && wait <= 0 {
+					t.Errorf("call %d: denied without wait", i)
+				}
+			}
+		})
+	}
+}
+
+func TestAllowAny(t *testing.T) {
+	byPrincipal := config.RateLimit{Principal: "bob", Action: config.ActionGet, Rate: 1, Burst: 2}
+	byTopic := config.RateLimit{Topic: "b", Action: config.ActionGet, Rate: 1, Burst: 1}
+
+	l := New()
+	l.Set([]config.RateLimit{byPrincipal, byTopic})
+
+	calls := []struct {
+		topics []string
+		want   bool
+	}{
+		// the principal is charged once for both topics
+		{topics: []string{"a", "b"}, want: true},
+		// the topic b has no token left
+		{topics: []string{"a", "b"}, want: false},
+		{topics: []string{"a"}, want: true},
+		{topics: []string{"a"}, want: false},
+	}
+
+	for i, c := range calls {
+		if _, ok := l.AllowAny("bob", c.topics, config.ActionGet); ok != c.want {
+			t.Errorf("call %d: allowed %v, want %v", i, ok, c.want)
+		}
+	}
+}
+
+func TestSetKeepsBuckets(t *testing.T) {
+	rule := config.RateLimit{Principal: "bob", Action: config.ActionSend, Rate: 0.001, Burst: 1}
+	other := config.RateLimit{Principal: "alice", Action: config.ActionSend, Rate: 0.001, Burst: 1}
+
+	tests := []struct {
+		name   string
+		reload []config.RateLimit
+		want   bool
+	}{
+		{name: "unchanged rule", reload: []config.RateLimit{rule}, want: false},
+		{name: "rule added", reload: []config.RateLimit{other, rule}, want: false},
+		{name: "rule changed", reload: []config.RateLimit{{Principal: "bob", Action: config.ActionSend, Rate: 0.001, Burst: 2}}, want: true},
+		{name: "rule removed and added back", reload: nil, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New()
+			l.Set([]config.RateLimit{rule})
+			if _, ok := l.Allow("bob", "a", config.ActionSend); !ok {
+				t.Fatal("first call denied")
+			}
+
+			l.Set(tt.reload)
+			l.Set([]config.RateLimit{rule})
+
+			if _, ok := l.Allow("bob", "a", config.ActionSend); ok != tt.want {
+				t.Errorf("allowed %v after reload, want %v", ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	rule := config.RateLimit{Principal: "*", Action: config.ActionSend, Rate: 1, Burst: 2}
+
+	l := New()
+	l.Set([]config.RateLimit{rule})
+	l.Allow("bob", "a", config.ActionSend)
+	l.Allow("alice", "a", config.ActionSend)
+	l.Allow("alice", "a", config.ActionSend)
+
+	now := time.Now()
+	tests := []struct {
+		name string
+		at   time.Time
+		want int
+	}{
+		{name: "both are refilling", at: now, want: 2},
+		{name: "bob is full", at: now.Add(1500 * time.Millisecond), want: 1},
+		{name: "alice is full", at: now.Add(3 * time.Second), want: 0},
+	}
+
+	for _, tt := range tests {
+		l.prune(tt.at)
+		if len(l.buckets) != tt.want {
+			t.Errorf("%s: %d buckets, want %d", tt.name, len(l.buckets), tt.want)
+		}
+	}
+}
@@ -2,23 +2,44 @@ package service
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/negasus/tlog"
+
+	"github.com/ssqueue/ssqueue/internal/audit"
+	"github.com/ssqueue/ssqueue/internal/auth"
+	"github.com/ssqueue/ssqueue/internal/messages"
+)
+
+const (
+	defaultBrowseLimit = 100
+	maxBrowseLimit     = 1000
+	defaultAuditLimit  = 100
 )
 
+// Application is the part of the application used by the admin endpoints
+type Application interface {
+	Browse(ctx context.Context, topic string, offset int, limit int) ([]messages.MessageInfo, error)
+	Tenants(ctx context.Context) []messages.TenantUsage
+}
+
 type Service struct {
 	h                    *tlog.Handler
+	app                  Application
+	tokens               *auth.Tokens
+	audit                *audit.Log
 	exposeProcessMetrics bool
 }
 
-func New(h *tlog.Handler) *Service {
-	return &Service{h: h}
+func New(h *tlog.Handler, app Application, tokens *auth.Tokens, auditLog *audit.Log) *Service {
+	return &Service{h: h, app: app, tokens: tokens, audit: auditLog}
 }
 
 func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener) {
@@ -31,8 +52,12 @@ func (s *Service) Run(ctx context.Context, wg *sync.WaitGroup, ln net.Listener)
 	})
 	mux.HandleFunc("/log/tag/on", s.handlerTag(s.h.TagOn))
 	mux.HandleFunc("/log/tag/off", s.handlerTag(s.h.TagOff))
+	mux.HandleFunc("GET /admin/topics/{topic}/messages", s.handlerBrowse)
+	mux.HandleFunc("GET /admin/audit", s.handlerAudit)
+	mux.HandleFunc("GET /admin/tenants", s.handlerTenants)
 
-	server := &http.Server{Handler: mux}
+	// the liveness probe stays open, probes usually have no credentials
+	server := &http.Server{Handler: s.tokens.Middleware(mux, "/liveness")}
 
 	wg.Add(1)
 	go func() {
@@ -75,3 +100,114 @@ func (s *Service) handlerTag(tagFunc func(tag string)) func(http.ResponseWriter,
 		}
 	}
 }
+
+// handlerBrowse lists all messages of the topic with their states, including reserved, delayed and buried ones
+func (s *Service) handlerBrowse(rw http.ResponseWriter, req *http.Request) {
+	type message struct {
+		ID    string  `json:"id"`
+		Name  string  `json:"name,omitempty"`
+		Age   float64 `json:"age"`
+		Size  int     `json:"size"`
+		State string  `json:"state"`
+	}
+
+	type response struct {
+		Messages []message `json:"messages"`
+	}
+
+	offset, limit := 0, defaultBrowseLimit
+	var err error
+	if v := req.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			http.Error(rw, "invalid offset", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := req.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxBrowseLimit {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	infos, errBrowse := s.app.Browse(req.Context(), req.PathValue("topic"), offset, limit)
+	if errBrowse != nil {
+		slog.Error("error browse topic", slog.String("error", errBrowse.Error()))
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	resp := response{Messages: make([]message, 0, len(infos))}
+	for _, info := range infos {
+		resp.Messages = append(resp.Messages, message{ID: info.ID, Name: info.Name, Age: info.Age.Seconds(), Size: info.Size, State: info.State})
+	}
+
+	sendJSON(rw, resp)
+}
+
+// handlerAudit returns the latest audit records, newest first, optionally only with the action
+func (s *Service) handlerAudit(rw http.ResponseWriter, req *http.Request) {
+	type response struct {
+		Records []audit.Record `json:"records"`
+	}
+
+	limit := defaultAuditLimit
+	if v := req.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			http.Error(rw, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	records := s.audit.Recent(req.URL.Query().Get("action"), limit)
+	if records == nil {
+		records = []audit.Record{}
+	}
+
+	sendJSON(rw, response{Records: records})
+}
+
+// handlerTenants returns the usage of tenant quotas, zero limits are unlimited
+func (s *Service) handlerTenants(rw http.ResponseWriter, req *http.Request) {
+	type tenant struct {
+		Name         string `json:"name"`
+		Topics       int    `json:"topics"`
+		Bytes        int64  `json:"bytes"`
+		Consumers    int    `json:"consumers"`
+		MaxTopics    int    `json:"max_topics"`
+		MaxBytes     int64  `json:"max_bytes"`
+		MaxConsumers int    `json:"max_consumers"`
+	}
+
+	type response struct {
+		Tenants []tenant `json:"tenants"`
+	}
+
+	usage := s.app.Tenants(req.Context())
+
+	resp := response{Tenants: make([]tenant, 0, len(usage))}
+	for _, u := range usage {
+		resp.Tenants = append(resp.Tenants, tenant(u))
+	}
+
+	sendJSON(rw, resp)
+}
+
+func sendJSON(rw http.ResponseWriter, v any) {
+	data, errEncode := json.Marshal(v)
+	if errEncode != nil {
+		slog.Error("error encode response", slog.String("error", errEncode.Error()))
+		http.Error(rw, "error encode response", http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	_, errWrite := rw.Write(data)
+	if errWrite != nil {
+		slog.Error("error write response", slog.String("error", errWrite.Error()))
+	}
+}